@@ -0,0 +1,27 @@
+
+-- Audit trail of every successful write API call.
+
+CREATE  TABLE "public".audit_log (
+	auditid              bigint  NOT NULL GENERATED BY DEFAULT AS IDENTITY  ,
+	api                  text  NOT NULL  ,
+	subject              text    ,
+	auth_level           text  NOT NULL  ,
+	client_ip            text    ,
+	input                jsonb  NOT NULL  ,
+	uname                text    ,
+	groupname            text    ,
+	unitname             text    ,
+	resourcename         text    ,
+	event_time           timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	CONSTRAINT pk_audit_log PRIMARY KEY ( auditid )
+ ) ;
+
+CREATE INDEX idx_audit_log_event_time ON "public".audit_log ( event_time ) ;
+CREATE INDEX idx_audit_log_uname ON "public".audit_log ( uname ) ;
+CREATE INDEX idx_audit_log_groupname ON "public".audit_log ( groupname ) ;
+CREATE INDEX idx_audit_log_unitname ON "public".audit_log ( unitname ) ;
+CREATE INDEX idx_audit_log_api ON "public".audit_log ( api ) ;
+CREATE INDEX idx_audit_log_subject ON "public".audit_log ( lower(subject) ) ;
+
+
+\i grants.sql
@@ -0,0 +1,43 @@
+
+-- Change-event webhooks.  Events are queued in webhook_deliveries by the same transaction as the write API call
+-- and delivered by the server in the background.
+
+CREATE  TABLE "public".webhooks (
+	webhookid            integer  NOT NULL GENERATED BY DEFAULT AS IDENTITY  ,
+	url                  text  NOT NULL  ,
+	secret               text  NOT NULL  ,
+	event_types          text[]    ,
+	unitid               integer    ,
+	compid               integer    ,
+	active               boolean DEFAULT true NOT NULL  ,
+	last_updated         timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	CONSTRAINT pk_webhooks PRIMARY KEY ( webhookid )
+ ) ;
+
+CREATE  TABLE "public".webhook_deliveries (
+	deliveryid           bigint  NOT NULL GENERATED BY DEFAULT AS IDENTITY  ,
+	webhookid            integer  NOT NULL  ,
+	event_type           text  NOT NULL  ,
+	payload              jsonb  NOT NULL  ,
+	attempts             integer DEFAULT 0 NOT NULL  ,
+	next_attempt         timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	delivered            timestamptz    ,
+	abandoned            boolean DEFAULT false NOT NULL  ,
+	last_error           text    ,
+	created              timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	CONSTRAINT pk_webhook_deliveries PRIMARY KEY ( deliveryid )
+ ) ;
+
+CREATE INDEX idx_webhook_deliveries_pending ON "public".webhook_deliveries ( next_attempt ) WHERE delivered IS NULL AND NOT abandoned ;
+
+ALTER TABLE "public".webhooks ADD CONSTRAINT fk_webhooks_affiliation_units FOREIGN KEY ( unitid ) REFERENCES "public".affiliation_units( unitid )   ;
+
+ALTER TABLE "public".webhooks ADD CONSTRAINT fk_webhooks_compute_resources FOREIGN KEY ( compid ) REFERENCES "public".compute_resources( compid )   ;
+
+ALTER TABLE "public".webhook_deliveries ADD CONSTRAINT fk_webhook_deliveries_webhooks FOREIGN KEY ( webhookid ) REFERENCES "public".webhooks( webhookid )   ;
+
+CREATE TRIGGER webhooks_common_update_stamp BEFORE INSERT OR UPDATE ON webhooks
+    FOR EACH ROW EXECUTE PROCEDURE common_update_stamp();
+
+
+\i grants.sql
@@ -0,0 +1,29 @@
+
+-- Per-API and per-affiliation authorization policies.  Accessors without policies keep the access given by accessors.write
+-- to every API.  Accessors with policies can only call the APIs, affiliation units and compute resources their policies allow.
+-- A null api, unitid or compid matches any.
+
+CREATE  TABLE "public".accessor_policies (
+	policyid             integer  NOT NULL GENERATED BY DEFAULT AS IDENTITY  ,
+	accid                bigint  NOT NULL  ,
+	api                  text    ,
+	unitid               integer    ,
+	compid               integer    ,
+	"write"              boolean DEFAULT false NOT NULL  ,
+	last_updated         timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	CONSTRAINT pk_accessor_policies PRIMARY KEY ( policyid )
+ ) ;
+
+CREATE INDEX idx_accessor_policies_accid ON "public".accessor_policies ( accid ) ;
+
+ALTER TABLE "public".accessor_policies ADD CONSTRAINT fk_accessor_policies_accessors FOREIGN KEY ( accid ) REFERENCES "public".accessors( accid )   ;
+
+ALTER TABLE "public".accessor_policies ADD CONSTRAINT fk_accessor_policies_affiliation_units FOREIGN KEY ( unitid ) REFERENCES "public".affiliation_units( unitid )   ;
+
+ALTER TABLE "public".accessor_policies ADD CONSTRAINT fk_accessor_policies_compute_resources FOREIGN KEY ( compid ) REFERENCES "public".compute_resources( compid )   ;
+
+CREATE TRIGGER accessor_policies_common_update_stamp BEFORE INSERT OR UPDATE ON accessor_policies
+    FOR EACH ROW EXECUTE PROCEDURE common_update_stamp();
+
+
+\i grants.sql
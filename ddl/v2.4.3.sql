@@ -0,0 +1,7 @@
+
+-- Address of the trusted reverse proxy a write API call came through, client_ip is then the address of the real client.
+
+ALTER TABLE "public".audit_log ADD COLUMN proxy_ip text ;
+
+
+\i grants.sql
@@ -0,0 +1,28 @@
+
+-- Notify the API servers when accessors or their policies change, so they drop the accessor from their cache as soon as
+-- the change is committed, even when it is made through psql.
+
+CREATE OR REPLACE FUNCTION notify_accessors_changed() RETURNS trigger AS $notify_accessors_changed$
+    BEGIN
+        IF TG_OP='DELETE' then
+            PERFORM pg_notify('accessors_changed', OLD.accid::text);
+        ELSE
+            PERFORM pg_notify('accessors_changed', NEW.accid::text);
+        END IF;
+        RETURN NULL;
+    END;
+$notify_accessors_changed$ LANGUAGE plpgsql;
+
+CREATE TRIGGER accessors_notify_changed AFTER INSERT OR DELETE ON accessors
+    FOR EACH ROW EXECUTE PROCEDURE notify_accessors_changed();
+
+-- Updates of last_used, made on every cache miss, must not invalidate the accessor they cache.
+CREATE TRIGGER accessors_notify_updated AFTER UPDATE ON accessors
+    FOR EACH ROW WHEN ((OLD.name, OLD.type, OLD.active, OLD.write) IS DISTINCT FROM (NEW.name, NEW.type, NEW.active, NEW.write))
+    EXECUTE PROCEDURE notify_accessors_changed();
+
+CREATE TRIGGER accessor_policies_notify_changed AFTER INSERT OR UPDATE OR DELETE ON accessor_policies
+    FOR EACH ROW EXECUTE PROCEDURE notify_accessors_changed();
+
+
+\i grants.sql
@@ -0,0 +1,20 @@
+
+-- Expiration warnings sent to users and the leaders of their groups, so each lead time is only warned once for an
+-- expiration date.
+
+CREATE  TABLE "public".user_expiration_warnings (
+	warningid            bigint  NOT NULL GENERATED BY DEFAULT AS IDENTITY  ,
+	uid                  integer  NOT NULL  ,
+	expiration_date      date  NOT NULL  ,
+	lead_days            integer  NOT NULL  ,
+	recipients           text    ,
+	sent                 timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	CONSTRAINT pk_user_expiration_warnings PRIMARY KEY ( warningid )
+ ) ;
+
+CREATE UNIQUE INDEX idx_user_expiration_warnings ON "public".user_expiration_warnings ( uid, expiration_date, lead_days ) ;
+
+ALTER TABLE "public".user_expiration_warnings ADD CONSTRAINT fk_user_expiration_warnings_users FOREIGN KEY ( uid ) REFERENCES "public".users( uid )   ;
+
+
+\i grants.sql
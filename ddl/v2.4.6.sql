@@ -0,0 +1,23 @@
+-- Former names of renamed users.  Lookups by an alias are redirected to the user until valid_until, unless a user has
+-- since taken the name.
+
+CREATE  TABLE "public".user_aliases (
+	aliasid              bigint  NOT NULL GENERATED BY DEFAULT AS IDENTITY  ,
+	alias                varchar(100)  NOT NULL  ,
+	uid                  bigint  NOT NULL  ,
+	valid_until          timestamptz  NOT NULL  ,
+	last_updated         timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL  ,
+	CONSTRAINT pk_user_aliases PRIMARY KEY ( aliasid )
+ ) ;
+
+CREATE UNIQUE INDEX idx_user_aliases_alias ON "public".user_aliases ( alias ) ;
+
+CREATE INDEX idx_user_aliases_uid ON "public".user_aliases ( uid ) ;
+
+ALTER TABLE "public".user_aliases ADD CONSTRAINT fk_user_aliases_users FOREIGN KEY ( uid ) REFERENCES "public".users( uid )   ;
+
+CREATE TRIGGER user_aliases_common_update_stamp BEFORE INSERT OR UPDATE ON user_aliases
+    FOR EACH ROW EXECUTE PROCEDURE common_update_stamp();
+
+
+\i grants.sql
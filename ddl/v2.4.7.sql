@@ -0,0 +1,8 @@
+-- User affected by a write API call, resolved from its username or uid.  For mergeUsers it is the merged account.
+
+ALTER TABLE "public".audit_log ADD COLUMN uid bigint ;
+
+CREATE INDEX idx_audit_log_uid ON "public".audit_log ( uid ) ;
+
+
+\i grants.sql
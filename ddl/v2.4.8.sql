@@ -0,0 +1,6 @@
+-- Admin accessors can manage accessors and the server.  Policies and token scopes never grant admin.
+
+ALTER TABLE "public".accessors ADD COLUMN admin boolean DEFAULT false NOT NULL ;
+
+
+\i grants.sql
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// IncludeAccessorAPIs includes all APIs described in this file in an APICollection
+func IncludeAccessorAPIs(c *APICollection) {
+	createAccessor := BaseAPI{
+		InputModel{
+			Parameter{AccessorName, true},
+			Parameter{AccessorType, true},
+			Parameter{Write, false},
+			Parameter{Admin, false},
+			Parameter{Comments, false},
+		},
+		createAccessor,
+		RoleWrite,
+		nil,
+	}
+	c.Add("createAccessor", &createAccessor)
+
+	setAccessorInfo := BaseAPI{
+		InputModel{
+			Parameter{AccessorName, true},
+			Parameter{Write, false},
+			Parameter{Admin, false},
+			Parameter{Status, false},
+			Parameter{Comments, false},
+		},
+		setAccessorInfo,
+		RoleWrite,
+		nil,
+	}
+	c.Add("setAccessorInfo", &setAccessorInfo)
+
+	deactivateAccessor := BaseAPI{
+		InputModel{
+			Parameter{AccessorName, true},
+		},
+		deactivateAccessor,
+		RoleWrite,
+		nil,
+	}
+	c.Add("deactivateAccessor", &deactivateAccessor)
+
+	getAccessors := BaseAPI{
+		InputModel{
+			Parameter{AccessorName, false},
+			Parameter{AccessorType, false},
+			Parameter{Status, false},
+		},
+		getAccessors,
+		RoleRead,
+		nil,
+	}
+	c.Add("getAccessors", &getAccessors)
+
+	createAccessorPolicy := BaseAPI{
+		InputModel{
+			Parameter{AccessorName, true},
+			Parameter{API, false},
+			Parameter{UnitName, false},
+			Parameter{ResourceName, false},
+			Parameter{Write, false},
+		},
+		createAccessorPolicy,
+		RoleWrite,
+		[]Attribute{UnitName, ResourceName},
+	}
+	c.Add("createAccessorPolicy", &createAccessorPolicy)
+
+	removeAccessorPolicy := BaseAPI{
+		InputModel{
+			Parameter{PolicyID, true},
+		},
+		removeAccessorPolicy,
+		RoleWrite,
+		nil,
+	}
+	c.Add("removeAccessorPolicy", &removeAccessorPolicy)
+
+	getAccessorPolicies := BaseAPI{
+		InputModel{
+			Parameter{AccessorName, false},
+		},
+		getAccessorPolicies,
+		RoleRead,
+		nil,
+	}
+	c.Add("getAccessorPolicies", &getAccessorPolicies)
+
+	getAccessorCache := BaseAPI{
+		InputModel{
+			Parameter{CacheKey, false},
+		},
+		getAccessorCache,
+		RoleRead,
+		nil,
+	}
+	c.Add("getAccessorCache", &getAccessorCache)
+
+	flushAccessorCache := BaseAPI{
+		InputModel{
+			Parameter{CacheKey, false},
+		},
+		flushAccessorCache,
+		RoleWrite,
+		nil,
+	}
+	c.Add("flushAccessorCache", &flushAccessorCache)
+}
+
+// validateAccessorName checks and normalizes the name of an accessor for its type:
+// a DN issued by a known CA for dn_role, an IP address or CIDR network for ip_role and a token subject for jwt_role
+func validateAccessorName(c APIContext, accType string, name string) (string, []APIError) {
+	var apiErr []APIError
+
+	switch accType {
+	case "dn_role":
+		dn, err := ExtractValidDN(name)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, DN))
+			return "", apiErr
+		}
+		return dn, nil
+	case "ip_role":
+		name = strings.TrimSpace(name)
+		if strings.Contains(name, "/") {
+			_, network, err := net.ParseCIDR(name)
+			if err != nil {
+				apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, AccessorName))
+				return "", apiErr
+			}
+			return network.String(), nil
+		}
+		ip := net.ParseIP(name)
+		if ip == nil {
+			apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, AccessorName))
+			return "", apiErr
+		}
+		return ip.String(), nil
+	case "jwt_role":
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || strings.ContainsAny(name, " \t\n") {
+			apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, AccessorName))
+			return "", apiErr
+		}
+		// UUID subjects must belong to a user, other subjects are service accounts known only to LDAP
+		if _, err := uuid.Parse(name); err == nil {
+			var found bool
+			err := c.DBtx.QueryRow(`select exists (select uid from users where token_subject = $1)`, name).Scan(&found)
+			if err != nil {
+				log.WithFields(QueryFields(c)).Error(err)
+				apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+				return "", apiErr
+			}
+			if !found {
+				apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, TokenSubject))
+				return "", apiErr
+			}
+		}
+		return name, nil
+	}
+
+	apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, AccessorType))
+	return "", apiErr
+}
+
+// lookupAccessor returns the id and type of an accessor by name.  IP addresses, networks and DNs are also looked up in
+// the canonical form createAccessor stores them in.
+func lookupAccessor(c APIContext, name string) (int64, string, []APIError) {
+	var apiErr []APIError
+	var accid int64
+	var accType string
+
+	names := accessorNames(name)
+	err := c.DBtx.QueryRow(`select accid, type from accessors where name = any($1)
+							order by array_position($1, name) limit 1`, pq.Array(names)).Scan(&accid, &accType)
+	if err == sql.ErrNoRows {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, AccessorName))
+		return 0, "", apiErr
+	} else if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return 0, "", apiErr
+	}
+
+	return accid, accType, nil
+}
+
+// accessorNames returns the names an accessor may be stored under: the name as given, then its canonical form as an
+// IP network, IP address or DN, as validateAccessorName normalizes them
+func accessorNames(name string) []string {
+	name = strings.TrimSpace(name)
+	names := []string{name}
+
+	canonical := ""
+	if _, network, err := net.ParseCIDR(name); err == nil {
+		canonical = network.String()
+	} else if ip := net.ParseIP(name); ip != nil {
+		canonical = ip.String()
+	} else if dn, err := ExtractDN(name); err == nil {
+		canonical = dn
+	}
+	if canonical != "" && canonical != name {
+		names = append(names, canonical)
+	}
+	return names
+}
+
+// invalidateAccessorAfterCommit removes an accessor from the cache once the call modifying it is committed.  Dry runs
+// leave the cache untouched.
+func invalidateAccessorAfterCommit(c APIContext, name string, accid int64) {
+	if c.DryRun != nil {
+		return
+	}
+	c.DBtx.AfterCommit(func() { invalidateAccessor(name, accid) })
+}
+
+// createAccessor godoc
+// @Summary      Grants a DN, IP address or token subject access to FERRY.
+// @Description  Grants a DN, IP address or token subject access to FERRY.  The accessor name is validated for its type:
+// @Description  dn_role requires a DN issued by a known CA, ip_role an IP address or CIDR network and jwt_role a token subject.  UUID token
+// @Description  subjects must belong to a user.  Accessors have read access unless write is set.  Only admin accessors, which
+// @Description  are not limited by policies or token scopes, can manage accessors, and only they can grant admin.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        accessorname   query     string  true   "DN, IP address or token subject of the accessor"
+// @Param        accessortype   query     string  true   "type of accessor"  Enums(dn_role, ip_role, jwt_role)
+// @Param        admin          query     boolean false  "allow managing accessors and the server, default false"
+// @Param        comments       query     string  false  "who or what the accessor is"
+// @Param        write          query     boolean false  "grant write access, default false"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /createAccessor [post]
+func createAccessor(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	accType := i[AccessorType].Data.(string)
+	name, apiErr := validateAccessorName(c, accType, i[AccessorName].Data.(string))
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	var exists bool
+	err := c.DBtx.QueryRow(`select exists (select accid from accessors where name = $1)`, name).Scan(&exists)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	if exists {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDuplicateData, AccessorName))
+		return nil, apiErr
+	}
+
+	accid := NewNullAttribute(AccessorID)
+	err = c.DBtx.QueryRow(`insert into accessors (name, active, write, admin, type, comments)
+						   values ($1, true, $2, $3, $4, $5) returning accid`,
+		name, i[Write].Default(false), i[Admin].Default(false), accType, i[Comments]).Scan(&accid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	invalidateAccessorAfterCommit(c, name, accid.Data.(int64))
+
+	return map[Attribute]interface{}{AccessorID: accid.Data, AccessorName: name}, nil
+}
+
+// setAccessorInfo godoc
+// @Summary      Modifies the access granted to an accessor.
+// @Description  Modifies the access granted to an accessor.  Changes are effective immediately.  Requires an admin accessor.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        accessorname   query     string  true   "DN, IP address or token subject of the accessor"
+// @Param        admin          query     boolean false  "true to allow managing accessors and the server, false to disallow it"
+// @Param        comments       query     string  false  "who or what the accessor is"
+// @Param        status         query     boolean false  "true to activate the accessor, false to deactivate it"
+// @Param        write          query     boolean false  "true to grant write access, false for read access only"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /setAccessorInfo [put]
+func setAccessorInfo(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	if !i[Write].Valid && !i[Admin].Valid && !i[Status].Valid && !i[Comments].Valid && !i[Comments].AbsoluteNull {
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, "nothing to modify, use write, admin, status or comments"))
+		return nil, apiErr
+	}
+
+	accid, _, apiErr := lookupAccessor(c, i[AccessorName].Data.(string))
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	_, err := c.DBtx.Exec(`update accessors set write = coalesce($2, write),
+												active = coalesce($3, active),
+												comments = case when $4 then null else coalesce($5, comments) end,
+												admin = coalesce($6, admin)
+						   where accid = $1`,
+		accid, i[Write], i[Status], i[Comments].AbsoluteNull, i[Comments], i[Admin])
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	invalidateAccessorAfterCommit(c, i[AccessorName].Data.(string), accid)
+
+	return nil, nil
+}
+
+// deactivateAccessor godoc
+// @Summary      Revokes the access of an accessor.
+// @Description  Revokes the access of an accessor.  The accessor is kept and can be reactivated with setAccessorInfo.
+// @Description  Changes are effective immediately.  Requires an admin accessor.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        accessorname   query     string  true   "DN, IP address or token subject of the accessor"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /deactivateAccessor [put]
+func deactivateAccessor(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	accid, _, apiErr := lookupAccessor(c, i[AccessorName].Data.(string))
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	_, err := c.DBtx.Exec(`update accessors set active = false where accid = $1`, accid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	invalidateAccessorAfterCommit(c, i[AccessorName].Data.(string), accid)
+
+	return nil, nil
+}
+
+// getAccessors godoc
+// @Summary      Returns the accessors granted access to FERRY.
+// @Description  Returns the accessors granted access to FERRY with their access and the last time they were used.
+// @Description  For jwt_role accessors, the user owning the token subject is returned when known.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        accessorname   query     string  false  "limit results to the named accessor"
+// @Param        accessortype   query     string  false  "limit results to a type of accessor"  Enums(dn_role, ip_role, jwt_role)
+// @Param        status         query     boolean false  "limit results to active or inactive accessors"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getAccessors [get]
+func getAccessors(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	rows, err := c.DBtx.Query(`select accid, a.name, type, active, write, admin, comments, last_used, a.last_updated, u.uname
+							   from accessors as a
+							   left join users as u on a.type = 'jwt_role' and u.token_subject = a.name
+							   where (a.name = $1 or $1 is null)
+								 and (type = $2 or $2 is null)
+								 and (active = $3 or $3 is null)
+							   order by type, a.name`, i[AccessorName], i[AccessorType], i[Status])
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	const LastUsed Attribute = "lastused"
+
+	type jsonentry map[Attribute]interface{}
+	out := make([]jsonentry, 0)
+
+	for rows.Next() {
+		var name, accType string
+		var comments sql.NullString
+		var lastUsed time.Time
+		row := NewMapNullAttribute(AccessorID, Status, Write, Admin, LastUpdated, UserName)
+		rows.Scan(row[AccessorID], &name, &accType, row[Status], row[Write], row[Admin], &comments, &lastUsed, row[LastUpdated],
+			row[UserName])
+
+		entry := jsonentry{
+			AccessorID:   row[AccessorID].Data,
+			AccessorName: name,
+			AccessorType: accType,
+			Status:       row[Status].Data,
+			Write:        row[Write].Data,
+			Admin:        row[Admin].Data,
+			Comments:     nil,
+			LastUsed:     nil,
+			LastUpdated:  row[LastUpdated].Data,
+			UserName:     row[UserName].Data,
+		}
+		if comments.Valid {
+			entry[Comments] = comments.String
+		}
+		// last_used defaults to the epoch for accessors that never connected
+		if lastUsed.Unix() > 0 {
+			entry[LastUsed] = lastUsed
+		}
+		out = append(out, entry)
+	}
+
+	return out, nil
+}
+
+// createAccessorPolicy godoc
+// @Summary      Limits an accessor to an API, an affiliation unit or a compute resource.
+// @Description  Adds a policy to an accessor.  Once an accessor has policies, it can only call the APIs allowed by one of them,
+// @Description  and write APIs need the write flag of both the accessor and the policy.  A policy scoped to an affiliation
+// @Description  unit or compute resource only allows calls on that unitname or resourcename, or on groups and users
+// @Description  belonging to it.  Omitted api, unitname and resourcename match any.  Requires an admin accessor.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        accessorname   query     string  true   "DN, IP address or token subject of the accessor"
+// @Param        api            query     string  false  "API allowed by the policy, default any"
+// @Param        resourcename   query     string  false  "compute resource the policy is limited to"
+// @Param        unitname       query     string  false  "affiliation unit the policy is limited to"
+// @Param        write          query     boolean false  "allow write APIs, default false"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /createAccessorPolicy [post]
+func createAccessorPolicy(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	if i[API].Valid {
+		known := false
+		for _, name := range apiNames {
+			if name == i[API].Data.(string) {
+				known = true
+				break
+			}
+		}
+		if !known && i[API].Data.(string) != "batch" && i[API].Data.(string) != "metrics" {
+			apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, API))
+			return nil, apiErr
+		}
+		if adminAPIs[i[API].Data.(string)] {
+			apiErr = append(apiErr, APIError{fmt.Errorf("%s requires an admin accessor and cannot be granted by a policy",
+				i[API].Data.(string)), ErrorAPIRequirement})
+			return nil, apiErr
+		}
+	}
+
+	accid, _, apiErr := lookupAccessor(c, i[AccessorName].Data.(string))
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	unitid := NewNullAttribute(UnitID)
+	compid := NewNullAttribute(ResourceID)
+	err := c.DBtx.QueryRow(`select (select unitid from affiliation_units where name = $1),
+								   (select compid from compute_resources where name = $2)`,
+		i[UnitName], i[ResourceName]).Scan(&unitid, &compid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	if i[UnitName].Valid && !unitid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UnitName))
+	}
+	if i[ResourceName].Valid && !compid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, ResourceName))
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	policyid := NewNullAttribute(PolicyID)
+	err = c.DBtx.QueryRow(`insert into accessor_policies (accid, api, unitid, compid, write)
+						   values ($1, $2, $3, $4, $5) returning policyid`,
+		accid, i[API], unitid, compid, i[Write].Default(false)).Scan(&policyid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	invalidateAccessorAfterCommit(c, i[AccessorName].Data.(string), accid)
+
+	return map[Attribute]interface{}{PolicyID: policyid.Data}, nil
+}
+
+// removeAccessorPolicy godoc
+// @Summary      Removes a policy from an accessor.
+// @Description  Removes a policy from an accessor.  Removing the last policy of an accessor restores the access given by
+// @Description  its write flag to every API.  Requires an admin accessor.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        policyid       query     int     true   "id of the policy to remove"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /removeAccessorPolicy [put]
+func removeAccessorPolicy(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	var accid int64
+	var name string
+	err := c.DBtx.QueryRow(`delete from accessor_policies as p using accessors as a
+							where p.accid = a.accid and policyid = $1
+							returning a.accid, a.name`, i[PolicyID]).Scan(&accid, &name)
+	if err == sql.ErrNoRows {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, PolicyID))
+		return nil, apiErr
+	} else if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	invalidateAccessorAfterCommit(c, name, accid)
+
+	return nil, nil
+}
+
+// getAccessorPolicies godoc
+// @Summary      Returns the policies limiting the accessors.
+// @Description  Returns the policies limiting the accessors.  Accessors without policies are not listed.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        accessorname   query     string  false  "limit results to the named accessor"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getAccessorPolicies [get]
+func getAccessorPolicies(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	rows, err := c.DBtx.Query(`select policyid, a.name, p.api, au.name, cr.name, p.write
+							   from accessor_policies as p
+							   join accessors as a using(accid)
+							   left join affiliation_units as au using(unitid)
+							   left join compute_resources as cr using(compid)
+							   where (a.name = $1 or $1 is null)
+							   order by a.name, policyid`, i[AccessorName])
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	type jsonentry map[Attribute]interface{}
+	out := make([]jsonentry, 0)
+
+	for rows.Next() {
+		var name string
+		row := NewMapNullAttribute(PolicyID, API, UnitName, ResourceName, Write)
+		rows.Scan(row[PolicyID], &name, row[API], row[UnitName], row[ResourceName], row[Write])
+		out = append(out, jsonentry{
+			PolicyID:     row[PolicyID].Data,
+			AccessorName: name,
+			API:          row[API].Data,
+			UnitName:     row[UnitName].Data,
+			ResourceName: row[ResourceName].Data,
+			Write:        row[Write].Data,
+		})
+	}
+
+	return out, nil
+}
+
+// getAccessorCache godoc
+// @Summary      Returns the accessors cached by this server.
+// @Description  Returns the accessors cached by this server, by the DN, IP address or token subject they were cached for.
+// @Description  Accessors are cached for accessors.expire minutes and dropped when they change in the database.  Requires an
+// @Description  admin accessor.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        cachekey       query     string  false  "limit results to the entry cached for a DN, IP address or token subject"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getAccessorCache [get]
+func getAccessorCache(c APIContext, i Input) (interface{}, []APIError) {
+	const Policies Attribute = "policies"
+	const Expiration Attribute = "expiration"
+
+	type jsonentry map[Attribute]interface{}
+	out := make([]jsonentry, 0)
+
+	items := AccCache.Items()
+	for _, key := range sortedKeys(items) {
+		if i[CacheKey].Valid && key != i[CacheKey].Data.(string) {
+			continue
+		}
+		acc, ok := items[key].Object.(accessor)
+		if !ok {
+			continue
+		}
+		entry := jsonentry{
+			CacheKey:     key,
+			AccessorID:   acc.accid,
+			AccessorName: acc.name,
+			AccessorType: acc.accType,
+			Write:        acc.write,
+			Admin:        acc.admin,
+			UserName:     nil,
+			Policies:     len(acc.policies),
+			Expiration:   nil,
+		}
+		if acc.uname != "" {
+			entry[UserName] = acc.uname
+		}
+		if items[key].Expiration > 0 {
+			entry[Expiration] = time.Unix(0, items[key].Expiration).Format(time.RFC3339)
+		}
+		out = append(out, entry)
+	}
+
+	return out, nil
+}
+
+// flushAccessorCache godoc
+// @Summary      Removes accessors from the cache of this server.
+// @Description  Removes the entry cached for a DN, IP address or token subject, or every entry when cachekey is not given,
+// @Description  so the accessors are read again from the database on their next call.  Requires an admin accessor.
+// @Tags         Accessors
+// @Accept       html
+// @Produce      json
+// @Param        cachekey       query     string  false  "DN, IP address or token subject to remove, all entries when not given"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /flushAccessorCache [put]
+func flushAccessorCache(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	if i[CacheKey].Valid {
+		key := i[CacheKey].Data.(string)
+		if _, found := AccCache.Get(key); !found {
+			apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, CacheKey))
+			return nil, apiErr
+		}
+		if c.DryRun == nil {
+			AccCache.Delete(key)
+		}
+		log.WithFields(QueryFields(c)).Infof("removed %s from the accessor cache", key)
+		return nil, nil
+	}
+
+	if c.DryRun == nil {
+		AccCache.Flush()
+	}
+	log.WithFields(QueryFields(c)).Info("flushed the accessor cache")
+
+	return nil, nil
+}
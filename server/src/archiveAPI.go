@@ -0,0 +1,486 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// IncludeArchiveAPIs includes all APIs described in this file in an APICollection
+func IncludeArchiveAPIs(c *APICollection) {
+	archiveUser := BaseAPI{
+		InputModel{
+			Parameter{UID, true},
+		},
+		archiveUser,
+		RoleWrite,
+		[]Attribute{UID},
+	}
+	c.Add("archiveUser", &archiveUser)
+
+	getArchivedUser := PagedAPI(
+		InputModel{
+			Parameter{UID, false},
+			Parameter{UserName, false},
+		},
+		getArchivedUser,
+		RoleRead,
+		[]Attribute{UserName, UID},
+	)
+	c.Add("getArchivedUser", &getArchivedUser)
+
+	restoreUser := BaseAPI{
+		InputModel{
+			Parameter{UID, true},
+		},
+		restoreUser,
+		RoleWrite,
+		[]Attribute{UID},
+	}
+	c.Add("restoreUser", &restoreUser)
+}
+
+// archiveTable is a table holding associations of a user, where selects the rows of the user given as $1
+type archiveTable struct {
+	name  string
+	where string
+}
+
+// archiveTables are the tables archived with a user, in the order their rows are deleted.  Rows are restored in the
+// reverse order.  The json keys of the archive are the table names, and the json keys of the rows the table columns,
+// as written by utility/archive-users/archiveUser.py.
+var archiveTables = []archiveTable{
+	{"storage_quota", "uid = $1"},
+	{"affiliation_unit_user_certificate", "dnid in (select dnid from user_certificates where uid = $1)"},
+	{"user_certificates", "uid = $1"},
+	{"external_affiliation_attribute", "uid = $1"},
+	{"grid_access", "uid = $1"},
+	{"compute_access_group", "uid = $1"},
+	{"compute_access", "uid = $1"},
+	{"compute_resource_shared_account", "uid = $1 or sharedaccount_uid = $1"},
+	{"user_group", "uid = $1"},
+	{"user_affiliation_units", "uid = $1"},
+	{"user_expiration_warnings", "uid = $1"},
+	{"user_aliases", "uid = $1"},
+	{"users", "uid = $1"},
+}
+
+// archiveReference is a column of an archived table referring to a row that must exist for the table to be restored
+type archiveReference struct {
+	table     string
+	column    string
+	refTable  string
+	refColumn string
+}
+
+// archiveReferences are the references checked before restoring a user.  References to users may be to the restored
+// user itself, or to other users granted its shared accounts or granting it theirs.
+var archiveReferences = []archiveReference{
+	{"storage_quota", "storageid", "storage_resources", "storageid"},
+	{"storage_quota", "unitid", "affiliation_units", "unitid"},
+	{"affiliation_unit_user_certificate", "unitid", "affiliation_units", "unitid"},
+	{"grid_access", "fqanid", "grid_fqan", "fqanid"},
+	{"compute_access_group", "groupid", "groups", "groupid"},
+	{"compute_access_group", "compid", "compute_resources", "compid"},
+	{"compute_access", "compid", "compute_resources", "compid"},
+	{"compute_resource_shared_account", "compid", "compute_resources", "compid"},
+	{"compute_resource_shared_account", "uid", "users", "uid"},
+	{"compute_resource_shared_account", "sharedaccount_uid", "users", "uid"},
+	{"user_group", "groupid", "groups", "groupid"},
+	{"user_affiliation_units", "unitid", "affiliation_units", "unitid"},
+}
+
+// archiveGroups is the json key of the groups of an archived user, used to detect groups reused since the archive
+const archiveGroups = "groups"
+
+// archiveLdap is the json key of the LDAP record of an archived user, kept for reference only
+const archiveLdap = "ldap"
+
+// archiveUser godoc
+// @Summary      Archives a user and all of its associations.
+// @Description  Snapshots every association of a UID into user_archives and deletes it, in one transaction: storage
+// @Description  quotas, certificates and their affiliation units, external attributes, FQANs (grid_access), compute
+// @Description  access and groups, shared accounts, groups, affiliation units and the user itself.  Shared accounts
+// @Description  include the grants of other users to the shared accounts of the user.  Once the archive is committed, the
+// @Description  user is removed from LDAP, its LDAP record is kept in the archive.  Condor quotas belong to condor groups
+// @Description  rather than to users, they are not archived.  Use restoreUser to reinstate the user.
+// @Tags         Users
+// @Accept       html
+// @Produce      json
+// @Param        uid            query     int     true  "uid of the user to archive"
+// @Success      200  {object}  userArchive
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /archiveUser [put]
+func archiveUser(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	uname := NewNullAttribute(UserName)
+
+	err := c.DBtx.QueryRow(`select uname from users where uid = $1`, i[UID]).Scan(&uname)
+	if err == sql.ErrNoRows {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UID))
+		return nil, apiErr
+	} else if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	archive := userArchive{
+		UID:      i[UID].Data.(int64),
+		UserName: uname.Data.(string),
+	}
+
+	userData, apiErr := snapshotUser(c, &archive)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	c = queueLdapAfterCommit(c)
+	if apiErr = removeArchivedUserFromLdap(c, archive.UserName, userData); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr = deleteUserRows(c, archive.UID); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr = insertArchive(c, &archive, userData); apiErr != nil {
+		return nil, apiErr
+	}
+
+	return archive, nil
+}
+
+// getArchivedUser godoc
+// @Summary      Returns the archives of users.
+// @Description  Returns the archives of users made by archiveUser, dropUser or archiveUser.py, newest first, with the
+// @Description  archived rows of every table.  Filtered by uid or username, all archives are returned in pages of limit
+// @Description  if neither is set.
+// @Tags         Users
+// @Accept       html
+// @Produce      json
+// @Param        uid            query     int     false  "uid of the archived user"
+// @Param        username       query     string  false  "name of the archived user"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return, required without uid or username"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
+// @Success      200  {object}  userArchive
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getArchivedUser [get]
+func getArchivedUser(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	if !i[UID].Valid && !i[UserName].Valid && !i[Limit].Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, "uid, username or limit is required"))
+		return nil, apiErr
+	}
+
+	const ArchiveID Attribute = "archiveid"
+
+	page, apiErr := newPage(i, map[Attribute]string{ArchiveID: "id", UID: "uid"}, "-"+ArchiveID, "id")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(3)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`select %s, id, uid, uname, date_deleted, user_data from user_archives
+										   where (uid = $1 or $1 is null) and (uname = $2 or $2 is null) and %s
+										   %s %s`, page.columns(), after, page.orderBy(), page.limitBy()),
+		append([]interface{}{i[UID], i[UserName]}, args...)...)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	out := make([]userArchive, 0)
+	for rows.Next() {
+		var sortValue, sortKey string
+		var archive userArchive
+		var userData []byte
+		err := rows.Scan(&sortValue, &sortKey, &archive.ArchiveID, &archive.UID, &archive.UserName, &archive.DateDeleted, &userData)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		if !page.add(sortValue, sortKey) {
+			break
+		}
+		archive.UserData = json.RawMessage(userData)
+		out = append(out, archive)
+	}
+
+	if len(out) == 0 {
+		if i[UID].Valid {
+			apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UID))
+		} else if i[UserName].Valid {
+			apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UserName))
+		}
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	return page.output(out), nil
+}
+
+// restoreUser godoc
+// @Summary      Restores an archived user and all of its associations.
+// @Description  Reinstates the newest archive of a UID made by archiveUser, dropUser or archiveUser.py, and removes the
+// @Description  archive.  Nothing is restored if the uid, the username or a certificate was reused, if a group was reused
+// @Description  under another name or gid, or if a group, affiliation unit, resource or FQAN the user belonged to was removed.
+// @Description  Every conflict is returned.  Active users are added back to LDAP once the restore is committed.
+// @Tags         Users
+// @Accept       html
+// @Produce      json
+// @Param        uid            query     int     true  "uid of the user to restore"
+// @Success      200  {object}  userArchive
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /restoreUser [put]
+func restoreUser(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	var archive userArchive
+	var parsedIn []byte
+
+	err := c.DBtx.QueryRow(`select id, uid, uname, date_deleted, user_data from user_archives where uid = $1
+							order by date_deleted desc, id desc limit 1`,
+		i[UID]).Scan(&archive.ArchiveID, &archive.UID, &archive.UserName, &archive.DateDeleted, &parsedIn)
+	if err == sql.ErrNoRows {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UID))
+		return nil, apiErr
+	} else if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	userData := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(parsedIn, &userData); err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, APIError{fmt.Errorf("archive %d is not valid: %s", archive.ArchiveID, err), ErrorAPIRequirement})
+		return nil, apiErr
+	}
+	for _, t := range archiveTables {
+		rows := strings.TrimSpace(string(userData[t.name]))
+		if rows == "" || rows == "null" {
+			rows = "[]"
+		} else if strings.HasPrefix(rows, "{") {
+			// dropUser archives the users row as an object
+			rows = "[" + rows + "]"
+		}
+		userData[t.name] = json.RawMessage(rows)
+	}
+
+	// Conflicts
+	var reused []string
+	err = c.DBtx.QueryRow(`select array(select format('uid %s is used by %s', uid, uname) from users where uid = $1
+													  union all
+													  select format('username %s is used by uid %s', uname, uid) from users where uname = $2
+													  union all
+													  select format('certificate %s is used by uid %s', c.dn, c.uid)
+													  from json_populate_recordset(null::user_certificates, $3) as a
+													  join user_certificates as c on c.dn = a.dn or c.dnid = a.dnid
+													  union all
+													  select format('group %s (groupid %s, gid %s) was reused by %s (gid %s)', a.name, a.groupid, a.gid, g.name, g.gid)
+													  from json_populate_recordset(null::groups, $4) as a
+													  join groups as g on g.groupid = a.groupid and (g.name != a.name or g.gid != a.gid))`,
+		archive.UID, archive.UserName, string(userData["user_certificates"]), nullableJSON(userData[archiveGroups])).Scan(pq.Array(&reused))
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	for _, conflict := range reused {
+		apiErr = append(apiErr, APIError{fmt.Errorf("cannot restore uid %d, %s", archive.UID, conflict), ErrorAPIRequirement})
+	}
+
+	for _, ref := range archiveReferences {
+		var missing string
+		self := ""
+		args := []interface{}{string(userData[ref.table])}
+		if ref.refTable == "users" {
+			// The restored user is inserted before the rows referring to it
+			self = fmt.Sprintf("and a.%s != $2", ref.column)
+			args = append(args, archive.UID)
+		}
+		err := c.DBtx.QueryRow(fmt.Sprintf(`select coalesce(string_agg(distinct a.%[2]s::text, ','), '')
+											from json_populate_recordset(null::%[1]s, $1) as a
+											where a.%[2]s is not null %[5]s
+											  and not exists (select 1 from %[3]s as r where r.%[4]s = a.%[2]s)`,
+			ref.table, ref.column, ref.refTable, ref.refColumn, self), args...).Scan(&missing)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		if missing != "" {
+			apiErr = append(apiErr, APIError{fmt.Errorf("cannot restore uid %d, %s %s %s no longer exists", archive.UID, ref.refTable, ref.refColumn, missing), ErrorAPIRequirement})
+		}
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	// Restore
+	archive.Rows = make(map[string]int)
+	for n := len(archiveTables) - 1; n >= 0; n-- {
+		t := archiveTables[n]
+		res, err := c.DBtx.Exec(fmt.Sprintf(`insert into %[1]s select * from json_populate_recordset(null::%[1]s, $1)`, t.name),
+			string(userData[t.name]))
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			if strings.Contains(err.Error(), "violates") {
+				apiErr = append(apiErr, APIError{fmt.Errorf("cannot restore uid %d, %s conflicts with the current data", archive.UID, t.name), ErrorAPIRequirement})
+			} else {
+				apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			}
+			return nil, apiErr
+		}
+		count, _ := res.RowsAffected()
+		archive.Rows[t.name] = int(count)
+	}
+
+	_, err = c.DBtx.Exec(`delete from user_archives where id = $1`, archive.ArchiveID)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	var active bool
+	err = c.DBtx.QueryRow(`select status from users where uid = $1`, archive.UID).Scan(&active)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	if active {
+		c = queueLdapAfterCommit(c)
+		input := Input{
+			UserName: NewNullAttribute(UserName).Default(archive.UserName),
+		}
+		if _, apiErr = addOrUpdateUserInLdap(c, input); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+
+	return archive, nil
+}
+
+// snapshotUser returns the rows of every archived table for the user of an archive, and counts them in archive.Rows
+func snapshotUser(c APIContext, archive *userArchive) (map[string]json.RawMessage, []APIError) {
+	var apiErr []APIError
+
+	archive.Rows = make(map[string]int)
+	userData := make(map[string]json.RawMessage)
+
+	for _, t := range archiveTables {
+		var rows json.RawMessage
+		var count int
+		err := c.DBtx.QueryRow(fmt.Sprintf(`select coalesce(json_agg(t), '[]'), count(*) from %s as t where %s`, t.name, t.where),
+			archive.UID).Scan(&rows, &count)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		userData[t.name] = rows
+		archive.Rows[t.name] = count
+	}
+
+	var groups json.RawMessage
+	err := c.DBtx.QueryRow(`select coalesce(json_agg(g), '[]') from
+							(select groupid, gid, name, type from groups
+							 where groupid in (select groupid from user_group where uid = $1
+											   union select groupid from compute_access_group where uid = $1)) as g`,
+		archive.UID).Scan(&groups)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	userData[archiveGroups] = groups
+
+	return userData, nil
+}
+
+// removeArchivedUserFromLdap removes a user from LDAP, keeping its LDAP record in the archive.  It needs the user in
+// the DB, so it is called before the rows are deleted, with the removal queued until the archive is committed.
+func removeArchivedUserFromLdap(c APIContext, uname string, userData map[string]json.RawMessage) []APIError {
+	var apiErr []APIError
+	var err error
+
+	input := Input{
+		UserName: NewNullAttribute(UserName).Default(uname),
+	}
+	lData, lErr := getUserLdapInfo(c, input)
+	if lErr != nil {
+		// Not in LDAP
+		return nil
+	}
+	if userData[archiveLdap], err = json.Marshal(lData); err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, err))
+		return apiErr
+	}
+	_, apiErr = removeUserFromLdap(c, input)
+	return apiErr
+}
+
+// deleteUserRows deletes the rows of every archived table for a uid
+func deleteUserRows(c APIContext, uid int64) []APIError {
+	var apiErr []APIError
+
+	for _, t := range archiveTables {
+		_, err := c.DBtx.Exec(fmt.Sprintf(`delete from %s where %s`, t.name, t.where), uid)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			if strings.Contains(err.Error(), "violates foreign key constraint") {
+				apiErr = append(apiErr, APIError{fmt.Errorf("cannot archive uid %d, %s has associations which are not archived", uid, t.name), ErrorAPIRequirement})
+			} else {
+				apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			}
+			return apiErr
+		}
+	}
+	return nil
+}
+
+// insertArchive stores an archive in user_archives, setting its id and date
+func insertArchive(c APIContext, archive *userArchive, userData map[string]json.RawMessage) []APIError {
+	var apiErr []APIError
+
+	parsedOut, err := json.Marshal(userData)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, err))
+		return apiErr
+	}
+
+	err = c.DBtx.QueryRow(`insert into user_archives (uid, uname, user_data, date_deleted) values ($1, $2, $3, now())
+						   returning id, date_deleted`,
+		archive.UID, archive.UserName, string(parsedOut)).Scan(&archive.ArchiveID, &archive.DateDeleted)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return apiErr
+	}
+	return nil
+}
+
+// nullableJSON returns nil for a missing json value, so it is passed to the DB as null
+func nullableJSON(j json.RawMessage) interface{} {
+	if len(j) == 0 {
+		return nil
+	}
+	return string(j)
+}
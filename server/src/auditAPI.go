@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// IncludeAuditAPIs includes all APIs described in this file in an APICollection
+func IncludeAuditAPIs(c *APICollection) {
+	getAuditLog := PagedAPI(
+		InputModel{
+			Parameter{UserName, false},
+			Parameter{UID, false},
+			Parameter{GroupName, false},
+			Parameter{UnitName, false},
+			Parameter{API, false},
+			Parameter{Subject, false},
+			Parameter{StartDate, false},
+			Parameter{EndDate, false},
+		},
+		getAuditLog,
+		RoleRead,
+		[]Attribute{UnitName, GroupName, UserName, UID},
+	)
+	c.Add("getAuditLog", &getAuditLog)
+}
+
+// auditInput returns the parameters given to an API, as recorded in the audit log
+func auditInput(i Input) map[Attribute]interface{} {
+	data := make(map[Attribute]interface{})
+	for attribute, value := range i {
+		if attribute == Help || attribute == DryRun {
+			continue
+		}
+		if value.Valid {
+			data[attribute] = value.Data
+		} else if value.AbsoluteNull {
+			data[attribute] = nil
+		}
+	}
+	return data
+}
+
+// recordAudit stores a successful write API call in the audit log using the API Transaction
+func recordAudit(c APIContext, i Input) error {
+	input, err := json.Marshal(auditInput(i))
+	if err != nil {
+		return err
+	}
+
+	var subject interface{}
+	if len(c.Subject) > 0 {
+		subject = c.Subject
+	}
+
+	var clientIP, proxyIP interface{}
+	ip, proxy := requestClient(c.R)
+	if ip != "" {
+		clientIP = ip
+	}
+	if proxy != "" {
+		proxyIP = proxy
+	}
+
+	uid, uname, err := auditUser(c, i)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.DBtx.Exec(`insert into audit_log (api, subject, auth_level, client_ip, proxy_ip, input, uid, uname, groupname, unitname, resourcename)
+						  values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		c.API, subject, c.AuthLevel.String(), clientIP, proxyIP, string(input),
+		uid, uname, i[GroupName], i[UnitName], i[ResourceName])
+
+	return err
+}
+
+// auditUser resolves the uid and username of the user affected by a write API call, given either by username or by
+// uid.  For mergeUsers it is the merged account, given by sourceuid.  Users renamed or archived by the call are found
+// through their alias or archive.
+func auditUser(c APIContext, i Input) (NullAttribute, NullAttribute, error) {
+	uid := NewNullAttribute(UID)
+	uname := NewNullAttribute(UserName)
+
+	var err error
+	switch {
+	case i[UserName].Valid:
+		uname = i[UserName]
+		err = c.DBtx.QueryRow(`select coalesce((select uid from users where uname = $1),
+											   (select uid from user_aliases where alias = $1),
+											   (select uid from user_archives where uname = $1 order by id desc limit 1))`,
+			uname).Scan(&uid)
+	case i[UID].Valid || i[SourceUID].Valid:
+		uid = i[UID]
+		if !uid.Valid {
+			uid = i[SourceUID]
+		}
+		err = c.DBtx.QueryRow(`select coalesce((select uname from users where uid = $1),
+											   (select uname from user_archives where uid = $1 order by id desc limit 1))`,
+			uid).Scan(&uname)
+	}
+
+	return uid, uname, err
+}
+
+// getAuditLog godoc
+// @Summary      Returns the audit log of write API calls.
+// @Description  Returns the audit log of successful write API calls, including who made the call, the parameters used and the
+// @Description  user, group, affiliation unit and resource affected.  For mergeUsers the user affected is the merged
+// @Description  account.  By default, returns the calls of the last 30 days.
+// @Tags         Audit
+// @Accept       html
+// @Produce      json
+// @Param        api            query     string  false  "limit results to calls to the named API"
+// @Param        enddate        query     string  false  "limit results to calls made before"  Format(date)
+// @Param        groupname      query     string  false  "limit results to calls affecting the group"
+// @Param        startdate      query     string  false  "limit results to calls made since, default 30 days ago"  Format(date)
+// @Param        subject        query     string  false  "limit results to calls made by the subject (DN, IP or token subject)"
+// @Param        uid            query     int     false  "limit results to calls affecting the user with this uid"
+// @Param        unitname       query     string  false  "limit results to calls affecting the affiliation unit"
+// @Param        username       query     string  false  "limit results to calls affecting the user"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
+// @Success      200  {object}  auditLogEntry
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getAuditLog [get]
+func getAuditLog(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	startDate := i[StartDate].Default(time.Now().AddDate(0, 0, -30))
+
+	page, apiErr := newPage(i, map[Attribute]string{AuditID: "auditid", API: "api"}, AuditID, "auditid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(9)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`select %s, auditid, api, subject, auth_level, client_ip, proxy_ip, input, uid, uname, groupname, unitname, resourcename, event_time
+							   from audit_log
+							   where (uname = $1 or $1 is null)
+								 and (groupname = $2 or $2 is null)
+								 and (unitname = $3 or $3 is null)
+								 and (api = $4 or $4 is null)
+								 and (lower(subject) = lower($5) or $5 is null)
+								 and (event_time >= $6)
+								 and (event_time < $7 or $7 is null)
+								 and (uid = $8 or $8 is null)
+								 and %s
+							   %s %s`, page.columns(), after, page.orderBy(), page.limitBy()),
+		append([]interface{}{i[UserName], i[GroupName], i[UnitName], i[API], i[Subject], startDate, i[EndDate], i[UID]}, args...)...)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	const AuthLevel Attribute = "authlevel"
+	const ClientIP Attribute = "clientip"
+	const ProxyIP Attribute = "proxyip"
+	const AuditInput Attribute = "input"
+	const EventTime Attribute = "eventtime"
+
+	type jsonentry map[Attribute]interface{}
+	out := make([]jsonentry, 0)
+
+	for rows.Next() {
+		var sortValue, sortKey string
+		var input []byte
+		var subject, authLevel, clientIP, proxyIP sql.NullString
+		row := NewMapNullAttribute(AuditID, API, UID, UserName, GroupName, UnitName, ResourceName, LastUpdated)
+		rows.Scan(&sortValue, &sortKey, row[AuditID], row[API], &subject, &authLevel, &clientIP, &proxyIP, &input,
+			row[UID], row[UserName], row[GroupName], row[UnitName], row[ResourceName], row[LastUpdated])
+		if !page.add(sortValue, sortKey) {
+			break
+		}
+
+		entry := jsonentry{
+			AuditID:      row[AuditID].Data,
+			API:          row[API].Data,
+			Subject:      nil,
+			AuthLevel:    authLevel.String,
+			ClientIP:     nil,
+			ProxyIP:      nil,
+			AuditInput:   json.RawMessage(input),
+			UID:          row[UID].Data,
+			UserName:     row[UserName].Data,
+			GroupName:    row[GroupName].Data,
+			UnitName:     row[UnitName].Data,
+			ResourceName: row[ResourceName].Data,
+			EventTime:    row[LastUpdated].Data,
+		}
+		if subject.Valid {
+			entry[Subject] = subject.String
+		}
+		if clientIP.Valid {
+			entry[ClientIP] = clientIP.String
+		}
+		if proxyIP.Valid {
+			entry[ProxyIP] = proxyIP.String
+		}
+		out = append(out, entry)
+	}
+
+	return page.output(out), nil
+}
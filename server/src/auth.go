@@ -9,13 +9,20 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwt"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/patrickmn/go-cache"
 	scitokens "github.com/scitokens/scitokens-go"
 	log "github.com/sirupsen/logrus"
@@ -23,41 +30,304 @@ import (
 )
 
 var accCache *cache.Cache
-var enforcer scitokens.Enforcer
+
+// tokenConfig is the scitokens enforcer of the issuers in the configuration, with the token scopes honored for each
+// issuer.  It is replaced as a whole by reloads, and stopped once the requests validating tokens with it are done.
+type tokenConfig struct {
+	enforcer scitokens.Enforcer
+	scopes   map[string][]scitokens.Scope
+	issuers  []string
+	cancel   context.CancelFunc
+	mutex    sync.RWMutex
+	stopped  bool
+}
+
+// tokenValidation is the token configuration loaded by the last reload
+var tokenValidation atomic.Pointer[tokenConfig]
 
 type accessor struct {
-	accid   int
-	name    string
-	active  bool
-	write   bool
-	accType string
-	uname   string
+	accid    int
+	name     string
+	active   bool
+	write    bool
+	admin    bool
+	accType  string
+	uname    string
+	policies []accessorPolicy
+	scoped   bool
+	scopes   []accessorPolicy
+}
+
+// accessorPolicy limits an accessor to an API, an affiliation unit and a compute resource.  Empty values match any.
+type accessorPolicy struct {
+	api      string
+	unit     string
+	resource string
+	write    bool
+}
+
+// leaderAPIs are the APIs group leaders can call with a JWT for the groups they lead
+var leaderAPIs = map[string]bool{
+	"addUserToGroup":      true,
+	"removeUserFromGroup": true,
+	"getGroupMembers":     true,
+}
+
+// adminAPIs are the APIs managing FERRY itself, only callable by admin accessors
+var adminAPIs = map[string]bool{
+	"createAccessor":       true,
+	"setAccessorInfo":      true,
+	"deactivateAccessor":   true,
+	"createAccessorPolicy": true,
+	"removeAccessorPolicy": true,
+	"getAccessorCache":     true,
+	"flushAccessorCache":   true,
+	"reloadServer":         true,
+}
+
+// isAdmin checks if the accessor can call the admin APIs: it must have the admin flag and must not be limited by
+// policies or token scopes, so a limited accessor cannot lift its own limits
+func (acc accessor) isAdmin() bool {
+	return acc.admin && !acc.scoped && len(acc.policies) == 0
+}
+
+// allows checks if the accessor can call an API with a role, regardless of the resource scope
+func (acc accessor) allows(api string, r AccessRole) bool {
+	return acc.allowsScope(api, r, nil)
+}
+
+// allowsScope checks if the accessor can call an API with a role on the units and resources given in scope.  A nil
+// scope matches any resource.  The write flag of the accessor bounds its policies, and accessors authorized by token
+// scopes are limited to what both their policies and scopes allow.
+func (acc accessor) allowsScope(api string, r AccessRole, scope map[Attribute][]string) bool {
+	if adminAPIs[api] && !acc.isAdmin() {
+		return false
+	}
+	if r == RoleWrite && !acc.write {
+		return false
+	}
+	if acc.scoped && !matchPolicies(acc.scopes, api, r, scope) {
+		return false
+	}
+	if len(acc.policies) == 0 {
+		return true
+	}
+	return matchPolicies(acc.policies, api, r, scope)
+}
+
+// matchPolicies checks if any of the policies allows an API with a role on the units and resources given in scope
+func matchPolicies(policies []accessorPolicy, api string, r AccessRole, scope map[Attribute][]string) bool {
+	for _, p := range policies {
+		if (p.api != "" && p.api != api) || (r == RoleWrite && !p.write) {
+			continue
+		}
+		if scope != nil && p.unit != "" && !containsFold(scope[UnitName], p.unit) {
+			continue
+		}
+		if scope != nil && p.resource != "" && !containsFold(scope[ResourceName], p.resource) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// containsFold checks if a list contains a name, ignoring case
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopePrefix is the prefix of the token scopes granting access to FERRY
+const scopePrefix = "ferry."
+
+// loadIssuerScopes reads the token_scopes section of the configuration
+func loadIssuerScopes() (map[string][]scitokens.Scope, error) {
+	var config []struct {
+		Issuer string   `mapstructure:"issuer"`
+		Scopes []string `mapstructure:"scopes"`
+	}
+	if err := viper.UnmarshalKey("token_scopes", &config); err != nil {
+		return nil, fmt.Errorf("invalid token_scopes: %s", err)
+	}
+
+	scopes := make(map[string][]scitokens.Scope)
+	for _, issuer := range config {
+		if issuer.Issuer == "" {
+			return nil, errors.New("invalid token_scopes: missing issuer")
+		}
+		for _, s := range issuer.Scopes {
+			scope := scitokens.ParseScope(s)
+			if _, ok := scopePolicy(scope); !ok {
+				return nil, fmt.Errorf("invalid token_scopes: %s is not a valid scope for issuer %s", s, issuer.Issuer)
+			}
+			scopes[issuer.Issuer] = append(scopes[issuer.Issuer], scope)
+		}
+	}
+	return scopes, nil
+}
+
+// scopePolicy converts a token scope to the policy it grants.  Valid scopes are ferry.read and ferry.write, optionally
+// limited to a path: /api/<name>, /unit/<name> or /resource/<name>.
+func scopePolicy(s scitokens.Scope) (accessorPolicy, bool) {
+	var p accessorPolicy
+	switch s.Auth {
+	case scopePrefix + "read":
+	case scopePrefix + "write":
+		p.write = true
+	default:
+		return p, false
+	}
+
+	path := strings.Trim(s.Path, "/")
+	if path == "" || path == "." {
+		return p, true
+	}
+	kind, name, _ := strings.Cut(path, "/")
+	if strings.Contains(name, "/") {
+		return p, false
+	}
+	switch kind {
+	case "api":
+		p.api = name
+	case "unit":
+		p.unit = name
+	case "resource":
+		p.resource = name
+	default:
+		return p, false
+	}
+	return p, true
+}
+
+// tokenScopes returns the policies granted by the scopes of a token, and whether its issuer is configured to be
+// authorized by scopes.  Scopes not listed for the issuer in token_scopes are ignored.
+func (t *tokenConfig) tokenScopes(token scitokens.SciToken) ([]accessorPolicy, bool) {
+	honored, found := t.scopes[token.Issuer()]
+	if !found {
+		return nil, false
+	}
+
+	var policies []accessorPolicy
+	for _, s := range token.Scopes() {
+		p, ok := scopePolicy(s)
+		if !ok {
+			continue
+		}
+		for _, h := range honored {
+			if h.Allowed(s.Auth, s.Path) {
+				policies = append(policies, p)
+				break
+			}
+		}
+	}
+	return policies, true
+}
+
+// scopeAccessor returns the accessor of a token with no accessors row, authorized only by the policies of its scopes
+func scopeAccessor(subject string, issuer string, scopes []accessorPolicy) accessor {
+	return accessor{name: subject, active: true, write: true, accType: "jwt_scope", uname: issuer, scoped: true, scopes: scopes}
 }
 
 func AuthInitialize() error {
-	if enforcer == nil {
-		ctx := context.Background()
-		if len(viper.GetStringSlice("issuers")) == 0 {
-			return errors.New("at least one 'issuers' must exist in the config file")
-		}
-		var err error
-		// NewEnforcerDaemon has its own internal cache to avoid calling the issuers for the same token.
-		enforcer, err = scitokens.NewEnforcerDaemon(ctx, viper.GetStringSlice("issuers")...)
+	if tokenValidation.Load() == nil {
+		t, err := newEnforcer()
 		if err != nil {
-			return fmt.Errorf("auth.AuthInitilize NewEnforcerDeamon error: %s", err.Error())
+			return fmt.Errorf("auth.AuthInitilize %s", err.Error())
 		}
+		tokenValidation.Store(t)
 	}
 	return nil
 }
 
-func queryAccessors(key string) (accessor, bool) {
+// newEnforcer creates a scitokens enforcer for the issuers in the configuration, with the scopes honored for each
+// issuer
+func newEnforcer() (*tokenConfig, error) {
+	if len(viper.GetStringSlice("issuers")) == 0 {
+		return nil, errors.New("at least one 'issuers' must exist in the config file")
+	}
+	scopes, err := loadIssuerScopes()
+	if err != nil {
+		return nil, err
+	}
+	configured := viper.GetStringSlice("issuers")
+	issuers := slices.Clone(configured)
+	for issuer := range scopes {
+		if !slices.Contains(issuers, issuer) {
+			issuers = append(issuers, issuer)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// NewEnforcerDaemon has its own internal cache to avoid calling the issuers for the same token.
+	e, err := scitokens.NewEnforcerDaemon(ctx, issuers...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("NewEnforcerDeamon error: %s", err.Error())
+	}
+	return &tokenConfig{enforcer: e, scopes: scopes, issuers: configured, cancel: cancel}, nil
+}
+
+// acquireTokenConfig returns the current token configuration, which is not stopped until released with RUnlock
+func acquireTokenConfig() *tokenConfig {
+	for {
+		t := tokenValidation.Load()
+		t.mutex.RLock()
+		if !t.stopped {
+			return t
+		}
+		// Replaced and stopped by a reload since it was loaded
+		t.mutex.RUnlock()
+	}
+}
+
+// stop stops the enforcer once the requests using it are done
+func (t *tokenConfig) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	t.cancel()
+}
+
+// tokenGrant is what a validated token may be authorized by
+type tokenGrant struct {
+	// scopes are the policies granted by the scopes of the token
+	scopes []accessorPolicy
+	// scoped is set if the issuer is authorized by scopes
+	scoped bool
+	// identifies is set if the issuer is in the issuers list, so the subject names a jwt_role accessor or a user.
+	// Subjects of tokens from issuers only listed in token_scopes are chosen by those issuers and identify nobody.
+	identifies bool
+}
+
+// grant returns what a validated token may be authorized by
+func (t *tokenConfig) grant(token scitokens.SciToken) tokenGrant {
+	scopes, scoped := t.tokenScopes(token)
+	return tokenGrant{scopes, scoped, slices.Contains(t.issuers, token.Issuer())}
+}
+
+// validateToken validates the token of a request, returning what it may be authorized by
+func validateToken(r *http.Request) (scitokens.SciToken, tokenGrant, error) {
+	t := acquireTokenConfig()
+	defer t.mutex.RUnlock()
+
+	token, err := t.enforcer.ValidateTokenRequest(r)
+	if err != nil {
+		return nil, tokenGrant{}, err
+	}
+	return token, t.grant(token), nil
+}
+
+func queryAccessors(ctx context.Context, key string) (accessor, bool) {
 	var found = true
 	var acc accessor
 
 	// Not using the transaction.go logic as it is written to be called with Run(....)
 
-	ctx := context.Background()
-
 	tx, err := DBptr.BeginTx(ctx, nil)
 	if err != nil {
 		log.Error(fmt.Sprintf("queryAccessors - transaction failed: %s", err.Error()))
@@ -66,8 +336,8 @@ func queryAccessors(key string) (accessor, bool) {
 	}
 
 	// log.Infof("queryAccessors - key: %s", key)
-	err = tx.QueryRow(`select accid, name, active, write, type from accessors where name = $1 and active = true`,
-		key).Scan(&acc.accid, &acc.name, &acc.active, &acc.write, &acc.accType)
+	err = tx.QueryRowContext(ctx, `select accid, name, active, write, admin, type from accessors where name = $1 and active = true`,
+		key).Scan(&acc.accid, &acc.name, &acc.active, &acc.write, &acc.admin, &acc.accType)
 	if err == sql.ErrNoRows {
 		found = false
 	} else if err != nil {
@@ -83,7 +353,7 @@ func queryAccessors(key string) (accessor, bool) {
 		// but are in LDAP through the capability set of that name.
 		_, err = uuid.Parse(acc.name)
 		if err == nil {
-			err = tx.QueryRow(`select uname from users where token_subject = $1`, acc.name).Scan(&acc.uname)
+			err = tx.QueryRowContext(ctx, `select uname from users where token_subject = $1`, acc.name).Scan(&acc.uname)
 			if err == sql.ErrNoRows {
 				log.Error(fmt.Sprintf("queryAccessors - tokensubject does not reference a valid user.  tokensubject: %s", acc.name))
 				found = false
@@ -94,6 +364,15 @@ func queryAccessors(key string) (accessor, bool) {
 		}
 	}
 
+	// Load the policies limiting the access of the accessor
+	if found {
+		acc.policies, err = queryAccessorPolicies(ctx, tx, acc.accid)
+		if err != nil {
+			log.Error(fmt.Sprintf("queryAccessors - policies query failed: %s", err.Error()))
+			found = false
+		}
+	}
+
 	// Update, so we can know who is using FERRY
 	if found {
 		_, err = tx.ExecContext(ctx, `update accessors set last_used=NOW() where accid = $1`, acc.accid)
@@ -117,7 +396,29 @@ func queryAccessors(key string) (accessor, bool) {
 	return acc, found
 }
 
-func getAccessor(key string, ip string) (accessor, bool) {
+func queryAccessorPolicies(ctx context.Context, tx *sql.Tx, accid int) ([]accessorPolicy, error) {
+	rows, err := tx.QueryContext(ctx, `select coalesce(api, ''), coalesce(au.name, ''), coalesce(cr.name, ''), write
+						   from accessor_policies as p
+						   left join affiliation_units as au using(unitid)
+						   left join compute_resources as cr using(compid)
+						   where accid = $1`, accid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []accessorPolicy
+	for rows.Next() {
+		var p accessorPolicy
+		if err := rows.Scan(&p.api, &p.unit, &p.resource, &p.write); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+func getAccessor(ctx context.Context, key string, ip string) (accessor, bool) {
 	var acc accessor
 	var whereFound string = "NOT FOUND"
 	var found bool = false
@@ -126,15 +427,23 @@ func getAccessor(key string, ip string) (accessor, bool) {
 	if found {
 		acc = data.(accessor)
 		whereFound = "cache"
+		accessorCache.WithLabelValues("hit").Inc()
 	} else {
-		acc, found = queryAccessors(key)
+		accessorCache.WithLabelValues("miss").Inc()
+		acc, found = queryAccessors(ctx, key)
+		if !found && key == ip {
+			// Look for the narrowest ip_role network containing the address
+			if network, matched := matchIPNetwork(ctx, ip); matched {
+				acc, found = queryAccessors(ctx, network)
+			}
+		}
 		if found {
 			// Store in cache by BOTH DN, if provided, and IP. Be aware that checkClientIP checks the IP,
 			// regardless if DN is used.   Not caching both will cause a DB hit on every API called via a DN.
 			//
 			// Set() REPLACES any existing matching item -- there may be one of the two still in cache.
 			AccCache.Set(key, acc, cache.DefaultExpiration)
-			if key != ip {
+			if key != ip && ip != "" {
 				AccCache.Set(ip, acc, cache.DefaultExpiration)
 			}
 			whereFound = "accessors table"
@@ -146,6 +455,143 @@ func getAccessor(key string, ip string) (accessor, bool) {
 	return acc, found
 }
 
+// clientIP returns the IP address of a remote address, with or without a port.  IPv6 addresses lose their brackets
+// and zone, and all addresses are returned in their canonical form so they match the names of ip_role accessors.
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+	}
+	if zone := strings.Index(host, "%"); zone >= 0 {
+		host = host[:zone]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// ipNetworksKey is the accessor cache entry holding the active ip_role networks, so addresses without an accessor of
+// their own are matched without querying the database on every connection
+const ipNetworksKey = "ip_role networks"
+
+// matchIPNetwork returns the name of the active ip_role accessor with the longest CIDR prefix containing an IP address
+func matchIPNetwork(ctx context.Context, ip string) (string, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false
+	}
+
+	networks, err := loadIPNetworks(ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf("matchIPNetwork - query failed: %s", err.Error()))
+		return "", false
+	}
+
+	var match string
+	longest := -1
+	for name, network := range networks {
+		if !network.Contains(addr) {
+			continue
+		}
+		if ones, _ := network.Mask.Size(); ones > longest || (ones == longest && name < match) {
+			match, longest = name, ones
+		}
+	}
+
+	return match, longest >= 0
+}
+
+// loadIPNetworks returns the networks of the active ip_role accessors by name, from the accessor cache when loaded
+func loadIPNetworks(ctx context.Context) (map[string]*net.IPNet, error) {
+	if data, found := AccCache.Get(ipNetworksKey); found {
+		return data.(map[string]*net.IPNet), nil
+	}
+
+	rows, err := DBptr.QueryContext(ctx, `select name from accessors where type = 'ip_role' and active = true and name like '%/%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	networks := make(map[string]*net.IPNet)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if _, network, err := net.ParseCIDR(name); err == nil {
+			networks[name] = network
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	AccCache.Set(ipNetworksKey, networks, cache.DefaultExpiration)
+	return networks, nil
+}
+
+// invalidateAccessor removes an accessor from the cache, both by name and by the IP addresses it was cached for
+func invalidateAccessor(name string, accid int64) {
+	if AccCache == nil {
+		return
+	}
+	AccCache.Delete(name)
+	invalidateAccessorID(accid)
+	log.Debugf("invalidateAccessor - removed %s (accid %d) from the cache", name, accid)
+}
+
+// invalidateAccessorID removes every cache entry of an accessor, returning the number of entries removed.  The cached
+// ip_role networks are reloaded too, as the accessor may be one of them.
+func invalidateAccessorID(accid int64) int {
+	var removed int
+	AccCache.Delete(ipNetworksKey)
+	for key, item := range AccCache.Items() {
+		if acc, ok := item.Object.(accessor); ok && int64(acc.accid) == accid {
+			AccCache.Delete(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// accessorsChannel is notified by the database when accessors or their policies change, with the accid as payload
+const accessorsChannel = "accessors_changed"
+
+// AccessorCacheListen removes accessors from the cache as soon as the database notifies they changed.  Notifications
+// sent while the connection is lost are missed, so the whole cache is flushed when it is reestablished.
+func AccessorCacheListen(connString string) {
+	listener := pq.NewListener(connString, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warnf("AccessorCacheListen - %s", err)
+		}
+	})
+	if err := listener.Listen(accessorsChannel); err != nil {
+		log.Errorf("AccessorCacheListen - unable to listen to %s, accessors will stay cached until they expire: %s", accessorsChannel, err)
+		listener.Close()
+		return
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			// pq sends nil after reconnecting
+			if n == nil {
+				AccCache.Flush()
+				log.Info("AccessorCacheListen - reconnected, flushed the accessor cache")
+				continue
+			}
+			accid, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				log.Warnf("AccessorCacheListen - invalid notification payload %q", n.Extra)
+				continue
+			}
+			removed := invalidateAccessorID(accid)
+			log.Debugf("AccessorCacheListen - accid %d changed, removed %d entries from the cache", accid, removed)
+		}
+	}()
+}
+
 func loadCerts(certs []string) (*x509.CertPool, error) {
 	pool := x509.NewCertPool()
 	for _, ca := range certs {
@@ -197,105 +643,313 @@ func parseDN(names []pkix.AttributeTypeAndValue, sep string) string {
 	return sep + strings.Join(subject, sep)
 }
 
-// Authorize the client by JWT, DN or IP.  Returns the level of access, a message and the validated string.
-func authorize(c APIContext, r AccessRole) (AccessLevel, string, string) {
+// Authorize the client by JWT, DN or IP for the API in the context.
+// Returns the level of access, a message, the validated string and the matching accessor.
+func authorize(c APIContext, r AccessRole) (AccessLevel, string, string, accessor) {
+	var none accessor
 
 	// See, if the API allows public access
 	if r == RolePublic {
-		return LevelPublic, "public role authorized", ""
+		return LevelPublic, "public role authorized", "", none
 	}
 
-	// Is it IPv4 or IPv6? Either way, drop the port number on the end.  Remove [] for IPv6.
-	re := regexp.MustCompile(`\[(.*?)\]`)
-	ipv6 := re.FindString(c.R.RemoteAddr)
-	ip := ipv6
-	if len(ipv6) == 0 {
-		ip = strings.Split(c.R.RemoteAddr, ":")[0]
-	} else {
-		ip = ipv6[1 : len(ipv6)-1]
+	ip, _ := requestClient(c.R)
+	ctx := c.R.Context()
+
+	// Reject revoked client certificates, whatever else authorizes the client
+	if revoked, message := revokedCertificate(c.R); revoked {
+		return LevelDenied, message, "", none
 	}
 
-	// Try authorizing using a json web token
+	// Try authorizing using a json web token.  userSubject is only set for tokens whose subject identifies a user.
+	var userSubject string
 	_, err := jwt.ParseRequest(c.R)
 	if err == nil {
-		var uuid string
-		if token, err := enforcer.ValidateTokenRequest(c.R); err == nil {
+		var uuid, issuer string
+		var grant tokenGrant
+		if token, g, err := validateToken(c.R); err == nil {
 			uuid = token.Subject()
+			issuer = token.Issuer()
+			grant = g
 		} else {
 			e := &scitokens.TokenValidationError{}
 			if !errors.As(err, &e) {
 				// some internal error while parsing/validating the token
 				log.Error(err)
-				return LevelDenied, fmt.Sprintf("Internal scitokens error: %s", err.Error()), ""
+				return LevelDenied, fmt.Sprintf("Internal scitokens error: %s", err.Error()), "", none
 			} else {
 				// token is not valid, err (and e.Err) will say why.
 				log.Info(err)
-				return LevelDenied, e.Error(), ""
+				return LevelDenied, e.Error(), "", none
 			}
 		}
-		acc, found := getAccessor(uuid, ip)
-		if found {
-			// authorize JWT roles
-			if acc.accType == "jwt_role" {
-				if r == RoleRead || (r == RoleWrite && acc.write) {
-					return LevelDNRole, fmt.Sprintf("JWT matches authorized role %s UUID %s for %s", r, uuid, acc.uname), fmt.Sprintf("%s %s", acc.uname, uuid)
+		found := false
+		if grant.identifies {
+			var acc accessor
+			acc, found = getAccessor(ctx, uuid, ip)
+			if found {
+				// authorize JWT roles
+				if acc.accType == "jwt_role" {
+					acc.scoped, acc.scopes = grant.scoped, grant.scopes
+					if acc.allows(c.API, r) {
+						return LevelDNRole, fmt.Sprintf("JWT matches authorized role %s UUID %s for %s", r, uuid, acc.uname), fmt.Sprintf("%s %s", acc.uname, uuid), acc
+					}
 				}
 			}
+			userSubject = uuid
+		}
+
+		// authorize services by the scopes of tokens minted by their own issuers, with no accessors row
+		if grant.scoped && !found {
+			acc := scopeAccessor(uuid, issuer, grant.scopes)
+			if acc.allows(c.API, r) {
+				return LevelJWTScope, fmt.Sprintf("JWT scopes from issuer %s allow role %s for %s", issuer, r, uuid), fmt.Sprintf("%s %s", issuer, uuid), acc
+			}
 		}
 	}
 
 	// Try authorizing DN by the Certs
-	for _, presCert := range c.R.TLS.PeerCertificates {
-		certDN := parseDN(presCert.Subject.Names, "/")
+	for _, certDN := range requestDNs(c.R) {
 		log.Debugf("authorize - calling getAccessor by certDn: %s ip: %s", certDN, ip)
-		acc, found := getAccessor(certDN, ip)
+		acc, found := getAccessor(ctx, certDN, ip)
 		if found {
 			// authorize DN roles
 			if acc.accType == "dn_role" {
-				if r == RoleRead || (r == RoleWrite && acc.write) {
-					return LevelDNRole, fmt.Sprintf("cert matches authorized role %s DN %s", r, certDN), certDN
+				if acc.allows(c.API, r) {
+					return LevelDNRole, fmt.Sprintf("cert matches authorized role %s DN %s", r, certDN), certDN, acc
 				}
 			}
 		}
 	}
 
-	// Try authorizing by the  IP address
-	log.Debugf("authorize - calling getAccessor by ip: %s ip: %s", ip, ip)
-	acc, found := getAccessor(ip, ip)
-	if found {
-		// authorize IP roles
-		if acc.accType == "ip_role" {
-			if r == RoleRead || (r == RoleWrite && acc.write) {
-				return LevelIPRole, fmt.Sprintf("ignoring DN of authorized IP %s with role %s", ip, r), ip
+	// Try authorizing by the  IP address, unknown when a trusted proxy does not pass the address of its client
+	if ip != "" {
+		log.Debugf("authorize - calling getAccessor by ip: %s ip: %s", ip, ip)
+		acc, found := getAccessor(ctx, ip, ip)
+		if found {
+			// authorize IP roles
+			if acc.accType == "ip_role" {
+				if acc.allows(c.API, r) {
+					return LevelIPRole, fmt.Sprintf("ignoring DN of authorized IP %s with role %s", ip, r), ip, acc
+				}
 			}
 		}
 	}
 
+	// Only when no accessor authorizes the client, try authorizing users reading their own data by their token or
+	// certificate, the username is pinned by authorizeScope
+	if r == RoleSelf {
+		if userSubject != "" {
+			if uname, found := queryActiveUser(c, userSubject); found {
+				self := accessor{name: userSubject, active: true, accType: "self", uname: uname}
+				return LevelSelf, fmt.Sprintf("JWT matches user %s UUID %s, self access", uname, userSubject), fmt.Sprintf("%s %s", uname, userSubject), self
+			}
+		}
+		for _, certDN := range requestDNs(c.R) {
+			if uname, found := queryCertificateUser(c, certDN); found {
+				self := accessor{name: certDN, active: true, accType: "self", uname: uname}
+				return LevelSelf, fmt.Sprintf("cert matches user %s DN %s, self access", uname, certDN), certDN, self
+			}
+		}
+	}
+
+	// Only when no accessor authorizes the client, try authorizing group leaders, the groups they lead are checked by
+	// authorizeScope
+	if leaderAPIs[c.API] && userSubject != "" {
+		if uname, found := queryActiveUser(c, userSubject); found {
+			leader := accessor{name: userSubject, active: true, write: true, accType: "group_leader", uname: uname}
+			return LevelGroupLeader, fmt.Sprintf("JWT matches user %s UUID %s, checking group leadership", uname, userSubject), fmt.Sprintf("%s %s", uname, userSubject), leader
+		}
+	}
+
 	// Go away, we don't like you
-	return LevelDenied, "unable to authorize access", ""
+	return LevelDenied, "unable to authorize access", "", none
 }
 
-func checkClientIP(client *tls.ClientHelloInfo) (*tls.Config, error) {
-	ip := client.Conn.RemoteAddr().String()
-	ip = strings.Split(ip, ":")[0]
-	_, found := getAccessor(ip, ip)
+// queryActiveUser returns the name of the active user owning a token subject
+func queryActiveUser(c APIContext, tokenSubject string) (string, bool) {
+	var uname string
+	err := DBptr.QueryRowContext(c.Ctx, `select uname from users
+										 where token_subject = $1 and status is true and is_banned is false`,
+		tokenSubject).Scan(&uname)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(fmt.Sprintf("queryActiveUser - query failed: %s", err.Error()))
+		}
+		return "", false
+	}
+	return uname, true
+}
 
-	if found {
-		log.WithFields(log.Fields{"client": ip}).Info("Host matches authorized IP.")
+// queryCertificateUser returns the name of the active user owning a certificate DN
+func queryCertificateUser(c APIContext, dn string) (string, bool) {
+	var uname string
+	err := DBptr.QueryRowContext(c.Ctx, `select uname from users join user_certificates using(uid)
+										 where dn = $1 and status is true and is_banned is false`,
+		dn).Scan(&uname)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error(fmt.Sprintf("queryCertificateUser - query failed: %s", err.Error()))
+		}
+		return "", false
+	}
+	return uname, true
+}
 
-		var err error
-		srvConfig := viper.GetStringMapString("server")
-		newConfig := Mainsrv.TLSConfig.Clone()
-		newConfig.ClientAuth = tls.VerifyClientCertIfGiven
-		newConfig.Certificates = make([]tls.Certificate, 1)
-		newConfig.Certificates[0], err = tls.LoadX509KeyPair(srvConfig["cert"], srvConfig["key"])
-		if err != nil {
-			log.Print(err)
-			return nil, err
+// authorizeSelf pins the username of an API call to the user authorized for self access
+func authorizeSelf(c APIContext, i Input) (bool, string) {
+	if i[UID].Valid || i[TokenSubject].Valid {
+		return false, fmt.Sprintf("user %s must use username for self access", c.Accessor.uname)
+	}
+	if i[UserName].Valid && !strings.EqualFold(fmt.Sprint(i[UserName].Data), c.Accessor.uname) {
+		return false, fmt.Sprintf("user %s cannot read data of user %v", c.Accessor.uname, i[UserName].Data)
+	}
+	i[UserName] = NewNullAttribute(UserName).Default(c.Accessor.uname)
+	return true, ""
+}
+
+// authorizeLeader checks that a group leader authorized by JWT leads the group given in the input
+func authorizeLeader(c APIContext, i Input) (bool, string) {
+	if i[Leader].Valid {
+		return false, fmt.Sprintf("group leader %s cannot change group leadership", c.Accessor.uname)
+	}
+
+	var leads bool
+	err := c.DBtx.QueryRow(`select exists (select 1 from user_group
+										  join users using(uid)
+										  join groups using(groupid)
+										  where uname = $1 and groups.name = $2 and groups.type = $3 and is_leader)`,
+		c.Accessor.uname, i[GroupName], i[GroupType].Default("UnixGroup")).Scan(&leads)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		return false, "unable to check group leadership"
+	}
+	if !leads {
+		return false, fmt.Sprintf("%s is not a leader of group %v", c.Accessor.uname, i[GroupName].Data)
+	}
+	return true, ""
+}
+
+// authorizeScope checks the resource scope of an API call against the policies of the accessor that was authorized
+func authorizeScope(c APIContext, api *BaseAPI, i Input) (bool, string) {
+	// checked again here for batch steps, which are authorized by the accessor of the batch
+	if adminAPIs[c.API] && !c.Accessor.isAdmin() {
+		return false, fmt.Sprintf("%s is not an admin accessor", c.Accessor.name)
+	}
+	if c.AuthLevel == LevelGroupLeader {
+		return authorizeLeader(c, i)
+	}
+	if c.AuthLevel == LevelSelf {
+		return authorizeSelf(c, i)
+	}
+	if api.AccessRole == RolePublic || (len(c.Accessor.policies) == 0 && !c.Accessor.scoped) {
+		return true, ""
+	}
+
+	scope, err := resolveScope(c, api.Scope, i)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		return false, fmt.Sprintf("unable to resolve the scope of %s", c.API)
+	}
+	if c.Accessor.allowsScope(c.API, api.AccessRole, scope) {
+		return true, ""
+	}
+	return false, fmt.Sprintf("no policy or scope of %s allows %s on %v", c.Accessor.name, c.API, scope)
+}
+
+// resolveScope returns the units and resources an API call acts on, from the scope attributes of the API.  An explicit
+// unitname or resourcename is used as given.  Otherwise a group is scoped by the units and resources it belongs to,
+// and users by the units and resources shared by all of them.
+func resolveScope(c APIContext, attributes []Attribute, i Input) (map[Attribute][]string, error) {
+	given := Input{GroupType: i[GroupType]}
+	for _, attribute := range attributes {
+		given[attribute] = i[attribute]
+	}
+
+	scope, err := queryScope(c, given, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[Attribute][]string{UnitName: scope.units, ResourceName: scope.resources}, nil
+}
+
+// entityScope holds the affiliation units and compute resources an API call acts on, by id and by name.  An explicit
+// unit or resource that does not exist has a name but no id.
+type entityScope struct {
+	unitIDs     []int64
+	units       []string
+	resourceIDs []int64
+	resources   []string
+}
+
+// queryScope finds the affiliation units and compute resources of the unitname, resourcename, group or users of an
+// input.  An explicit unitname or resourcename is used as given.  Otherwise a group is scoped by the units and resources
+// it belongs to, and users by those of any of them, or only those shared by all of them when shared is set.
+func queryScope(c APIContext, i Input, shared bool) (entityScope, error) {
+	var scope entityScope
+
+	var uids []int64
+	users := 0
+	for _, attribute := range []Attribute{UID, SourceUID, TargetUID} {
+		if i[attribute].Valid {
+			uids = append(uids, i[attribute].Data.(int64))
+			users++
 		}
+	}
+	if i[UserName].Valid {
+		users++
+	}
+	if !shared {
+		users = 1
+	}
 
-		return newConfig, nil
+	err := c.DBtx.QueryRow(`with units as (
+								select (select unitid from affiliation_units where name = $1) as unitid, $1::text as name
+								where $1::text is not null
+								union
+								select au.unitid, au.name from affiliation_unit_group
+								join groups as g using(groupid) join affiliation_units as au using(unitid)
+								where $1::text is null and g.name = $2 and (g.type::text = $3 or $3::text is null)
+								union
+								select au.unitid, au.name from user_affiliation_units
+								join users as u using(uid) join affiliation_units as au using(unitid)
+								where $1::text is null and $2::text is null and (u.uname = $4 or u.uid = any($5))
+								group by au.unitid, au.name having count(distinct u.uid) >= $7
+							), resources as (
+								select (select compid from compute_resources where name = $6) as compid, $6::text as name
+								where $6::text is not null
+								union
+								select cr.compid, cr.name from compute_access_group
+								join groups as g using(groupid) join compute_resources as cr using(compid)
+								where $6::text is null and g.name = $2 and (g.type::text = $3 or $3::text is null)
+								union
+								select cr.compid, cr.name from compute_access
+								join users as u using(uid) join compute_resources as cr using(compid)
+								where $6::text is null and $2::text is null and (u.uname = $4 or u.uid = any($5))
+								group by cr.compid, cr.name having count(distinct u.uid) >= $7
+							)
+							select array(select unitid from units where unitid is not null), array(select name from units),
+								   array(select compid from resources where compid is not null), array(select name from resources)`,
+		i[UnitName], i[GroupName], i[GroupType], i[UserName], pq.Array(uids), i[ResourceName], users).Scan(
+		pq.Array(&scope.unitIDs), pq.Array(&scope.units), pq.Array(&scope.resourceIDs), pq.Array(&scope.resources))
+
+	return scope, err
+}
+
+func checkClientIP(client *tls.ClientHelloInfo) (*tls.Config, error) {
+	ip := clientIP(client.Conn.RemoteAddr().String())
+	_, found := getAccessor(client.Context(), ip, ip)
+
+	// Client certificates are verified against the CAs loaded by the last reload
+	newConfig := Mainsrv.TLSConfig.Clone()
+	newConfig.ClientCAs = clientCAs.Load()
+
+	// Trusted proxies terminate the TLS connection of their clients and may not have a certificate of their own
+	if found || isTrustedProxy(ip) {
+		log.WithFields(log.Fields{"client": ip}).Info("Host matches authorized IP.")
+		newConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 
-	return nil, nil
+	return newConfig, nil
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/patrickmn/go-cache"
+	"github.com/scitokens/scitokens-go"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		ip   string
+	}{
+		{"192.0.2.1:8443", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[::1]:8443", "::1"},
+		{"::1", "::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:0db8:0000:0000::0001]:8443", "2001:db8::1"},
+		{"[fe80::1%eth0]:8443", "fe80::1"},
+		{"[::ffff:192.0.2.1]:8443", "192.0.2.1"},
+		{"not an address", "not an address"},
+	}
+
+	for _, test := range tests {
+		if ip := clientIP(test.addr); ip != test.ip {
+			t.Errorf("clientIP(%q): expected %q, got %q", test.addr, test.ip, ip)
+		}
+	}
+}
+
+// testAccessorCache replaces the accessor cache for the duration of a test
+func testAccessorCache(t *testing.T) {
+	previous := AccCache
+	AccCache = cache.New(time.Minute, time.Minute)
+	t.Cleanup(func() { AccCache = previous })
+}
+
+func TestMatchIPNetwork(t *testing.T) {
+	testAccessorCache(t)
+
+	networks := make(map[string]*net.IPNet)
+	for _, name := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "10.2.0.1/16",
+		"2001:db8::/32", "2001:db8:1::/48"} {
+		_, network, err := net.ParseCIDR(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks[name] = network
+	}
+	AccCache.Set(ipNetworksKey, networks, cache.DefaultExpiration)
+
+	tests := []struct {
+		name    string
+		ip      string
+		network string
+		found   bool
+	}{
+		{"widest network", "10.9.9.9", "10.0.0.0/8", true},
+		{"overlapping networks", "10.1.9.9", "10.1.0.0/16", true},
+		{"longest prefix", "10.1.2.3", "10.1.2.0/24", true},
+		{"same prefix", "10.2.3.4", "10.2.0.0/16", true},
+		{"IPv6 network", "2001:db8:2::1", "2001:db8::/32", true},
+		{"IPv6 longest prefix", "2001:db8:1::1", "2001:db8:1::/48", true},
+		{"IPv4-mapped IPv6 address", "::ffff:10.1.2.3", "10.1.2.0/24", true},
+		{"no network", "192.0.2.1", "", false},
+		{"IPv6 address outside the networks", "2001:db9::1", "", false},
+		{"not an address", "10.1.2", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network, found := matchIPNetwork(context.Background(), test.ip)
+			if network != test.network || found != test.found {
+				t.Errorf("expected %q %v, got %q %v", test.network, test.found, network, found)
+			}
+		})
+	}
+}
+
+// testConn is a connection with a fixed remote address
+type testConn struct {
+	net.Conn
+	remote string
+}
+
+func (c testConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remote)
+	return addr
+}
+
+func TestCheckClientIP(t *testing.T) {
+	testAccessorCache(t)
+	previous := Mainsrv
+	Mainsrv = &http.Server{TLSConfig: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}}
+	t.Cleanup(func() { Mainsrv = previous })
+
+	for _, ip := range []string{"192.0.2.10", "2001:db8::10"} {
+		AccCache.Set(ip, accessor{name: ip, active: true, accType: "ip_role"}, cache.DefaultExpiration)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+	}{
+		{"IPv4 accessor", "192.0.2.10:8443"},
+		{"IPv6 accessor", "[2001:db8::10]:8443"},
+		{"IPv6 accessor in its long form", "[2001:0db8:0000::0010]:8443"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := checkClientIP(&tls.ClientHelloInfo{Conn: testConn{remote: test.remote}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != tls.VerifyClientCertIfGiven {
+				t.Errorf("expected the client certificate to be optional, got %v", config.ClientAuth)
+			}
+		})
+	}
+}
+
+func TestScopePolicy(t *testing.T) {
+	tests := []struct {
+		scope  string
+		policy accessorPolicy
+		ok     bool
+	}{
+		{"ferry.read", accessorPolicy{}, true},
+		{"ferry.write", accessorPolicy{write: true}, true},
+		{"ferry.write:/api/setCondorQuota", accessorPolicy{api: "setCondorQuota", write: true}, true},
+		{"ferry.read:/unit/dune", accessorPolicy{unit: "dune"}, true},
+		{"ferry.write:/resource/fermigrid", accessorPolicy{resource: "fermigrid", write: true}, true},
+		{"ferry.read:/group/dune", accessorPolicy{}, false},
+		{"ferry.read:/api/a/b", accessorPolicy{}, false},
+		{"storage.read:/", accessorPolicy{}, false},
+	}
+
+	for _, test := range tests {
+		policy, ok := scopePolicy(scitokens.ParseScope(test.scope))
+		if ok != test.ok || (ok && policy != test.policy) {
+			t.Errorf("scopePolicy(%q): expected %+v %v, got %+v %v", test.scope, test.policy, test.ok, policy, ok)
+		}
+	}
+}
+
+// testToken returns a token of an issuer with the given scopes
+func testToken(t *testing.T, issuer string, scopes string) scitokens.SciToken {
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, issuer)
+	token.Set(jwt.SubjectKey, "service")
+	token.Set("scope", scopes)
+	st, err := scitokens.NewSciToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestTokenScopeAccess(t *testing.T) {
+	config := &tokenConfig{scopes: map[string][]scitokens.Scope{
+		"https://scoped.example.com":   {scitokens.ParseScope("ferry.read"), scitokens.ParseScope("ferry.write")},
+		"https://readonly.example.com": {scitokens.ParseScope("ferry.read")},
+		"https://quota.example.com":    {scitokens.ParseScope("ferry.write:/api/setCondorQuota")},
+	}}
+
+	tests := []struct {
+		name   string
+		issuer string
+		scopes string
+		api    string
+		role   AccessRole
+		scoped bool
+		allows bool
+	}{
+		{"read scope reads", "https://scoped.example.com", "ferry.read", "getUserInfo", RoleRead, true, true},
+		{"read scope cannot write", "https://scoped.example.com", "ferry.read", "setUserInfo", RoleWrite, true, false},
+		{"write scope writes", "https://scoped.example.com", "ferry.write", "setUserInfo", RoleWrite, true, true},
+		{"API write scope writes that API", "https://scoped.example.com", "ferry.write:/api/setCondorQuota", "setCondorQuota",
+			RoleWrite, true, true},
+		{"API write scope cannot write other APIs", "https://scoped.example.com", "ferry.write:/api/setCondorQuota", "setUserInfo",
+			RoleWrite, true, false},
+		{"write scope not honored for the issuer", "https://readonly.example.com", "ferry.read ferry.write", "setUserInfo",
+			RoleWrite, true, false},
+		{"read scope of a read-only issuer reads", "https://readonly.example.com", "ferry.read ferry.write", "getUserInfo",
+			RoleRead, true, true},
+		{"broad write scope of an issuer limited to an API", "https://quota.example.com", "ferry.write", "setUserInfo",
+			RoleWrite, true, false},
+		{"API write scope of an issuer limited to that API", "https://quota.example.com", "ferry.write:/api/setCondorQuota",
+			"setCondorQuota", RoleWrite, true, true},
+		{"no FERRY scope", "https://scoped.example.com", "storage.read:/", "getUserInfo", RoleRead, true, false},
+		{"issuer not authorized by scopes", "https://other.example.com", "ferry.write", "getUserInfo", RoleRead, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policies, scoped := config.tokenScopes(testToken(t, test.issuer, test.scopes))
+			if scoped != test.scoped {
+				t.Fatalf("expected scoped %v, got %v", test.scoped, scoped)
+			}
+			if !scoped {
+				return
+			}
+			acc := scopeAccessor("service", test.issuer, policies)
+			if allows := acc.allows(test.api, test.role); allows != test.allows {
+				t.Errorf("expected %s access to %s to be %v, got %v", test.role, test.api, test.allows, allows)
+			}
+		})
+	}
+}
+
+func TestScopedAccessorAllows(t *testing.T) {
+	read := []accessorPolicy{{}}
+	write := []accessorPolicy{{write: true}}
+
+	tests := []struct {
+		name   string
+		acc    accessor
+		role   AccessRole
+		allows bool
+	}{
+		{"write accessor with read scope", accessor{write: true, scoped: true, scopes: read}, RoleWrite, false},
+		{"write accessor with read scope reads", accessor{write: true, scoped: true, scopes: read}, RoleRead, true},
+		{"write accessor with write scope", accessor{write: true, scoped: true, scopes: write}, RoleWrite, true},
+		{"read accessor with write scope", accessor{scoped: true, scopes: write}, RoleWrite, false},
+		{"write accessor without scopes", accessor{write: true, scoped: true}, RoleRead, false},
+		{"write accessor of an unscoped issuer", accessor{write: true}, RoleWrite, true},
+	}
+
+	for _, test := range tests {
+		if allows := test.acc.allows("setUserInfo", test.role); allows != test.allows {
+			t.Errorf("%s: expected %v, got %v", test.name, test.allows, allows)
+		}
+	}
+}
+
+func TestAdminAccessorAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		acc    accessor
+		allows bool
+	}{
+		{"admin accessor", accessor{write: true, admin: true}, true},
+		{"write accessor", accessor{write: true}, false},
+		{"admin accessor with a policy for the API", accessor{write: true, admin: true,
+			policies: []accessorPolicy{{api: "createAccessor", write: true}}}, false},
+		{"admin accessor with write scope", accessor{write: true, admin: true, scoped: true,
+			scopes: []accessorPolicy{{write: true}}}, false},
+	}
+
+	for _, test := range tests {
+		if allows := test.acc.allows("createAccessor", RoleWrite); allows != test.allows {
+			t.Errorf("%s: expected %v, got %v", test.name, test.allows, allows)
+		}
+		if allows := test.acc.allows("getAccessorCache", RoleRead); allows != test.allows {
+			t.Errorf("%s: expected %v reading the cache, got %v", test.name, test.allows, allows)
+		}
+		if allows := test.acc.allows("reloadServer", RoleWrite); allows != test.allows {
+			t.Errorf("%s: expected %v reloading the server, got %v", test.name, test.allows, allows)
+		}
+	}
+}
+
+// testEnforcer accepts the token it holds for every request
+type testEnforcer struct {
+	scitokens.Enforcer
+	token scitokens.SciToken
+}
+
+func (e testEnforcer) ValidateTokenRequest(*http.Request, ...scitokens.Validator) (scitokens.SciToken, error) {
+	return e.token, nil
+}
+
+func TestAuthorizeScopeOnlyIssuer(t *testing.T) {
+	testAccessorCache(t)
+
+	const userSubject = "9b5f3c52-1d6e-4f3a-8c2e-6a0f7e1b2c3d"
+	// An accessor row for the subject, which tokens of scope-only issuers must not reach
+	AccCache.Set(userSubject, accessor{name: userSubject, active: true, write: true, accType: "jwt_role", uname: "jdoe"},
+		cache.DefaultExpiration)
+	// The client address is known but not an ip_role, so requests are not authorized by their address
+	AccCache.Set("192.0.2.1", accessor{name: "192.0.2.1", active: true, accType: "dn_role"}, cache.DefaultExpiration)
+
+	tests := []struct {
+		name   string
+		scopes string
+		api    string
+		role   AccessRole
+	}{
+		{"self access", "storage.read:/", "getUserInfo", RoleSelf},
+		{"group leader access", "ferry.read", "addUserToGroup", RoleWrite},
+		{"jwt_role accessor of the subject", "ferry.read", "setUserInfo", RoleWrite},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := jwt.New()
+			token.Set(jwt.IssuerKey, "https://service.example.com")
+			token.Set(jwt.SubjectKey, userSubject)
+			token.Set("scope", test.scopes)
+			signed, err := jwt.Sign(token, jwa.HS256, []byte("test key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			st, err := scitokens.NewSciToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := &tokenConfig{
+				enforcer: testEnforcer{token: st},
+				scopes:   map[string][]scitokens.Scope{"https://service.example.com": {scitokens.ParseScope("ferry.read")}},
+				issuers:  []string{"https://users.example.com"},
+				cancel:   func() {},
+			}
+			previous := tokenValidation.Swap(config)
+			defer tokenValidation.Store(previous)
+
+			r := httptest.NewRequest("GET", "/"+test.api, nil)
+			r.Header.Set("Authorization", "Bearer "+string(signed))
+
+			level, message, _, _ := authorize(APIContext{R: r, API: test.api, StartTime: time.Now()}, test.role)
+			if level != LevelDenied {
+				t.Errorf("expected the token to be denied, got %s: %s", level, message)
+			}
+		})
+	}
+}
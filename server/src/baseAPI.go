@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 // BaseAPI is a basic type to build APIs
@@ -18,24 +22,40 @@ type BaseAPI struct {
 	InputModel    InputModel
 	QueryFunction func(APIContext, Input) (interface{}, []APIError)
 	AccessRole    AccessRole
+	// Scope lists the input attributes defining the units and resources an API call acts on, checked against the
+	// policies and token scopes of the accessor.  Groups and users are scoped by the units and resources they belong to.
+	Scope []Attribute
 }
 
 // Run the API
-func (b BaseAPI) Run(w http.ResponseWriter, r *http.Request) {
+func (b *BaseAPI) Run(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	var context APIContext
 	context.StartTime = time.Now()
 	context.R = r
+	context.API = apiNames[b]
+	context.RequestID = requestID(r)
+	w.Header().Set(RequestIDHeader, context.RequestID)
+
+	ctx, cancel := requestContext(r, context.API)
+	defer cancel()
+	context.Ctx = ctx
+	context.R = r.WithContext(ctx)
 
 	var output Output
 	defer output.Parse(context, w)
 
-	authLevel, message, subject := authorize(context, b.AccessRole)
+	var errType ErrorType
+	defer func() { observeAPI(context, output.Status, errType) }()
+
+	authLevel, message, subject, acc := authorize(context, b.AccessRole)
 	context.AuthRole = b.AccessRole
 	context.AuthLevel = authLevel
 	context.Subject = subject
+	context.Accessor = acc
 	if authLevel == LevelDenied {
 		w.WriteHeader(http.StatusUnauthorized)
+		errType = ErrorAuthorization
 		output.Err = append(output.Err, fmt.Errorf("client not authorized"))
 		log.WithFields(QueryFields(context)).Info(message)
 		return
@@ -43,30 +63,72 @@ func (b BaseAPI) Run(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(QueryFields(context)).Debug(message)
 
 	var err error
-	context.DBtx, context.Ckey, err = LoadTransaction(r, DBptr)
+	context.DBtx, context.Ckey, err = LoadTransaction(context.R, DBptr)
 	if err != nil {
 		err := errors.New("error starting database transaction")
+		errType = ErrorDbQuery
 		output.Err = append(output.Err, err)
 		log.WithFields(QueryFields(context)).Error(err)
 		return
 	}
 	defer context.DBtx.Rollback(context.Ckey)
 
+	model := b.InputModel[:len(b.InputModel):len(b.InputModel)]
+	if b.AccessRole == RoleWrite {
+		model = append(model, Parameter{DryRun, false})
+	}
+	if authLevel == LevelSelf {
+		model = model.SelfModel()
+	}
+
 	input := make(Input)
-	parseErr := input.Parse(context, b.InputModel)
+	parseErr := input.Parse(context, model)
 	if input[Help].Valid {
-		output.Out = b.InputModel.Help()
+		output.Out = model.Help()
 		output.Status = true
 		return
 	}
 	if parseErr != nil {
+		errType = ErrorInvalidData
 		output.Err = parseErr
+		if errors.Is(parseErr[0], errUnsupportedMediaType) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		}
 		return
 	}
 
+	if err := resolveUserAlias(context, input); err != nil {
+		log.WithFields(QueryFields(context)).Error(err)
+		errType = ErrorDbQuery
+		output.Err = append(output.Err, errors.New("error while resolving username alias"))
+		return
+	}
+
+	if allowed, message := authorizeScope(context, b, input); !allowed {
+		w.WriteHeader(http.StatusUnauthorized)
+		errType = ErrorAuthorization
+		output.Err = append(output.Err, fmt.Errorf("client not authorized"))
+		log.WithFields(QueryFields(context)).Info(message)
+		return
+	}
+
+	if input[DryRun].Valid {
+		context.DryRun = NewDryRunReport()
+	}
+
+	var scope webhookScope
+	if b.AccessRole == RoleWrite && context.DryRun == nil {
+		var err error
+		if scope, err = resolveWebhookScope(context, input); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			errType = ErrorDbQuery
+			output.Err = append(output.Err, errors.New("error while resolving the webhook scope"))
+			return
+		}
+	}
+
 	out, queryErr := b.QueryFunction(context, input)
 	if len(queryErr) > 0 {
-		var errType ErrorType
 		for _, err := range queryErr {
 			log.WithFields(QueryFields(context)).Error(err.Error)
 			output.Err = append(output.Err, err.Error)
@@ -74,6 +136,9 @@ func (b BaseAPI) Run(w http.ResponseWriter, r *http.Request) {
 				errType = err.Type
 			}
 		}
+		if err := ctx.Err(); err != nil {
+			output.Err = append(output.Err, fmt.Errorf("request aborted: %s", err))
+		}
 
 		switch {
 		case errType > HTTP500:
@@ -83,11 +148,58 @@ func (b BaseAPI) Run(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if context.DryRun != nil {
+		if err := context.DryRun.LoadTableChanges(context.DBtx); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			errType = ErrorDbQuery
+			output.Err = append(output.Err, errors.New("error while collecting dry run changes"))
+			return
+		}
+		log.WithFields(QueryFields(context)).Info("dry run, rolling back")
+		output.Status = true
+		output.Out = map[string]interface{}{
+			"dryrun":  context.DryRun,
+			"results": out,
+		}
+		return
+	}
+
+	if b.AccessRole == RoleWrite {
+		if err := recordAudit(context, input); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			errType = ErrorDbQuery
+			output.Err = append(output.Err, errors.New("error while recording the audit log"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := queueWebhookEvents(context, input, scope); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			errType = ErrorDbQuery
+			output.Err = append(output.Err, errors.New("error while queueing webhook events"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := context.DBtx.Commit(context.Ckey); err != nil {
+		log.WithFields(QueryFields(context)).Error(err)
+		errType = ErrorDbQuery
+		output.Err = append(output.Err, errors.New("error while committing the database transaction"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	log.WithFields(QueryFields(context)).Info("success")
 
-	context.DBtx.Commit(context.Ckey)
 	output.Status = true
 	output.Out = out
+	if page, ok := out.(pagedOutput); ok {
+		output.Out = page.Out
+		output.NextCursor = page.NextCursor
+	}
+	if text, ok := out.(nativeOutput); ok {
+		output.Out = nil
+		output.Native = &text
+	}
 }
 
 // InputModel describes all parameters used by an API
@@ -110,13 +222,35 @@ func (i InputModel) Help() map[Attribute]map[string]interface{} {
 	return out
 }
 
+// SelfModel returns a copy of the InputModel where username is optional, as it defaults to the user of a self access
+func (i InputModel) SelfModel() InputModel {
+	model := make(InputModel, len(i))
+	for n, p := range i {
+		if p.Attribute == UserName {
+			p.Required = false
+		}
+		model[n] = p
+	}
+	return model
+}
+
 // Input is a dictionary of parsed parameters for an API
 type Input map[Attribute]NullAttribute
 
 // Parse an http.Request and returns a ParsedInput
 func (i Input) Parse(c APIContext, m InputModel) []error {
+	q, err := requestValues(c.R)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		return []error{err}
+	}
+
+	return i.ParseValues(c, m, q)
+}
+
+// ParseValues parses a set of raw parameter values against an InputModel
+func (i Input) ParseValues(c APIContext, m InputModel, q url.Values) []error {
 	var errs []error
-	q := c.R.URL.Query()
 
 	m.Add(Help, false)
 
@@ -155,6 +289,79 @@ func (i Input) Parse(c APIContext, m InputModel) []error {
 	return errs
 }
 
+// errUnsupportedMediaType is returned by requestValues for a request body that is neither form-encoded nor JSON
+var errUnsupportedMediaType = errors.New("unsupported request body")
+
+// requestValues merges the query string with the parameters sent in the request body.
+// Bodies may be form-encoded or a flat JSON object.  A parameter may only be given once, in the query string or the body.
+func requestValues(r *http.Request) (url.Values, error) {
+	q := r.URL.Query()
+	if r.Body == nil || r.Method == http.MethodGet {
+		return q, nil
+	}
+
+	add := func(k, value string) error {
+		if _, found := q[k]; found {
+			return fmt.Errorf("parameter %s is given more than once", k)
+		}
+		q.Set(k, value)
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		body := make(map[string]interface{})
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			return nil, fmt.Errorf("unable to parse request body: %s", err)
+		}
+		for k, v := range body {
+			value, err := jsonValueString(v)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %s", k, err)
+			}
+			if err := add(k, value); err != nil {
+				return nil, err
+			}
+		}
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("unable to parse request body: %s", err)
+		}
+		for k, values := range r.PostForm {
+			if len(values) > 1 {
+				return nil, fmt.Errorf("parameter %s is given more than once", k)
+			}
+			if err := add(k, values[0]); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if r.ContentLength != 0 {
+			return nil, fmt.Errorf("%w: content type %q is not supported", errUnsupportedMediaType, mediaType)
+		}
+	}
+
+	return q, nil
+}
+
+// jsonValueString converts a decoded JSON value to the string form used by query parameters
+func jsonValueString(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", errors.New("value must be a string, number, boolean or null")
+}
+
 // Add a parsed attribute to Input
 func (i Input) Add(attribute NullAttribute) {
 	i[attribute.Attribute] = attribute
@@ -169,19 +376,28 @@ func (i Input) AddValue(attribute Attribute, value interface{}) {
 
 // Output is the default structure for APIs to return information
 type Output struct {
-	Status bool
-	Err    []error
-	Out    interface{}
+	Status     bool
+	Err        []error
+	Out        interface{}
+	NextCursor string
+	Native     *nativeOutput
 }
 
 type jsonOutput struct {
-	Status string      `json:"ferry_status"`
-	Err    []string    `json:"ferry_error"`
-	Out    interface{} `json:"ferry_output"`
+	Status     string      `json:"ferry_status"`
+	Err        []string    `json:"ferry_error"`
+	Out        interface{} `json:"ferry_output"`
+	NextCursor string      `json:"ferry_next_cursor,omitempty"`
 }
 
 // Parse the Output and writes to an http.ResponseWriter
 func (o *Output) Parse(c APIContext, w http.ResponseWriter) {
+	if o.Status && o.Native != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		fmt.Fprint(w, *o.Native)
+		return
+	}
+
 	var out jsonOutput
 
 	if o.Status {
@@ -196,6 +412,7 @@ func (o *Output) Parse(c APIContext, w http.ResponseWriter) {
 	}
 
 	out.Out = o.Out
+	out.NextCursor = o.NextCursor
 
 	parsedOut, err := json.Marshal(out)
 	if err != nil {
@@ -262,6 +479,27 @@ const (
 	ExpirationDate    Attribute = "expirationdate"
 	LastUpdated       Attribute = "lastupdated"
 	Help              Attribute = "help"
+	DryRun            Attribute = "dryrun"
+	Limit             Attribute = "limit"
+	Cursor            Attribute = "cursor"
+	Sort              Attribute = "sort"
+	Fields            Attribute = "fields"
+	Format            Attribute = "format"
+	API               Attribute = "api"
+	AuditID           Attribute = "auditid"
+	StartDate         Attribute = "startdate"
+	EndDate           Attribute = "enddate"
+	URL               Attribute = "url"
+	EventTypes        Attribute = "eventtypes"
+	WebhookID         Attribute = "webhookid"
+	DeliveryID        Attribute = "deliveryid"
+	AccessorName      Attribute = "accessorname"
+	AccessorType      Attribute = "accessortype"
+	AccessorID        Attribute = "accid"
+	Write             Attribute = "write"
+	Admin             Attribute = "admin"
+	PolicyID          Attribute = "policyid"
+	CacheKey          Attribute = "cachekey"
 	PasswdMode        Attribute = "passwdmode"
 	Standalone        Attribute = "standalone"
 	RemoveGroup       Attribute = "removegroup"
@@ -282,6 +520,13 @@ const (
 	UsedHours         Attribute = "usedhours"
 	Comments          Attribute = "comments"
 	CreateDate        Attribute = "createdate"
+	UpdatedBefore     Attribute = "updatedbefore"
+	ExpiresAfter      Attribute = "expiresafter"
+	ExpiresBefore     Attribute = "expiresbefore"
+	Score             Attribute = "score"
+	SourceUID         Attribute = "sourceuid"
+	TargetUID         Attribute = "targetuid"
+	NewUserName       Attribute = "newusername"
 )
 
 // Type returns the type of the Attribute
@@ -341,6 +586,27 @@ func (a Attribute) Type() AttributeType {
 		ExpirationDate:    TypeDate,
 		LastUpdated:       TypeDate,
 		Help:              TypeFlag,
+		DryRun:            TypeFlag,
+		Limit:             TypeInt,
+		Cursor:            TypeSstring,
+		Sort:              TypeString,
+		Fields:            TypeString,
+		Format:            TypeString,
+		API:               TypeSstring,
+		AuditID:           TypeInt,
+		StartDate:         TypeDate,
+		EndDate:           TypeDate,
+		URL:               TypeSstring,
+		EventTypes:        TypeString,
+		WebhookID:         TypeInt,
+		DeliveryID:        TypeInt,
+		AccessorName:      TypeSstring,
+		AccessorType:      TypeString,
+		AccessorID:        TypeInt,
+		Write:             TypeBool,
+		Admin:             TypeBool,
+		PolicyID:          TypeInt,
+		CacheKey:          TypeSstring,
 		PasswdMode:        TypeFlag,
 		Standalone:        TypeFlag,
 		RemoveGroup:       TypeFlag,
@@ -354,6 +620,13 @@ func (a Attribute) Type() AttributeType {
 		UsedHours:         TypeFloat,
 		Comments:          TypeSstring,
 		CreateDate:        TypeDate,
+		UpdatedBefore:     TypeDate,
+		ExpiresAfter:      TypeDate,
+		ExpiresBefore:     TypeDate,
+		Score:             TypeInt,
+		SourceUID:         TypeInt,
+		TargetUID:         TypeInt,
+		NewUserName:       TypeString,
 	}
 
 	return AttributeType[a]
@@ -533,6 +806,7 @@ const (
 	ErrorDuplicateData
 	ErrorAPIRequirement
 	ErrorText
+	ErrorAuthorization
 	HTTP500
 	ErrorDbQuery
 )
@@ -549,6 +823,22 @@ func (t ErrorType) DefaultMessage() string {
 	return messageMap[t]
 }
 
+// String returns the ErrorType string representation
+func (t ErrorType) String() string {
+	messageMap := map[ErrorType]string{
+		HTTP200:             "none",
+		ErrorDataNotFound:   "data_not_found",
+		ErrorInvalidData:    "invalid_data",
+		ErrorDuplicateData:  "duplicate_data",
+		ErrorAPIRequirement: "api_requirement",
+		ErrorText:           "text",
+		ErrorAuthorization:  "authorization",
+		HTTP500:             "internal",
+		ErrorDbQuery:        "db_query",
+	}
+	return messageMap[t]
+}
+
 // DefaultAPIError makes an APIError using the default message for the ErrorType
 // and takes interfaces to complete it when necessary
 func DefaultAPIError(t ErrorType, a interface{}) APIError {
@@ -567,14 +857,37 @@ type APIContext struct {
 	DBtx      *Transaction
 	Ckey      int64
 	Subject   string
+	DryRun    *DryRunReport
+	API       string
+	RequestID string
+	Ctx       context.Context
+	Accessor  accessor
+	LDAPQueue *ldapQueue
+}
+
+// requestContext derives the context of an API call from its request, with the deadline configured for the API
+func requestContext(r *http.Request, api string) (context.Context, context.CancelFunc) {
+	timeouts := viper.GetStringMapString("timeouts")
+	timeout, found := timeouts[strings.ToLower(api)]
+	if !found {
+		timeout = timeouts["default"]
+	}
+	if deadline, err := time.ParseDuration(timeout); err == nil && deadline > 0 {
+		return context.WithTimeout(r.Context(), deadline)
+	}
+	return context.WithCancel(r.Context())
 }
 
 // APICollection aggregates a collection of APIs to be called from a function
 type APICollection map[string]*BaseAPI
 
+// apiNames maps every BaseAPI added to a collection to its name
+var apiNames = make(map[*BaseAPI]string)
+
 // Add a BaseAPI to the collection
 func (c APICollection) Add(name string, api *BaseAPI) {
 	c[name] = api
+	apiNames[api] = name
 }
 
 // NewMapNullAttribute builds a map of Attribute to NullAttribute
@@ -599,6 +912,7 @@ type AccessRole string
 // List of valid access roles
 const (
 	RolePublic AccessRole = "public"
+	RoleSelf   AccessRole = "self"
 	RoleRead   AccessRole = "read"
 	RoleWrite  AccessRole = "write"
 )
@@ -621,6 +935,10 @@ const (
 	LevelJWTRole
 	LevelDNWhitelist
 	LevelIPWhitelist
+	LevelGroupLeader
+	LevelSelf
+	LevelJWTScope
+	LevelInternal
 )
 
 // String returns the AccessRole string representation
@@ -631,8 +949,13 @@ func (a AccessLevel) String() string {
 		LevelPublic:      "public",
 		LevelDNRole:      "dn_role",
 		LevelIPRole:      "ip_role",
+		LevelJWTRole:     "jwt_role",
 		LevelDNWhitelist: "dn_whitelist",
 		LevelIPWhitelist: "ip_whitelist",
+		LevelGroupLeader: "group_leader",
+		LevelSelf:        "self",
+		LevelJWTScope:    "jwt_scope",
+		LevelInternal:    "internal",
 	}
 	return messageMap[a]
 }
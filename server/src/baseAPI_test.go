@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInputParse(t *testing.T) {
+	model := InputModel{
+		Parameter{UserName, true},
+		Parameter{UID, false},
+		Parameter{FullName, false},
+	}
+
+	const JSON = "application/json"
+	const Form = "application/x-www-form-urlencoded"
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		contentType string
+		body        string
+		err         string
+		unsupported bool
+		values      map[Attribute]interface{}
+		null        []Attribute
+	}{
+		{"query string", http.MethodGet, "username=jdoe&uid=10", "", "", "", false,
+			map[Attribute]interface{}{UserName: "jdoe", UID: int64(10)}, nil},
+		{"JSON body", http.MethodPost, "", JSON, `{"username": "jdoe", "uid": 10, "fullname": "Jane Doe"}`, "", false,
+			map[Attribute]interface{}{UserName: "jdoe", UID: int64(10), FullName: "Jane Doe"}, nil},
+		{"JSON body with query string", http.MethodPost, "username=jdoe", JSON, `{"uid": 10}`, "", false,
+			map[Attribute]interface{}{UserName: "jdoe", UID: int64(10)}, nil},
+		{"JSON null", http.MethodPut, "", JSON, `{"username": "jdoe", "fullname": null}`, "", false,
+			map[Attribute]interface{}{UserName: "jdoe"}, []Attribute{FullName}},
+		{"JSON wrong type", http.MethodPost, "", JSON, `{"username": "jdoe", "uid": "ten"}`,
+			fmt.Sprintf("parameter uid requires a %s value", TypeInt), false, nil, nil},
+		{"JSON unknown parameter", http.MethodPost, "", JSON, `{"username": "jdoe", "shell": "/bin/bash"}`,
+			"shell is not a valid parameter for this api", false, nil, nil},
+		{"JSON nested value", http.MethodPost, "", JSON, `{"username": {"name": "jdoe"}}`,
+			"parameter username: value must be a string, number, boolean or null", false, nil, nil},
+		{"JSON missing required", http.MethodPost, "", JSON, `{"uid": 10}`,
+			"required parameter username not provided", false, nil, nil},
+		{"form body", http.MethodPost, "", Form, "username=jdoe&fullname=Jane+Doe", "", false,
+			map[Attribute]interface{}{UserName: "jdoe", FullName: "Jane Doe"}, nil},
+		{"form NULL", http.MethodPut, "", Form, "username=jdoe&fullname=NULL", "", false,
+			map[Attribute]interface{}{UserName: "jdoe"}, []Attribute{FullName}},
+		{"form wrong type", http.MethodPost, "", Form, "username=jdoe&uid=ten",
+			fmt.Sprintf("parameter uid requires a %s value", TypeInt), false, nil, nil},
+		{"duplicate in query and JSON", http.MethodPost, "username=jdoe", JSON, `{"username": "jroe"}`,
+			"parameter username is given more than once", false, nil, nil},
+		{"duplicate in query and form", http.MethodPost, "username=jdoe", Form, "username=jroe",
+			"parameter username is given more than once", false, nil, nil},
+		{"duplicate in form", http.MethodPost, "", Form, "username=jdoe&username=jroe",
+			"parameter username is given more than once", false, nil, nil},
+		{"unsupported body", http.MethodPost, "username=jdoe", "text/plain", "uid=10", "", true, nil, nil},
+		{"no body", http.MethodPut, "username=jdoe", "", "", "", false,
+			map[Attribute]interface{}{UserName: "jdoe"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body io.Reader
+			if test.body != "" {
+				body = strings.NewReader(test.body)
+			}
+			r := httptest.NewRequest(test.method, "/testAPI?"+test.query, body)
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+
+			i := make(Input)
+			errs := i.Parse(APIContext{R: r, StartTime: time.Now()}, model)
+
+			if test.unsupported {
+				if len(errs) != 1 || !errors.Is(errs[0], errUnsupportedMediaType) {
+					t.Fatalf("expected an unsupported media type error, got %v", errs)
+				}
+				return
+			}
+			if test.err != "" {
+				if len(errs) != 1 || errs[0].Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, errs)
+				}
+				return
+			}
+			if errs != nil {
+				t.Fatalf("unexpected errors %v", errs)
+			}
+
+			for attribute, value := range test.values {
+				if !i[attribute].Valid || i[attribute].Data != value {
+					t.Errorf("expected %s to be %v, got %+v", attribute, value, i[attribute])
+				}
+			}
+			for _, attribute := range test.null {
+				if !i[attribute].AbsoluteNull {
+					t.Errorf("expected %s to be NULL, got %+v", attribute, i[attribute])
+				}
+			}
+		})
+	}
+}
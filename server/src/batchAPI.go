@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// batchStep is a single API call requested in a batch
+type batchStep struct {
+	API        string                 `json:"api"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// batchStepResult reports the outcome of a single batch step
+type batchStepResult struct {
+	Step   int         `json:"step"`
+	API    string      `json:"api"`
+	Status string      `json:"status"`
+	Err    []string    `json:"error"`
+	Out    interface{} `json:"output"`
+}
+
+// RunBatch godoc
+// @Summary      Runs a list of API calls in a single database transaction.
+// @Description  Runs an ordered list of API calls in a single database transaction. The request body must be a JSON array of
+// @Description  objects with the keys "api" (name of the API) and "parameters" (object with the API parameters).  Steps run in
+// @Description  order and the batch stops at the first failure, in which case nothing is committed and the remaining steps are
+// @Description  reported as skipped.  LDAP changes made by the steps are queued and only sent once the database transaction
+// @Description  is committed, so steps do not see the LDAP changes of earlier steps.  If sending the queued LDAP changes fails,
+// @Description  the database changes stay committed and the batch reports the failure; run syncLdapWithFerry to repair LDAP.
+// @Description  The body is limited to batch.max_bytes and the list to batch.max_steps steps.  With dryrun, every step is run
+// @Description  and rolled back, and the changes of the whole batch are reported.  Steps cannot set dryrun themselves.
+// @Description  A step the client is not authorized to run fails the whole batch with 401.
+// @Description  Requires write access.
+// @Tags         Miscellaneous
+// @Accept       json
+// @Produce      json
+// @Param        dryrun         query     string  false  "run the steps and report their changes without committing them"  Format(flag)
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Failure      405  {object}  jsonOutput
+// @Failure      413  {object}  jsonOutput
+// @Router /batch [post]
+func (c APICollection) RunBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	var context APIContext
+	context.StartTime = time.Now()
+	context.R = r
+	context.API = "batch"
+	context.RequestID = requestID(r)
+	w.Header().Set(RequestIDHeader, context.RequestID)
+
+	ctx, cancel := requestContext(r, context.API)
+	defer cancel()
+	context.Ctx = ctx
+	context.R = r.WithContext(ctx)
+
+	var output Output
+	defer output.Parse(context, w)
+
+	var errType ErrorType
+	defer func() { observeAPI(context, output.Status, errType) }()
+
+	authLevel, message, subject, acc := authorize(context, RoleWrite)
+	context.AuthRole = RoleWrite
+	context.AuthLevel = authLevel
+	context.Subject = subject
+	context.Accessor = acc
+	if authLevel == LevelDenied {
+		w.WriteHeader(http.StatusUnauthorized)
+		errType = ErrorAuthorization
+		output.Err = append(output.Err, fmt.Errorf("client not authorized"))
+		log.WithFields(QueryFields(context)).Info(message)
+		return
+	}
+	log.WithFields(QueryFields(context)).Debug(message)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		errType = ErrorInvalidData
+		output.Err = append(output.Err, errors.New("batch requires a POST request"))
+		return
+	}
+
+	input := make(Input)
+	if parseErr := input.ParseValues(context, InputModel{Parameter{DryRun, false}}, r.URL.Query()); parseErr != nil {
+		errType = ErrorInvalidData
+		output.Err = parseErr
+		return
+	}
+	if input[DryRun].Valid {
+		context.DryRun = NewDryRunReport()
+	}
+
+	maxBytes, maxSteps := batchLimits()
+	var steps []batchStep
+	if r.Body == nil {
+		errType = ErrorInvalidData
+		output.Err = append(output.Err, errors.New("request body must contain a list of steps"))
+		return
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes)).Decode(&steps); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			err = fmt.Errorf("the body is larger than %d bytes", maxBytes)
+		}
+		errType = ErrorInvalidData
+		output.Err = append(output.Err, fmt.Errorf("unable to parse request body: %s", err))
+		log.WithFields(QueryFields(context)).Error(output.Err[0])
+		return
+	}
+	if len(steps) == 0 {
+		errType = ErrorInvalidData
+		output.Err = append(output.Err, errors.New("request body must contain a list of steps"))
+		return
+	}
+	if len(steps) > maxSteps {
+		errType = ErrorInvalidData
+		output.Err = append(output.Err, fmt.Errorf("a batch is limited to %d steps", maxSteps))
+		return
+	}
+
+	var err error
+	context.DBtx, context.Ckey, err = LoadTransaction(context.R, DBptr)
+	if err != nil {
+		err := errors.New("error starting database transaction")
+		errType = ErrorDbQuery
+		output.Err = append(output.Err, err)
+		log.WithFields(QueryFields(context)).Error(err)
+		return
+	}
+	defer context.DBtx.Rollback(context.Ckey)
+	if context.DryRun == nil {
+		context.LDAPQueue = new(ldapQueue)
+	}
+
+	results := make([]batchStepResult, len(steps))
+	failed := false
+
+	for n, step := range steps {
+		results[n] = batchStepResult{Step: n + 1, API: step.API, Err: make([]string, 0)}
+		if failed {
+			results[n].Status = "skipped"
+			continue
+		}
+
+		stepErr, stepType := c.runBatchStep(context, step, &results[n])
+		if len(stepErr) > 0 {
+			failed = true
+			results[n].Status = "failure"
+			for _, err := range stepErr {
+				results[n].Err = append(results[n].Err, err.Error())
+			}
+			output.Err = append(output.Err, fmt.Errorf("step %d (%s) failed", n+1, step.API))
+			if stepType > errType {
+				errType = stepType
+			}
+			continue
+		}
+		results[n].Status = "success"
+	}
+
+	output.Out = results
+	if failed {
+		switch {
+		case errType > HTTP500:
+			w.WriteHeader(http.StatusInternalServerError)
+		case errType == ErrorAuthorization:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		log.WithFields(QueryFields(context)).Info("batch failed, rolling back")
+		return
+	}
+
+	if context.DryRun != nil {
+		if err := context.DryRun.LoadTableChanges(context.DBtx); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			errType = ErrorDbQuery
+			output.Err = append(output.Err, errors.New("error while collecting dry run changes"))
+			return
+		}
+		log.WithFields(QueryFields(context)).Info("dry run, rolling back")
+		output.Status = true
+		output.Out = map[string]interface{}{
+			"dryrun":  context.DryRun,
+			"results": results,
+		}
+		return
+	}
+
+	if err := context.DBtx.Commit(context.Ckey); err != nil {
+		log.WithFields(QueryFields(context)).Error(err)
+		errType = ErrorDbQuery
+		output.Err = append(output.Err, errors.New("error while committing the database transaction"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := context.LDAPQueue.send(context); err != nil {
+		log.WithFields(QueryFields(context)).Error(err)
+		errType = ErrorText
+		output.Err = append(output.Err, fmt.Errorf("the batch was committed but %s, run syncLdapWithFerry", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(QueryFields(context)).Info("success")
+
+	output.Status = true
+}
+
+// batchLimits returns the largest body and number of steps accepted in a batch
+func batchLimits() (int64, int) {
+	maxBytes := viper.GetInt64("batch.max_bytes")
+	if maxBytes <= 0 {
+		maxBytes = 1 << 20
+	}
+	maxSteps := viper.GetInt("batch.max_steps")
+	if maxSteps <= 0 {
+		maxSteps = 100
+	}
+	return maxBytes, maxSteps
+}
+
+// unbatchedAPIs are the APIs that cannot run as batch steps, as their effects are not rolled back with the batch
+var unbatchedAPIs = map[string]bool{
+	"reloadServer": true,
+}
+
+// runBatchStep parses and runs a single batch step sharing the batch Transaction
+func (c APICollection) runBatchStep(batch APIContext, step batchStep, result *batchStepResult) ([]error, ErrorType) {
+	api, found := c[step.API]
+	if !found {
+		return []error{fmt.Errorf("%s is not a valid api", step.API)}, ErrorInvalidData
+	}
+	if unbatchedAPIs[step.API] {
+		return []error{fmt.Errorf("%s cannot run in a batch", step.API)}, ErrorAPIRequirement
+	}
+
+	values := make(url.Values)
+	for k, v := range step.Parameters {
+		value, err := jsonValueString(v)
+		if err != nil {
+			return []error{fmt.Errorf("parameter %s: %s", k, err)}, ErrorInvalidData
+		}
+		values.Set(k, value)
+	}
+
+	stepURL := *batch.R.URL
+	stepURL.Path = "/" + step.API
+	stepURL.RawQuery = values.Encode()
+
+	context := batch
+	context.R = WithTransaction(batch.R, batch.DBtx)
+	context.R.URL = &stepURL
+	context.Ckey = 0
+	context.AuthRole = api.AccessRole
+	context.API = step.API
+
+	input := make(Input)
+	if parseErr := input.ParseValues(context, api.InputModel, values); parseErr != nil {
+		return parseErr, ErrorInvalidData
+	}
+	if input[Help].Valid {
+		return []error{errors.New("help is not supported in a batch")}, ErrorInvalidData
+	}
+	if err := resolveUserAlias(context, input); err != nil {
+		log.WithFields(QueryFields(context)).Error(err)
+		return []error{errors.New("error while resolving username alias")}, ErrorDbQuery
+	}
+	if allowed, message := authorizeScope(context, api, input); !allowed {
+		log.WithFields(QueryFields(context)).Info(message)
+		return []error{errors.New("client not authorized")}, ErrorAuthorization
+	}
+
+	var scope webhookScope
+	if api.AccessRole == RoleWrite && context.DryRun == nil {
+		var err error
+		if scope, err = resolveWebhookScope(context, input); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			return []error{errors.New("error while resolving the webhook scope")}, ErrorDbQuery
+		}
+	}
+
+	out, queryErr := api.QueryFunction(context, input)
+	if len(queryErr) > 0 {
+		var errs []error
+		var errType ErrorType
+		for _, err := range queryErr {
+			log.WithFields(QueryFields(context)).Error(err.Error)
+			errs = append(errs, err.Error)
+			if err.Type > errType {
+				errType = err.Type
+			}
+		}
+		return errs, errType
+	}
+
+	if api.AccessRole == RoleWrite && context.DryRun == nil {
+		if err := recordAudit(context, input); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			return []error{errors.New("error while recording the audit log")}, ErrorDbQuery
+		}
+		if err := queueWebhookEvents(context, input, scope); err != nil {
+			log.WithFields(QueryFields(context)).Error(err)
+			return []error{errors.New("error while queueing webhook events")}, ErrorDbQuery
+		}
+	}
+
+	log.WithFields(QueryFields(context)).Info("success")
+	result.Out = out
+	if page, ok := out.(pagedOutput); ok {
+		result.Out = page.Out
+	}
+
+	return nil, HTTP200
+}
+
+// ldapQueue holds the LDAP writes of a batch until the batch is committed
+type ldapQueue struct {
+	requests []interface{}
+}
+
+// queueLdapAfterCommit returns the context of an API call with its LDAP writes queued until its transaction is
+// committed.  In a batch, the writes join the queue of the batch.  Otherwise they are sent once the API transaction
+// commits, and failures are reported as LDAP errors for syncLdapWithFerry to fix.  Dry runs are not queued.
+func queueLdapAfterCommit(c APIContext) APIContext {
+	if c.LDAPQueue != nil || c.DryRun != nil {
+		return c
+	}
+	c.LDAPQueue = new(ldapQueue)
+	queued := c
+	c.DBtx.AfterCommit(func() {
+		if err := queued.LDAPQueue.send(queued); err != nil {
+			ldapError(queued.RequestID, queued.API, "send", fmt.Errorf("committed but %s, run syncLdapWithFerry", err))
+		}
+	})
+	return c
+}
+
+// send opens a new LDAP connection and sends the queued writes in order, stopping at the first failure
+func (q *ldapQueue) send(c APIContext) error {
+	if len(q.requests) == 0 {
+		return nil
+	}
+
+	c.LDAPQueue = nil
+	con, err := LDAPgetConnection(c, false)
+	if err != nil {
+		return fmt.Errorf("the LDAP connection failed: %s", err)
+	}
+	defer con.Close()
+
+	for n, r := range q.requests {
+		switch r := r.(type) {
+		case *ldap.AddRequest:
+			err = con.Add(r)
+		case *ldap.DelRequest:
+			err = con.Del(r)
+		case *ldap.ModifyRequest:
+			err = con.Modify(r)
+		case *ldap.ModifyDNRequest:
+			err = con.ModifyDN(r)
+		}
+		if err != nil {
+			return fmt.Errorf("LDAP change %d of %d failed: %s", n+1, len(q.requests), err)
+		}
+	}
+
+	return nil
+}
+
+// ldapQueuedConn is an LDAP connection of a batch step that queues writes instead of sending them
+type ldapQueuedConn struct {
+	ldap.Client
+	queue *ldapQueue
+}
+
+// RequestID returns the ID of the request the connection was opened for
+func (l *ldapQueuedConn) RequestID() string {
+	return ldapRequestID(l.Client)
+}
+
+// Add queues an LDAP add request
+func (l *ldapQueuedConn) Add(r *ldap.AddRequest) error {
+	l.queue.requests = append(l.queue.requests, r)
+	return nil
+}
+
+// Del queues an LDAP delete request
+func (l *ldapQueuedConn) Del(r *ldap.DelRequest) error {
+	l.queue.requests = append(l.queue.requests, r)
+	return nil
+}
+
+// Modify queues an LDAP modify request
+func (l *ldapQueuedConn) Modify(r *ldap.ModifyRequest) error {
+	l.queue.requests = append(l.queue.requests, r)
+	return nil
+}
+
+// ModifyDN queues an LDAP modify DN request
+func (l *ldapQueuedConn) ModifyDN(r *ldap.ModifyDNRequest) error {
+	l.queue.requests = append(l.queue.requests, r)
+	return nil
+}
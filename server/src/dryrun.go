@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DryRunReport collects the changes an API would have made if it was not a dry run
+type DryRunReport struct {
+	Tables map[string]DryRunTableChanges `json:"tables"`
+	LDAP   []DryRunLDAPChange            `json:"ldap"`
+}
+
+// DryRunTableChanges counts the rows affected in a single table
+type DryRunTableChanges struct {
+	Inserted int64 `json:"inserted"`
+	Updated  int64 `json:"updated"`
+	Deleted  int64 `json:"deleted"`
+}
+
+// DryRunLDAPChange describes a skipped LDAP write
+type DryRunLDAPChange struct {
+	Operation string                      `json:"operation"`
+	DN        string                      `json:"dn"`
+	Changes   []DryRunLDAPAttributeChange `json:"changes,omitempty"`
+}
+
+// DryRunLDAPAttributeChange describes a single attribute change of a skipped LDAP write
+type DryRunLDAPAttributeChange struct {
+	Operation string   `json:"operation"`
+	Attribute string   `json:"attribute"`
+	Values    []string `json:"values"`
+}
+
+// NewDryRunReport builds an empty DryRunReport
+func NewDryRunReport() *DryRunReport {
+	return &DryRunReport{
+		Tables: make(map[string]DryRunTableChanges),
+		LDAP:   make([]DryRunLDAPChange, 0),
+	}
+}
+
+// addLDAP records a skipped LDAP write
+func (d *DryRunReport) addLDAP(change DryRunLDAPChange) {
+	d.LDAP = append(d.LDAP, change)
+}
+
+// LoadTableChanges reads the rows modified so far by the Transaction from the statistics collector
+func (d *DryRunReport) LoadTableChanges(tx *Transaction) error {
+	rows, err := tx.Query(`select relname, n_tup_ins, n_tup_upd, n_tup_del from pg_stat_xact_user_tables
+						   where n_tup_ins + n_tup_upd + n_tup_del > 0 order by relname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		var changes DryRunTableChanges
+		if err := rows.Scan(&table, &changes.Inserted, &changes.Updated, &changes.Deleted); err != nil {
+			return err
+		}
+		d.Tables[table] = changes
+	}
+
+	return rows.Err()
+}
+
+// ldapDryRunConn is a readonly LDAP connection that records writes instead of sending them
+type ldapDryRunConn struct {
+	ldap.Client
+	report *DryRunReport
+}
+
+// RequestID returns the ID of the request the connection was opened for
+func (l *ldapDryRunConn) RequestID() string {
+	return ldapRequestID(l.Client)
+}
+
+// Add records an LDAP add request
+func (l *ldapDryRunConn) Add(r *ldap.AddRequest) error {
+	change := DryRunLDAPChange{Operation: "add", DN: r.DN}
+	for _, a := range r.Attributes {
+		change.Changes = append(change.Changes, DryRunLDAPAttributeChange{"add", a.Type, a.Vals})
+	}
+	l.report.addLDAP(change)
+	return nil
+}
+
+// Del records an LDAP delete request
+func (l *ldapDryRunConn) Del(r *ldap.DelRequest) error {
+	l.report.addLDAP(DryRunLDAPChange{Operation: "delete", DN: r.DN})
+	return nil
+}
+
+// Modify records an LDAP modify request
+func (l *ldapDryRunConn) Modify(r *ldap.ModifyRequest) error {
+	operations := map[uint]string{
+		ldap.AddAttribute:     "add",
+		ldap.DeleteAttribute:  "delete",
+		ldap.ReplaceAttribute: "replace",
+	}
+
+	change := DryRunLDAPChange{Operation: "modify", DN: r.DN}
+	for _, c := range r.Changes {
+		change.Changes = append(change.Changes,
+			DryRunLDAPAttributeChange{operations[c.Operation], c.Modification.Type, c.Modification.Vals})
+	}
+	l.report.addLDAP(change)
+	return nil
+}
+
+// ModifyDN records an LDAP modify DN request
+func (l *ldapDryRunConn) ModifyDN(r *ldap.ModifyDNRequest) error {
+	change := DryRunLDAPChange{Operation: "modifydn", DN: r.DN}
+	change.Changes = append(change.Changes, DryRunLDAPAttributeChange{"replace", "rdn", []string{r.NewRDN}})
+	l.report.addLDAP(change)
+	return nil
+}
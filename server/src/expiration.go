@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// expirationLock is the advisory lock held while expiring users, so only one server runs the scheduler at a time
+const expirationLock = 4215790
+
+// ExpirationInitialize starts the scheduler expiring users past their expiration date and warning them ahead of it,
+// as set in the expiration section of the configuration.  The scheduler is disabled when no interval is set.
+func ExpirationInitialize() {
+	interval, err := time.ParseDuration(viper.GetString("expiration.interval"))
+	if err != nil || interval <= 0 {
+		log.Warning("expiration.interval not set, users will not be expired")
+		return
+	}
+
+	go func() {
+		for {
+			runExpiration()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// internalContext returns the context of an action run by the server itself, outside of any API call.  The deadline
+// is set by the timeouts section of the configuration, as for an API of the same name.
+func internalContext(api string) (APIContext, context.CancelFunc, error) {
+	var c APIContext
+	r, err := http.NewRequest(http.MethodPut, "/"+api, nil)
+	if err != nil {
+		return c, nil, err
+	}
+	ctx, cancel := requestContext(r, api)
+	c.StartTime = time.Now()
+	c.R = r.WithContext(ctx)
+	c.Ctx = ctx
+	c.API = api
+	c.AuthRole = RoleWrite
+	c.AuthLevel = LevelInternal
+	c.Subject = "expiration scheduler"
+	c.RequestID = requestID(r)
+	return c, cancel, nil
+}
+
+// runExpiration sends the warnings due and expires the users past their expiration date
+func runExpiration() {
+	fields := log.Fields{"action": "expiration"}
+
+	c, cancel, err := internalContext("runExpiration")
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+	defer cancel()
+	ctx := c.Ctx
+
+	// Hold a session lock for the whole run, so the servers sharing the database take turns
+	conn, err := DBptr.Conn(ctx)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, expirationLock).Scan(&locked); err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+	if !locked {
+		log.WithFields(fields).Debug("expiration running on another server")
+		return
+	}
+	defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, expirationLock)
+
+	sendExpirationWarnings(ctx)
+	expireUsers(ctx)
+}
+
+// expirationLeadDays returns the lead times of the warnings, in days, from the longest to the shortest
+func expirationLeadDays() []int {
+	var leads []int
+	for _, lead := range viper.GetIntSlice("expiration.warnings") {
+		if lead > 0 {
+			leads = append(leads, lead)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(leads)))
+	return leads
+}
+
+// sendExpirationWarnings warns the active users expiring within the longest lead time, and the leaders of their
+// groups.  Each lead time is warned once per expiration date, a single message covering every lead time that is due.
+func sendExpirationWarnings(ctx context.Context) {
+	fields := log.Fields{"action": "expiration"}
+
+	leads := expirationLeadDays()
+	if len(leads) == 0 {
+		return
+	}
+
+	rows, err := DBptr.QueryContext(ctx, `select uid, uname, expiration_date, expiration_date - current_date
+							  from users
+							  where status is true and expiration_date >= current_date
+								and expiration_date <= current_date + $1::integer
+							  order by expiration_date, uname`, leads[0])
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+
+	type expiringUser struct {
+		uid        int
+		uname      string
+		expiration time.Time
+		daysLeft   int
+	}
+	var users []expiringUser
+	for rows.Next() {
+		var u expiringUser
+		if err := rows.Scan(&u.uid, &u.uname, &u.expiration, &u.daysLeft); err != nil {
+			log.WithFields(fields).Error(err)
+			rows.Close()
+			return
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	for _, u := range users {
+		var due []int
+		for _, lead := range leads {
+			if u.daysLeft > lead {
+				continue
+			}
+			var sent bool
+			err := DBptr.QueryRowContext(ctx, `select exists (select 1 from user_expiration_warnings
+												  where uid = $1 and expiration_date = $2 and lead_days = $3)`,
+				u.uid, u.expiration, lead).Scan(&sent)
+			if err != nil {
+				log.WithFields(fields).Error(err)
+				return
+			}
+			if !sent {
+				due = append(due, lead)
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+
+		recipients, err := expirationRecipients(ctx, u.uid, u.uname)
+		if err != nil {
+			log.WithFields(fields).Error(err)
+			continue
+		}
+		subject := fmt.Sprintf("FERRY account %s expires on %s", u.uname, u.expiration.Format("2006-01-02"))
+		body := fmt.Sprintf("The FERRY account %s expires on %s, in %d days.  After that date the account will be "+
+			"deactivated and removed from LDAP.  Contact the leader of your group to have the expiration date extended.\n",
+			u.uname, u.expiration.Format("2006-01-02"), u.daysLeft)
+		if err := sendEmail(recipients, subject, body); err != nil {
+			log.WithFields(fields).Errorf("unable to warn %s of expiration: %s", u.uname, err)
+			continue
+		}
+
+		for _, lead := range due {
+			_, err := DBptr.ExecContext(ctx, `insert into user_expiration_warnings (uid, expiration_date, lead_days, recipients)
+								  values ($1, $2, $3, $4) on conflict do nothing`,
+				u.uid, u.expiration, lead, strings.Join(recipients, ","))
+			if err != nil {
+				log.WithFields(fields).Error(err)
+			}
+		}
+		log.WithFields(fields).Infof("warned %s of expiration on %s: %s", u.uname, u.expiration.Format("2006-01-02"), strings.Join(recipients, ","))
+	}
+}
+
+// expirationRecipients returns the email addresses of a user and of the active leaders of the user's groups.  FERRY does
+// not store email addresses, they are username@email_domain, as in the mail attribute of LDAP.
+func expirationRecipients(ctx context.Context, uid int, uname string) ([]string, error) {
+	domain := emailDomain()
+	recipients := []string{fmt.Sprintf("%s@%s", uname, domain)}
+
+	rows, err := DBptr.QueryContext(ctx, `select distinct l.uname
+							  from user_group as ug
+							  join user_group as lg on lg.groupid = ug.groupid and lg.is_leader
+							  join users as l on l.uid = lg.uid
+							  where ug.uid = $1 and l.uid != $1 and l.status is true
+							  order by l.uname`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var leader string
+		if err := rows.Scan(&leader); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, fmt.Sprintf("%s@%s", leader, domain))
+	}
+	return recipients, rows.Err()
+}
+
+// sendEmail sends a plain text message through the SMTP server set in expiration.smtp
+func sendEmail(to []string, subject string, body string) error {
+	server := viper.GetString("expiration.smtp")
+	if server == "" {
+		return errors.New("expiration.smtp is not set")
+	}
+	from := viper.GetString("expiration.from")
+	if from == "" {
+		return errors.New("expiration.from is not set")
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		from, strings.Join(to, ", "), subject, body)
+	return smtp.SendMail(server, nil, from, to, []byte(message))
+}
+
+// expireUsers deactivates the active users past their expiration date and removes them from LDAP.  Each user is
+// expired in its own transaction and recorded in the audit log as expireUser.
+func expireUsers(ctx context.Context) {
+	fields := log.Fields{"action": "expiration"}
+
+	rows, err := DBptr.QueryContext(ctx, `select uname from users
+							  where status is true and expiration_date < current_date
+							  order by uname`)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+	var unames []string
+	for rows.Next() {
+		var uname string
+		if err := rows.Scan(&uname); err != nil {
+			log.WithFields(fields).Error(err)
+			rows.Close()
+			return
+		}
+		unames = append(unames, uname)
+	}
+	rows.Close()
+
+	for _, uname := range unames {
+		if err := expireUser(uname); err != nil {
+			log.WithFields(fields).Errorf("unable to expire %s: %s", uname, err)
+			continue
+		}
+		log.WithFields(fields).Infof("expired %s", uname)
+	}
+}
+
+// expireUser deactivates a user and removes the user from LDAP, through the same path as removeUserFromLdap.  LDAP is
+// only modified once the deactivation is committed.
+func expireUser(uname string) error {
+	c, cancel, err := internalContext("expireUser")
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	var tx Transaction
+	key, err := tx.Start(c.Ctx, DBptr)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(key)
+	c.DBtx = &tx
+	c.R = WithTransaction(c.R, &tx)
+	c.Ckey = key
+	c.LDAPQueue = new(ldapQueue)
+
+	i := make(Input)
+	i[UserName] = NewNullAttribute(UserName).Default(uname)
+
+	_, err = c.DBtx.Exec(`update users set status = false, last_updated = NOW() where uname = $1 and status is true`, uname)
+	if err != nil {
+		return err
+	}
+
+	if _, apiErr := removeUserFromLdap(c, i); len(apiErr) > 0 {
+		return apiErr[0].Error
+	}
+
+	if err := recordAudit(c, i); err != nil {
+		return err
+	}
+	if err := queueWebhookEvents(c, i, webhookScope{}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(key); err != nil {
+		return err
+	}
+	if err := c.LDAPQueue.send(c); err != nil {
+		return fmt.Errorf("deactivated but %s, run syncLdapWithFerry", err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// nativeOutput is returned by APIs rendering a native file format instead of JSON
+type nativeOutput string
+
+// List of valid output formats
+const (
+	FormatJSON   = "json"
+	FormatNative = "native"
+)
+
+// NativeAPI builds a BaseAPI that can render its output in a native file format.
+// The native format is selected with format=native or an Accept header asking for text/plain.
+func NativeAPI(m InputModel, f func(APIContext, Input) (interface{}, []APIError), role AccessRole, scope []Attribute,
+	render func(Input, interface{}) (string, error)) BaseAPI {
+	model := append(m[:len(m):len(m)], Parameter{Format, false})
+
+	native := func(c APIContext, i Input) (interface{}, []APIError) {
+		var apiErr []APIError
+
+		format := FormatJSON
+		if i[Format].Valid {
+			format = i[Format].Data.(string)
+		} else if strings.Contains(c.R.Header.Get("Accept"), "text/plain") {
+			format = FormatNative
+		}
+		if format != FormatJSON && format != FormatNative {
+			apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, Format))
+			return nil, apiErr
+		}
+
+		out, apiErr := f(c, i)
+		if len(apiErr) > 0 || format == FormatJSON {
+			return out, apiErr
+		}
+
+		text, err := render(i, out)
+		if err != nil {
+			apiErr = append(apiErr, DefaultAPIError(ErrorText, fmt.Sprintf("unable to render output: %s", err)))
+			return nil, apiErr
+		}
+
+		return nativeOutput(text), nil
+	}
+
+	return BaseAPI{model, native, role, scope}
+}
+
+// remarshal converts the output of an API into a typed structure
+func remarshal(in interface{}, out interface{}) error {
+	encoded, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, out)
+}
+
+// colonField formats a field of a colon separated file such as passwd or group.  Fields containing a colon or a new
+// line cannot be written without changing the entry and return an error.
+func colonField(value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	field := fmt.Sprint(value)
+	if strings.ContainsAny(field, ":\n\r") {
+		return "", fmt.Errorf("%q contains a colon or a new line", field)
+	}
+	return field, nil
+}
+
+// quotedField quotes a field of a grid-mapfile or grid-vorolemap
+func quotedField(value string) string {
+	value = strings.NewReplacer("\n", " ", "\r", " ").Replace(value)
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// plainField sanitizes a whitespace separated field
+func plainField(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(fmt.Sprint(value)), "_")
+}
+
+type nativePasswdEntry struct {
+	UserName string      `json:"username"`
+	UID      json.Number `json:"uid"`
+	GID      json.Number `json:"gid"`
+	GECOS    interface{} `json:"gecos"`
+	HomeDir  interface{} `json:"homedir"`
+	Shell    interface{} `json:"shell"`
+}
+
+// renderPasswdFile renders the output of getPasswdFile as an /etc/passwd file.
+// Users are listed once, ordered by uid, even if they appear in several units or resources.  A user whose entry differs
+// between resources, in its home directory or shell for instance, cannot be listed once and fails the rendering, as do
+// fields containing a colon or a new line.
+func renderPasswdFile(i Input, out interface{}) (string, error) {
+	var units map[string]struct {
+		Resources map[string][]nativePasswdEntry `json:"resources"`
+	}
+	if err := remarshal(out, &units); err != nil {
+		return "", err
+	}
+
+	type passwdLine struct {
+		uid      int64
+		userName string
+		line     string
+		source   string
+	}
+	seen := make(map[string]passwdLine)
+	var lines []passwdLine
+	unitNames := make([]string, 0, len(units))
+	for name := range units {
+		unitNames = append(unitNames, name)
+	}
+	sort.Strings(unitNames)
+
+	for _, unit := range unitNames {
+		resources := units[unit].Resources
+		names := make([]string, 0, len(resources))
+		for name := range resources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, e := range resources[name] {
+				var fields []string
+				for _, f := range []struct {
+					name  Attribute
+					value interface{}
+				}{{UserName, e.UserName}, {"gecos", e.GECOS}, {HomeDir, e.HomeDir}, {Shell, e.Shell}} {
+					field, err := colonField(f.value)
+					if err != nil {
+						return "", fmt.Errorf("%s of %s on %s/%s: %s", f.name, e.UserName, unit, name, err)
+					}
+					fields = append(fields, field)
+				}
+				uid, _ := e.UID.Int64()
+				line := passwdLine{uid, e.UserName, fmt.Sprintf("%s:x:%s:%s:%s:%s:%s", fields[0], e.UID, e.GID, fields[1],
+					fields[2], fields[3]), unit + "/" + name}
+				if first, found := seen[e.UserName]; found {
+					if first.line != line.line {
+						return "", fmt.Errorf("%s has different entries on %s and %s, request a single resourcename",
+							e.UserName, first.source, line.source)
+					}
+					continue
+				}
+				seen[e.UserName] = line
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	sort.SliceStable(lines, func(a, b int) bool {
+		if lines[a].uid != lines[b].uid {
+			return lines[a].uid < lines[b].uid
+		}
+		return lines[a].userName < lines[b].userName
+	})
+
+	var text strings.Builder
+	for _, l := range lines {
+		text.WriteString(l.line + "\n")
+	}
+
+	return text.String(), nil
+}
+
+// renderGroupFile renders the output of getGroupFile as an /etc/group file ordered by group name.  Group and user names
+// containing a colon or a new line fail the rendering.
+func renderGroupFile(i Input, out interface{}) (string, error) {
+	var groups []struct {
+		GroupName string      `json:"groupname"`
+		GID       json.Number `json:"gid"`
+		Users     []string    `json:"users"`
+	}
+	if err := remarshal(out, &groups); err != nil {
+		return "", err
+	}
+
+	sort.SliceStable(groups, func(a, b int) bool { return groups[a].GroupName < groups[b].GroupName })
+
+	var text strings.Builder
+	for _, g := range groups {
+		groupName, err := colonField(g.GroupName)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", GroupName, err)
+		}
+		users := make([]string, 0, len(g.Users))
+		for _, u := range g.Users {
+			user, err := colonField(u)
+			if err != nil {
+				return "", fmt.Errorf("%s of %s: %s", UserName, groupName, err)
+			}
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		fmt.Fprintf(&text, "%s:x:%s:%s\n", groupName, g.GID, strings.Join(users, ","))
+	}
+
+	return text.String(), nil
+}
+
+// renderGridMapFile renders the output of getGridMapFile as a grid-mapfile ordered by DN.
+// Only active users are listed, whatever status filter was used.
+func renderGridMapFile(i Input, out interface{}) (string, error) {
+	if i[JWT].Valid {
+		return "", errors.New("the native format is not supported with jwt")
+	}
+
+	var entries []struct {
+		DN       string `json:"dn"`
+		UserName string `json:"username"`
+		Status   bool   `json:"status"`
+	}
+	if err := remarshal(out, &entries); err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.Status || e.UserName == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", quotedField(e.DN), plainField(e.UserName)))
+	}
+	sort.Strings(lines)
+
+	return joinLines(lines), nil
+}
+
+// renderVORoleMapFile renders the output of getVORoleMapFile as a grid-vorolemap ordered by FQAN
+func renderVORoleMapFile(i Input, out interface{}) (string, error) {
+	var entries []struct {
+		FQAN     string `json:"fqan"`
+		UserName string `json:"username"`
+	}
+	if err := remarshal(out, &entries); err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf(`"*" %s %s`, quotedField(e.FQAN), plainField(e.UserName)))
+	}
+	sort.Strings(lines)
+
+	return joinLines(lines), nil
+}
+
+// renderStorageAuthzDBFile renders the output of getStorageAuthzDBFile as a dCache storage-authzdb file,
+// or as a passwd file when passwdmode is set
+func renderStorageAuthzDBFile(i Input, out interface{}) (string, error) {
+	if i[PasswdMode].Valid {
+		return renderPasswdFile(i, out)
+	}
+
+	var entries []struct {
+		UserName   string        `json:"username"`
+		Privileges string        `json:"privileges"`
+		UID        json.Number   `json:"uid"`
+		Groups     []json.Number `json:"groups"`
+		HomeDir    string        `json:"homedir"`
+		Root       string        `json:"root"`
+		Path       string        `json:"path"`
+	}
+	if err := remarshal(out, &entries); err != nil {
+		return "", err
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool { return entries[a].UserName < entries[b].UserName })
+
+	var text strings.Builder
+	text.WriteString("version 2.1\n\n")
+	for _, e := range entries {
+		if e.UserName == "" {
+			continue
+		}
+		groups := make([]string, 0, len(e.Groups))
+		for _, g := range e.Groups {
+			groups = append(groups, g.String())
+		}
+		fmt.Fprintf(&text, "authorize %s %s %s %s %s %s %s\n", plainField(e.UserName), plainField(e.Privileges),
+			e.UID, strings.Join(groups, ","), plainField(e.HomeDir), plainField(e.Root), plainField(e.Path))
+	}
+
+	return text.String(), nil
+}
+
+// joinLines joins lines terminating each one with a new line
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderPasswdFile(t *testing.T) {
+	entry := func(uname, uid, home, shell string) map[string]interface{} {
+		return map[string]interface{}{"username": uname, "uid": uid, "gid": "9767", "gecos": uname, "homedir": home, "shell": shell}
+	}
+	resources := func(r map[string][]map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"resources": r}
+	}
+
+	tests := []struct {
+		name string
+		out  map[string]interface{}
+		text string
+		err  string
+	}{
+		{"ordered by uid", map[string]interface{}{
+			"nova": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/bash"), entry("asmith", "10", "/home/asmith", "/bin/bash")},
+			}),
+		}, "asmith:x:10:9767:asmith:/home/asmith:/bin/bash\njdoe:x:20:9767:jdoe:/home/jdoe:/bin/bash\n", ""},
+		{"same entry on two resources", map[string]interface{}{
+			"nova": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/bash")},
+				"gpgrid":    {entry("jdoe", "20", "/home/jdoe", "/bin/bash")},
+			}),
+			"dune": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/bash")},
+			}),
+		}, "jdoe:x:20:9767:jdoe:/home/jdoe:/bin/bash\n", ""},
+		{"different home directories", map[string]interface{}{
+			"nova": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/bash")},
+				"gpgrid":    {entry("jdoe", "20", "/nashome/j/jdoe", "/bin/bash")},
+			}),
+		}, "", "jdoe has different entries on nova/fermigrid and nova/gpgrid"},
+		{"different shells across units", map[string]interface{}{
+			"dune": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/bash")},
+			}),
+			"nova": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/tcsh")},
+			}),
+		}, "", "jdoe has different entries on dune/fermigrid and nova/fermigrid"},
+		{"colons in fields", map[string]interface{}{
+			"nova": resources(map[string][]map[string]interface{}{
+				"fermigrid": {entry("jdoe", "20", "/home/jdoe", "/bin/bash:x")},
+			}),
+		}, "", "shell of jdoe on nova/fermigrid: \"/bin/bash:x\" contains a colon or a new line"},
+		{"new line in gecos", map[string]interface{}{
+			"nova": resources(map[string][]map[string]interface{}{
+				"fermigrid": {{"username": "jdoe", "uid": "20", "gid": "9767", "gecos": "John\nDoe", "homedir": "/home/jdoe",
+					"shell": "/bin/bash"}},
+			}),
+		}, "", "gecos of jdoe on nova/fermigrid"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := renderPasswdFile(Input{}, test.out)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Errorf("got %q", text)
+			}
+		})
+	}
+}
+
+func TestRenderGroupFile(t *testing.T) {
+	group := func(name string, users ...string) map[string]interface{} {
+		return map[string]interface{}{"groupname": name, "gid": "9767", "users": users}
+	}
+
+	tests := []struct {
+		name   string
+		groups []map[string]interface{}
+		text   string
+		err    string
+	}{
+		{"ordered by name", []map[string]interface{}{group("nova", "jdoe", "asmith"), group("dune")},
+			"dune:x:9767:\nnova:x:9767:asmith,jdoe\n", ""},
+		{"colon in group name", []map[string]interface{}{group("nova:x", "jdoe")}, "",
+			"groupname: \"nova:x\" contains a colon or a new line"},
+		{"new line in user name", []map[string]interface{}{group("nova", "jdoe\nroot")}, "",
+			"username of nova: \"jdoe\\nroot\" contains a colon or a new line"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := renderGroupFile(Input{}, test.groups)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Errorf("got %q", text)
+			}
+		})
+	}
+}
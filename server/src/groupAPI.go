@@ -24,6 +24,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		createGroup,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("createGroup", &createGroup)
 
@@ -37,6 +38,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		addGroupToUnit,
 		RoleWrite,
+		[]Attribute{UnitName, GroupName},
 	}
 	c.Add("addGroupToUnit", &addGroupToUnit)
 
@@ -49,6 +51,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		setGroupRequired,
 		RoleWrite,
+		[]Attribute{UnitName, GroupName},
 	}
 	c.Add("setGroupRequired", &setGroupRequired)
 
@@ -60,6 +63,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		removeGroupFromUnit,
 		RoleWrite,
+		[]Attribute{UnitName, GroupName},
 	}
 	c.Add("removeGroupFromUnit", &removeGroupFromUnit)
 
@@ -70,6 +74,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		setPrimaryStatusGroup,
 		RoleWrite,
+		[]Attribute{UnitName, GroupName},
 	}
 	c.Add("setPrimaryStatusGroup", &setPrimaryStatusGroup)
 
@@ -81,6 +86,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getGroupMembers,
 		RoleRead,
+		[]Attribute{GroupName},
 	}
 	c.Add("getGroupMembers", &getGroupMembers)
 
@@ -92,6 +98,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		isUserMemberOfGroup,
 		RoleRead,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("isUserMemberOfGroup", &isUserMemberOfGroup)
 
@@ -103,6 +110,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		isUserLeaderOfGroup,
 		RoleRead,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("isUserLeaderOfGroup", &isUserLeaderOfGroup)
 
@@ -114,6 +122,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		setGroupLeader,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("setGroupLeader", &setGroupLeader)
 
@@ -125,6 +134,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		removeGroupLeader,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("removeGroupLeader", &removeGroupLeader)
 
@@ -137,6 +147,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getGroupUnits,
 		RoleRead,
+		[]Attribute{GroupName},
 	}
 	c.Add("getGroupUnits", &getGroupUnits)
 
@@ -147,16 +158,18 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getAllGroups,
 		RoleRead,
+		nil,
 	}
 	c.Add("getAllGroups", &getAllGroups)
 
-	getAllGroupsMembers := BaseAPI{
+	getAllGroupsMembers := PagedAPI(
 		InputModel{
 			Parameter{LastUpdated, false},
 		},
 		getAllGroupsMembers,
 		RoleRead,
-	}
+		nil,
+	)
 	c.Add("getAllGroupsMembers", &getAllGroupsMembers)
 
 	getGroupAccessToResource := BaseAPI{
@@ -167,6 +180,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getGroupAccessToResource,
 		RoleRead,
+		[]Attribute{UnitName, ResourceName},
 	}
 	c.Add("getGroupAccessToResource", &getGroupAccessToResource)
 
@@ -178,6 +192,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getBatchPriorities,
 		RoleRead,
+		[]Attribute{UnitName, ResourceName},
 	}
 	c.Add("getBatchPriorities", &getBatchPriorities)
 
@@ -188,6 +203,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getCondorQuotas,
 		RoleRead,
+		[]Attribute{UnitName, ResourceName},
 	}
 	c.Add("getCondorQuotas", &getCondorQuotas)
 
@@ -201,6 +217,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		setCondorQuota,
 		RoleWrite,
+		[]Attribute{ResourceName},
 	}
 	c.Add("setCondorQuota", &setCondorQuota)
 
@@ -211,6 +228,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		removeCondorQuota,
 		RoleWrite,
+		[]Attribute{ResourceName},
 	}
 	c.Add("removeCondorQuota", &removeCondorQuota)
 
@@ -224,6 +242,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		getGroupStorageQuota,
 		RoleRead,
+		[]Attribute{UnitName, ResourceName, GroupName},
 	}
 	c.Add("getGroupStorageQuota", &getGroupStorageQuota)
 
@@ -235,6 +254,7 @@ func IncludeGroupAPIs(c *APICollection) {
 		},
 		removeUserAccessFromResource,
 		RoleRead,
+		[]Attribute{ResourceName, GroupName, UserName},
 	}
 	c.Add("removeUserAccessFromResource", &removeUserAccessFromResource)
 }
@@ -590,6 +610,7 @@ func setPrimaryStatusGroup(c APIContext, i Input) (interface{}, []APIError) {
 // getGroupMembers godoc
 // @Summary      Returns all the members of the specified group.
 // @Description  Returns all the members of the specified group.
+// @Description  Group leaders can call it with their JWT for the groups they lead.
 // @Tags         Groups
 // @Accept       html
 // @Produce      json
@@ -638,7 +659,8 @@ func getGroupMembers(c APIContext, i Input) (interface{}, []APIError) {
 								users using(uid)
 							   where
 								groupid = $1 and
-								(user_group.last_updated>=$2 or $2 is null)`,
+								(user_group.last_updated>=$2 or $2 is null)
+								order by users.uname`,
 		groupid, i[LastUpdated])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -975,12 +997,13 @@ func getGroupUnits(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select name, type, url, alternative_name from
+	rows, err := c.DBtx.Query(`select name, type, url, alternative_name from
 									affiliation_unit_group as ag join
 									affiliation_units using(unitid) left join
 									voms_url as vu using(unitid)
 								where groupid = $1 and ((url is not null = $2) or not $2)
-								and (vu.last_updated>=$3 or ag.last_updated>=$3 or $3 is null)`,
+								and (vu.last_updated>=$3 or ag.last_updated>=$3 or $3 is null)
+								order by name`,
 		groupid, experiment, i[LastUpdated])
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -1047,11 +1070,12 @@ func getBatchPriorities(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select name, value, valid_until from compute_batch
+	rows, err := c.DBtx.Query(`select name, value, valid_until from compute_batch
 							  where type = 'priority'
 							  and (compid = $1 or $1 is null)
 							  and (unitid = $2 or $2 is null)
-							  and (last_updated >= $3 or $3 is null)`, compid, unitid, i[LastUpdated])
+							  and (last_updated >= $3 or $3 is null)
+							  order by name`, compid, unitid, i[LastUpdated])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1348,7 +1372,7 @@ func getGroupStorageQuota(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select value, unit, valid_until from storage_quota
+	rows, err := c.DBtx.Query(`select value, unit, valid_until from storage_quota
 							  where groupid = $1 and storageid = $2 and unitid = $3
 							  and (valid_until is null or valid_until >= NOW()) and (last_updated>=$4 or $4 is null)
 							  order by valid_until desc`,
@@ -1505,10 +1529,11 @@ func getAllGroups(c APIContext, i Input) (interface{}, []APIError) {
 	}
 
 	if validType {
-		rows, err = DBptr.Query(`select name, type, gid from groups
-		where (groups.last_updated>=$1 or $1 is null) and type = $2`, i[LastUpdated], groupType)
+		rows, err = c.DBtx.Query(`select name, type, gid from groups
+		where (groups.last_updated>=$1 or $1 is null) and type = $2
+		order by name`, i[LastUpdated], groupType)
 	} else {
-		rows, err = DBptr.Query(`select name, type, gid from groups where groups.last_updated>=$1 or $1 is null`, i[LastUpdated])
+		rows, err = c.DBtx.Query(`select name, type, gid from groups where groups.last_updated>=$1 or $1 is null order by name`, i[LastUpdated])
 	}
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -1543,6 +1568,10 @@ func getAllGroups(c APIContext, i Input) (interface{}, []APIError) {
 // @Accept       html
 // @Produce      json
 // @Param        lastupdated    query     string  false  "limit results to records  updated since"  Format(date)
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
 // @Success      200  {object}  groupAllGroupsMembersMap
 // @Failure      400  {object}  jsonOutput
 // @Failure      401  {object}  jsonOutput
@@ -1550,12 +1579,24 @@ func getAllGroups(c APIContext, i Input) (interface{}, []APIError) {
 func getAllGroupsMembers(c APIContext, i Input) (interface{}, []APIError) {
 	var apiErr []APIError
 
-	rows, err := DBptr.Query(`select name, type, gid, uname, uid
-							  from user_group as ug
-							  join users using(uid)
-							  right join groups as g using(groupid)
-							  where ug.last_updated >= $1 or g.last_updated >= $1 or $1 is null
-							  order by name, type`, i[LastUpdated])
+	page, apiErr := newPage(i, map[Attribute]string{GroupName: "name"}, GroupName, "groupid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(2)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`with members as (
+								select groupid, name, type, gid, uname, uid
+								from user_group as ug
+								join users using(uid)
+								right join groups as g using(groupid)
+								where ug.last_updated >= $1 or g.last_updated >= $1 or $1 is null
+							  ), page as (
+								select groupid, name from members where %s group by groupid, name %s %s
+							  )
+							  select %s, name, type, gid, uname, uid from members join page using(groupid, name)
+							  %s, uname`, after, page.orderBy(), page.limitBy(), page.columns(), page.orderBy()),
+		append([]interface{}{i[LastUpdated]}, args...)...)
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1574,13 +1615,19 @@ func getAllGroupsMembers(c APIContext, i Input) (interface{}, []APIError) {
 	}
 	out := make([]jsonentry, 0)
 
+	prevKey := ""
 	for rows.Next() {
+		var sortValue, sortKey string
 		row := NewMapNullAttribute(GroupName, GroupType, GID, UserName, UID)
-		rows.Scan(row[GroupName], row[GroupType], row[GID], row[UserName], row[UID])
-		if row[GroupName].Data != group[GroupName] {
-			if group[GroupName] != "" {
+		rows.Scan(&sortValue, &sortKey, row[GroupName], row[GroupType], row[GID], row[UserName], row[UID])
+		if sortKey != prevKey {
+			if !page.add(sortValue, sortKey) {
+				break
+			}
+			if prevKey != "" {
 				out = append(out, group)
 			}
+			prevKey = sortKey
 			group = jsonentry{
 				GroupName: row[GroupName].Data,
 				GroupType: row[GroupType].Data,
@@ -1604,9 +1651,11 @@ func getAllGroupsMembers(c APIContext, i Input) (interface{}, []APIError) {
 			})
 		}
 	}
-	out = append(out, group)
+	if prevKey != "" {
+		out = append(out, group)
+	}
 
-	return out, nil
+	return page.output(out), nil
 }
 
 // getGroupAccessToResource godoc
@@ -1649,7 +1698,7 @@ func getGroupAccessToResource(c APIContext, i Input) (interface{}, []APIError) {
 	}
 
 	out := make([]interface{}, 0)
-	rows, err := DBptr.Query(`select name from groups where groupid in (
+	rows, err := c.DBtx.Query(`select name from groups where groupid in (
 								select distinct groupid from compute_access as ca
 								join compute_access_group using(compid, uid)
 								join compute_resources using(compid)
@@ -16,7 +16,8 @@ func IncludeLdapAPIs(c *APICollection) {
 			Parameter{UserName, true},
 		},
 		getUserLdapInfo,
-		RoleRead,
+		RoleSelf,
+		[]Attribute{UserName},
 	}
 	c.Add("getUserLdapInfo", &getUserLdapInfo)
 
@@ -26,13 +27,15 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		addOrUpdateUserInLdap,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("addOrUpdateUserInLdap", &addOrUpdateUserInLdap)
 
 	syncLdapWithFerry := BaseAPI{
 		InputModel{},
-		syncLdapWithFerry,
+		countLdapSync(syncLdapWithFerry),
 		RoleWrite,
+		nil,
 	}
 	c.Add("syncLdapWithFerry", &syncLdapWithFerry)
 
@@ -42,6 +45,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		removeUserFromLdap,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("removeUserFromLdap", &removeUserFromLdap)
 
@@ -53,6 +57,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		getCapabilitySet,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getCapabilitySet", &getCapabilitySet)
 
@@ -65,6 +70,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		createCapabilitySet,
 		RoleWrite,
+		nil,
 	}
 	c.Add("createCapabilitySet", &createCapabilitySet)
 
@@ -76,6 +82,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		setCapabilitySetAttributes,
 		RoleWrite,
+		nil,
 	}
 	c.Add("setCapabilitySetAttributes", &setCapabilitySetAttributes)
 
@@ -85,6 +92,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		dropCapabilitySet,
 		RoleWrite,
+		nil,
 	}
 	c.Add("dropCapabilitySet", &dropCapabilitySet)
 
@@ -95,6 +103,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		addScopeToCapabilitySet,
 		RoleWrite,
+		nil,
 	}
 	c.Add("addScopeToCapabilitySet", &addScopeToCapabilitySet)
 
@@ -105,6 +114,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		removeScopeFromCapabilitySet,
 		RoleWrite,
+		nil,
 	}
 	c.Add("removeScopeFromCapabilitySet", &removeScopeFromCapabilitySet)
 
@@ -116,6 +126,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		addCapabilitySetToFQAN,
 		RoleWrite,
+		[]Attribute{UnitName},
 	}
 	c.Add("addCapabilitySetToFQAN", &addCapabilitySetToFQAN)
 
@@ -127,6 +138,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		removeCapabilitySetFromFQAN,
 		RoleWrite,
+		[]Attribute{UnitName},
 	}
 	c.Add("removeCapabilitySetFromFQAN", &removeCapabilitySetFromFQAN)
 
@@ -136,6 +148,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		updateLdapForAffiliation,
 		RoleWrite,
+		[]Attribute{UnitName},
 	}
 	c.Add("updateLdapForAffiliation", &updateLdapForAffiliation)
 
@@ -145,6 +158,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		updateLdapForCapabilitySet,
 		RoleWrite,
+		nil,
 	}
 	c.Add("updateLdapForCapabilitySet", &updateLdapForCapabilitySet)
 
@@ -155,6 +169,7 @@ func IncludeLdapAPIs(c *APICollection) {
 		},
 		modifyUserLdapAttributes,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("modifyUserLdapAttributes", &modifyUserLdapAttributes)
 
@@ -163,6 +178,7 @@ func IncludeLdapAPIs(c *APICollection) {
 // getUserLdapInfo godoc
 // @Summary      Returns the user's LDAP data, directly from LDAP, not FERRY's DB.
 // @Description  Returns the user's LDAP data, directly from LDAP, not FERRY's DB.
+// @Description  Users can call it for themselves with their own JWT or certificate, username defaults to them.
 // @Tags         LDAP
 // @Accept       html
 // @Produce      json
@@ -178,7 +194,7 @@ func getUserLdapInfo(c APIContext, i Input) (interface{}, []APIError) {
 
 	uid := NewNullAttribute(UID)
 
-	err := DBptr.QueryRow(`select uid, token_subject from users where uname=$1`, i[UserName]).Scan(&uid, &vopid)
+	err := c.DBtx.QueryRow(`select uid, token_subject from users where uname=$1`, i[UserName]).Scan(&uid, &vopid)
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -192,7 +208,7 @@ func getUserLdapInfo(c APIContext, i Input) (interface{}, []APIError) {
 	}
 	lData.TokenSubject = vopid.String
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -232,7 +248,7 @@ func getUserLdapInfo(c APIContext, i Input) (interface{}, []APIError) {
 func addOrUpdateUserInLdap(c APIContext, i Input) (interface{}, []APIError) {
 	var apiErr []APIError
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -280,7 +296,7 @@ func syncLdapWithFerry(c APIContext, i Input) (interface{}, []APIError) {
 		Updated: make(jsonlist, 0),
 	}
 
-	con, err := LDAPgetConnection(true)
+	con, err := LDAPgetConnection(c, true)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection with paging failed: %v", err)
 		log.Error(msg)
@@ -298,7 +314,7 @@ func syncLdapWithFerry(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 	con.Close()
-	con, err = LDAPgetConnection(false)
+	con, err = LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -327,14 +343,15 @@ func syncLdapWithFerry(c APIContext, i Input) (interface{}, []APIError) {
 
 	rows, err := c.DBtx.Query(`select token_subject from temp_token_subjects
 	                           except
-							   select cast(token_subject as text) from users where token_subject is not null`)
+							   select cast(token_subject as text) from users where token_subject is not null
+							   order by token_subject`)
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
 		return nil, apiErr
 	}
 
-	requiredAccts := strings.Split(requiredAccounts, ",")
+	requiredAccts := strings.Split(ldapConfig.Load().requiredAccounts, ",")
 	for rows.Next() {
 		var deleteVoPersonID string
 
@@ -481,7 +498,7 @@ func removeUserFromLdap(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -716,7 +733,7 @@ func createCapabilitySet(c APIContext, i Input) (interface{}, []APIError) {
 		rData.voPersonApplicationUID = append(rData.voPersonApplicationUID, i[VaultStorageKey].Data.(string))
 	}
 
-	rData.dn = fmt.Sprintf("uid=%s,%s", i[SetName].Data, ldapBaseSetDN)
+	rData.dn = fmt.Sprintf("uid=%s,%s", i[SetName].Data, ldapConfig.Load().baseSetDN)
 	rData.objectClass = []string{"account", "eduPerson", "voPerson"}
 	rData.voPersonExternalID = i[SetName].Data.(string) + "@fnal.gov"
 	rData.uid = i[SetName].Data.(string)
@@ -725,7 +742,7 @@ func createCapabilitySet(c APIContext, i Input) (interface{}, []APIError) {
 		rData.eduPersonEntitlement = append(rData.eduPersonEntitlement, strings.TrimSpace(pattern))
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -805,7 +822,7 @@ func setCapabilitySetAttributes(c APIContext, i Input) (interface{}, []APIError)
 		return nil, apiErr
 	}
 
-	rData.dn = fmt.Sprintf("uid=%s,%s", i[SetName].Data, ldapBaseSetDN)
+	rData.dn = fmt.Sprintf("uid=%s,%s", i[SetName].Data, ldapConfig.Load().baseSetDN)
 
 	if i[TokenSubject].Valid {
 		rData.eduPersonPrincipalName = append(rData.eduPersonPrincipalName, i[TokenSubject].Data.(string))
@@ -821,7 +838,7 @@ func setCapabilitySetAttributes(c APIContext, i Input) (interface{}, []APIError)
 		}
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -890,7 +907,7 @@ func dropCapabilitySet(c APIContext, i Input) (interface{}, []APIError) {
 		apiErr = append(apiErr, DefaultAPIError(ErrorText, fmt.Sprintf("Capability set is in use by %d fqan records.", setidCnt)))
 		return nil, apiErr
 	}
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -959,7 +976,7 @@ func addScopeToCapabilitySet(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -1028,7 +1045,7 @@ func removeScopeFromCapabilitySet(c APIContext, i Input) (interface{}, []APIErro
 		return nil, nil
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -1182,7 +1199,8 @@ func removeCapabilitySetFromFQAN(c APIContext, i Input) (interface{}, []APIError
 							   where u.token_subject is not null
 								 and gf.fqanid in (select fqanid from grid_fqan join affiliation_units using (unitid)
 								                   where name=$1
-												     and lower(fqan) like lower($2) )`, i[UnitName], role)
+												     and lower(fqan) like lower($2) )
+							   order by u.token_subject`, i[UnitName], role)
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1192,7 +1210,7 @@ func removeCapabilitySetFromFQAN(c APIContext, i Input) (interface{}, []APIError
 		return nil, nil
 	}
 
-	con, lErr := LDAPgetConnection(false)
+	con, lErr := LDAPgetConnection(c, false)
 	if lErr != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", lErr)
 		log.Error(msg)
@@ -1204,7 +1222,7 @@ func removeCapabilitySetFromFQAN(c APIContext, i Input) (interface{}, []APIError
 	var setsToDrop, setsToAdd, groupsToDrop, groupsToAdd []string
 	var voPersonID string
 
-	setsToDrop = append(setsToDrop, ldapCapabitySet+i[SetName].Data.(string))
+	setsToDrop = append(setsToDrop, ldapConfig.Load().capabilitySet+i[SetName].Data.(string))
 	wgroup := getWlcgGroup(fullFQAN.Data.(string), i[UnitName].Data.(string))
 	if wgroup != "" {
 		groupsToDrop = append(groupsToDrop, wgroup)
@@ -1213,7 +1231,7 @@ func removeCapabilitySetFromFQAN(c APIContext, i Input) (interface{}, []APIError
 	for rows.Next() {
 		rows.Scan(&voPersonID)
 
-		dn = fmt.Sprintf("voPersonID=%s,%s", voPersonID, ldapBaseDN)
+		dn = fmt.Sprintf("voPersonID=%s,%s", voPersonID, ldapConfig.Load().baseDN)
 		log.Infof("dn: %s", dn)
 		_, lErr = LDAPmodifyUserScoping(dn, setsToDrop, setsToAdd, groupsToDrop, groupsToAdd, con)
 		if lErr != nil {
@@ -1239,7 +1257,7 @@ func removeCapabilitySetFromFQAN(c APIContext, i Input) (interface{}, []APIError
 }
 
 // Internal method.  Given a set of user's voPersonIDs, for each user update LDAP.
-func updateLdapForUserSet(c APIContext, voPersonIDs []string, con *ldap.Conn) ([]string, []APIError) {
+func updateLdapForUserSet(c APIContext, voPersonIDs []string, con ldap.Client) ([]string, []APIError) {
 	var apiErr []APIError
 	var updated []string
 	var dn string
@@ -1269,8 +1287,8 @@ func updateLdapForUserSet(c APIContext, voPersonIDs []string, con *ldap.Conn) ([
 		var setname, fqan, unitname string
 		for rows.Next() {
 			rows.Scan(&setname, &fqan, &unitname)
-			if !stringInSlice(ldapCapabitySet+setname, ferryCsets) {
-				ferryCsets = append(ferryCsets, ldapCapabitySet+setname)
+			if !stringInSlice(ldapConfig.Load().capabilitySet+setname, ferryCsets) {
+				ferryCsets = append(ferryCsets, ldapConfig.Load().capabilitySet+setname)
 			}
 			wgroup := getWlcgGroup(fqan, unitname)
 			if wgroup != "" && !stringInSlice(wgroup, ferryWgroups) {
@@ -1290,7 +1308,7 @@ func updateLdapForUserSet(c APIContext, voPersonIDs []string, con *ldap.Conn) ([
 		groupsToDrop := arrayCompare(lData.IsMemberOf, ferryWgroups)
 		groupsToAdd := arrayCompare(ferryWgroups, lData.IsMemberOf)
 
-		dn = fmt.Sprintf("voPersonID=%s,%s", voPersonID, ldapBaseDN)
+		dn = fmt.Sprintf("voPersonID=%s,%s", voPersonID, ldapConfig.Load().baseDN)
 		modified, lErr := LDAPmodifyUserScoping(dn, setsToDrop, setsToAdd, groupsToDrop, groupsToAdd, con)
 		if lErr != nil {
 			log.Errorf("From LDAPmodifyUserScoping - error on dn: %s  Error: %s", dn, lErr)
@@ -1364,7 +1382,7 @@ func updateLdapForAffiliation(c APIContext, i Input) (interface{}, []APIError) {
 		voPersonIDs = append(voPersonIDs, voPersonID)
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -1435,7 +1453,7 @@ func updateLdapForCapabilitySet(c APIContext, i Input) (interface{}, []APIError)
 		voPersonIDs = append(voPersonIDs, voPersonID)
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
@@ -1454,7 +1472,7 @@ func modifyUserLdapAttributes(c APIContext, i Input) (interface{}, []APIError) {
 	var apiErr []APIError
 	var voPersonID sql.NullString
 
-	err := DBptr.QueryRow(`select token_subject from users where uname = $1`, i[UserName]).Scan(&voPersonID)
+	err := c.DBtx.QueryRow(`select token_subject from users where uname = $1`, i[UserName]).Scan(&voPersonID)
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1476,14 +1494,14 @@ func modifyUserLdapAttributes(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	con, err := LDAPgetConnection(false)
+	con, err := LDAPgetConnection(c, false)
 	if err != nil {
 		msg := fmt.Sprintf("LDAP, connection failed: %v", err)
 		log.Error(msg)
 		apiErr = append(apiErr, DefaultAPIError(ErrorText, msg))
 		return nil, apiErr
 	}
-	dn := fmt.Sprintf("voPersonID=%s,%s", voPersonID.String, ldapBaseDN)
+	dn := fmt.Sprintf("voPersonID=%s,%s", voPersonID.String, ldapConfig.Load().baseDN)
 	err = LdapModifyAttributes(dn, m, con)
 	if err != nil {
 		con.Close()
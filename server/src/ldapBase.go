@@ -5,12 +5,15 @@ package main
 // https://github.com/go-ldap/ldap
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
@@ -19,123 +22,279 @@ import (
 	"github.com/spf13/viper"
 )
 
-var ldapURL string
-var ldapWriteDN string
-var ldapReadDN string
-var ldapPass string
-var ldapReadPass string
-var ldapBaseDN string
-var ldapBaseSetDN string
-var ldapCapabitySet string
-var ldapTimeout string
-var requiredAccounts string
+// ldapSettings is the LDAP section of the configuration.  It is replaced as a whole by reloads.
+type ldapSettings struct {
+	url, writeDN, readDN, pass, readPass, baseDN, baseSetDN, capabilitySet, requiredAccounts string
+	timeout                                                                                   time.Duration
+}
+
+// ldapConfig is the LDAP configuration loaded by the last reload
+var ldapConfig atomic.Pointer[ldapSettings]
 
 var ldapErrNoSuchObject = "LDAP Result Code 32 \"No Such Object\": "
 
+// LDAPinitialize loads the LDAP section of the configuration
 func LDAPinitialize() error {
+	settings, err := loadLdapSettings()
+	ldapConfig.Store(settings)
+	return err
+}
+
+// loadLdapSettings reads the LDAP section of the configuration, returning an error naming the missing settings
+func loadLdapSettings() (*ldapSettings, error) {
 	var fields []string
 
 	ldapConfig := viper.GetStringMapString("ldap")
-	ldapURL = ldapConfig["url"]
-	ldapWriteDN = ldapConfig["writedn"]
-	ldapReadDN = ldapConfig["readdn"]
-	ldapBaseDN = ldapConfig["basedn"]
-	ldapBaseSetDN = ldapConfig["basesetdn"]
-	ldapCapabitySet = ldapConfig["capabilityset"]
-	ldapTimeout = ldapConfig["timeoutinseconds"]
-	requiredAccounts = ldapConfig["requiredaccounts"]
+	s := ldapSettings{
+		url:              ldapConfig["url"],
+		writeDN:          ldapConfig["writedn"],
+		readDN:           ldapConfig["readdn"],
+		baseDN:           ldapConfig["basedn"],
+		baseSetDN:        ldapConfig["basesetdn"],
+		capabilitySet:    ldapConfig["capabilityset"],
+		requiredAccounts: ldapConfig["requiredaccounts"],
+		timeout:          ldap.DefaultTimeout,
+	}
 
 	x := viper.Get("ldap_password")
 	if x != nil {
-		ldapPass = x.(string)
+		s.pass = x.(string)
 	} else {
-		ldapPass = ldapConfig["password"]
+		s.pass = ldapConfig["password"]
 	}
 	x = viper.Get("ldap_readpassword")
 	if x != nil {
-		ldapReadPass = x.(string)
+		s.readPass = x.(string)
 	} else {
-		ldapReadPass = ldapConfig["readpassword"]
+		s.readPass = ldapConfig["readpassword"]
 	}
 
-	if len(ldapURL) == 0 {
+	if len(s.url) == 0 {
 		fields = append(fields, "url")
 	}
-	if len(ldapWriteDN) == 0 {
+	if len(s.writeDN) == 0 {
 		fields = append(fields, "writedn")
 	}
-	if len(ldapReadDN) == 0 {
+	if len(s.readDN) == 0 {
 		fields = append(fields, "readdn")
 	}
-	if len(ldapPass) == 0 {
+	if len(s.pass) == 0 {
 		fields = append(fields, "password")
 	}
-	if len(ldapReadPass) == 0 {
+	if len(s.readPass) == 0 {
 		fields = append(fields, "readpassword")
 	}
-	if len(ldapBaseDN) == 0 {
+	if len(s.baseDN) == 0 {
 		fields = append(fields, "basedn")
 	}
-	if len(ldapBaseSetDN) == 0 {
+	if len(s.baseSetDN) == 0 {
 		fields = append(fields, "basesetdn")
 	}
-	if len(ldapTimeout) > 0 {
-		t, _ := strconv.ParseInt(ldapTimeout, 10, 0)
-		ldap.DefaultTimeout = time.Duration(t) * time.Second
+	if timeout := ldapConfig["timeoutinseconds"]; len(timeout) > 0 {
+		t, _ := strconv.ParseInt(timeout, 10, 0)
+		s.timeout = time.Duration(t) * time.Second
 	}
-	if len(requiredAccounts) == 0 {
+	if len(s.requiredAccounts) == 0 {
 		fields = append(fields, "requiredaccounts")
 	}
 	if len(fields) > 0 {
 		err := errors.New("in the  ldap section, the config file is missing: " + strings.Join(fields, ","))
-		return err
+		return &s, err
 	}
-	return nil
+	return &s, nil
 }
 
-func ldapError(method string, ldapMethod string, e error) {
+// ldapError logs an LDAP error and sends it as a Slack alert in the background, both tagged with the request ID if any
+func ldapError(requestID string, method string, ldapMethod string, e error) {
 	msg := fmt.Sprintf("LDAPERROR in %s:%s --> %s", method, ldapMethod, e)
-	log.Errorf(msg)
-	// _ = SlackMessage(context.TODO(), msg)
+	fields := log.Fields{}
+	if len(requestID) > 0 {
+		fields["request_id"] = requestID
+	}
+	log.WithFields(fields).Error(msg)
+
+	if len(FerryAlertsURL) > 0 {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_ = SlackMessage(ctx, requestID, msg)
+		}()
+	}
+}
+
+// ldapRequestID returns the ID of the request an LDAP connection was opened for
+func ldapRequestID(con ldap.Client) string {
+	if r, ok := con.(interface{ RequestID() string }); ok {
+		return r.RequestID()
+	}
+	return ""
 }
 
 // Caller MUST close connection when done.
 // readonly=true provides a connection to a DN which allows paging but is readyonly
-func LDAPgetConnection(readonly bool) (*ldap.Conn, error) {
+// During a dry run the connection is readonly and writes are only recorded in the dry run report.
+// In a batch, writes are queued and only sent once the batch is committed.
+// The connection is closed when the context of the API call is done.
+func LDAPgetConnection(c APIContext, readonly bool) (ldap.Client, error) {
+	ctx := c.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	settings := ldapConfig.Load()
+	dialer := &net.Dialer{Timeout: settings.timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
 
-	l, err := ldap.DialURL(ldapURL)
+	start := time.Now()
+	dial, err := ldap.DialURL(settings.url, ldap.DialWithDialer(dialer))
+	observeLDAP("connect", start, err)
 	if err != nil {
-		ldapError("LDAPgetConnection", "DialURL", err)
+		ldapError(c.RequestID, "LDAPgetConnection", "DialURL", err)
 		return nil, err
 	}
+	stop := context.AfterFunc(ctx, func() { dial.Close() })
+	l := ldapRequestConn{dial, ctx, c.RequestID, stop}
+	if c.DryRun != nil {
+		err = l.Bind(settings.readDN, settings.readPass)
+		if err != nil {
+			ldapError(c.RequestID, "LDAPgetConnection", "Bind", err)
+			l.Close()
+			return nil, err
+		}
+		return &ldapDryRunConn{l, c.DryRun}, nil
+	}
 	if readonly {
-		err = l.Bind(ldapReadDN, ldapReadPass)
+		err = l.Bind(settings.readDN, settings.readPass)
 		if err != nil {
-			ldapError("LDAPgetConnection", "Bind", err)
+			ldapError(c.RequestID, "LDAPgetConnection", "Bind", err)
+			l.Close()
 			return nil, err
 		}
 	} else {
-		err = l.Bind(ldapWriteDN, ldapPass)
+		err = l.Bind(settings.writeDN, settings.pass)
 		if err != nil {
-			ldapError("LDAPgetConnection", "Bind 2", err)
+			ldapError(c.RequestID, "LDAPgetConnection", "Bind 2", err)
+			l.Close()
 			return nil, err
 		}
 	}
+	if c.LDAPQueue != nil && !readonly {
+		return &ldapQueuedConn{l, c.LDAPQueue}, nil
+	}
 
 	return l, nil
 }
 
-func LDAPgetUserData(voPersonID string, con *ldap.Conn) (LDAPUserData, error) {
+// ldapRequestConn is an LDAP connection opened for an API call.  Operations fail once the context of the call is done
+// and their count and latency are recorded in the server metrics.
+type ldapRequestConn struct {
+	ldap.Client
+	ctx       context.Context
+	requestID string
+	stop      func() bool
+}
+
+// RequestID returns the ID of the request the connection was opened for
+func (l ldapRequestConn) RequestID() string {
+	return l.requestID
+}
+
+// Close closes the connection and stops waiting for the context of the call to be done
+func (l ldapRequestConn) Close() {
+	l.stop()
+	l.Client.Close()
+}
+
+// Bind binds to the LDAP server
+func (l ldapRequestConn) Bind(username, password string) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := l.Client.Bind(username, password)
+	observeLDAP("bind", start, err)
+	return err
+}
+
+// Add sends an LDAP add request
+func (l ldapRequestConn) Add(r *ldap.AddRequest) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := l.Client.Add(r)
+	observeLDAP("add", start, err)
+	return err
+}
+
+// Del sends an LDAP delete request
+func (l ldapRequestConn) Del(r *ldap.DelRequest) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := l.Client.Del(r)
+	observeLDAP("delete", start, err)
+	return err
+}
+
+// Modify sends an LDAP modify request
+func (l ldapRequestConn) Modify(r *ldap.ModifyRequest) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := l.Client.Modify(r)
+	observeLDAP("modify", start, err)
+	return err
+}
+
+// ModifyDN sends an LDAP modify DN request
+func (l ldapRequestConn) ModifyDN(r *ldap.ModifyDNRequest) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := l.Client.ModifyDN(r)
+	observeLDAP("modifydn", start, err)
+	return err
+}
+
+// Search sends an LDAP search request
+func (l ldapRequestConn) Search(r *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if err := l.ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := l.Client.Search(r)
+	observeLDAP("search", start, err)
+	return result, err
+}
+
+// SearchWithPaging sends a paged LDAP search request
+func (l ldapRequestConn) SearchWithPaging(r *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	if err := l.ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := l.Client.SearchWithPaging(r, pagingSize)
+	observeLDAP("search_paged", start, err)
+	return result, err
+}
+
+func LDAPgetUserData(voPersonID string, con ldap.Client) (LDAPUserData, error) {
 	var lData LDAPUserData
 	attributes := []string{"dn", "objectClass", "voPersonID", "voPersonExternalID", "uid", "sn", "cn", "givenName", "mail",
 		"eduPersonPrincipalName", "eduPersonEntitlement", "isMemberOf"}
 
 	filter := fmt.Sprintf("(voPersonID=%s)", ldap.EscapeFilter(voPersonID))
-	searchReq := ldap.NewSearchRequest(ldapBaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attributes, []ldap.Control{})
+	searchReq := ldap.NewSearchRequest(ldapConfig.Load().baseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, attributes, []ldap.Control{})
 
 	result, err := con.Search(searchReq)
 	if err != nil {
-		ldapError("LDAPgetUserData", "Search", err)
+		ldapError(ldapRequestID(con), "LDAPgetUserData", "Search", err)
 		return lData, err
 	}
 
@@ -160,15 +319,15 @@ func LDAPgetUserData(voPersonID string, con *ldap.Conn) (LDAPUserData, error) {
 	return lData, nil
 }
 
-func LDAPgetAllVoPersonIDs(con *ldap.Conn) ([]string, error) {
+func LDAPgetAllVoPersonIDs(con ldap.Client) ([]string, error) {
 	var voPersonIDs []string
 
 	attributes := []string{"voPersonID"}
-	searchReq := ldap.NewSearchRequest(ldapBaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false,
+	searchReq := ldap.NewSearchRequest(ldapConfig.Load().baseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false,
 		"(&(objectClass=organizationalPerson))", attributes, []ldap.Control{ldap.NewControlPaging(1000)})
 	result, err := con.SearchWithPaging(searchReq, 1000)
 	if err != nil {
-		ldapError("LDAPgetAllVoPersonIDs", "SearchWithPaging", err)
+		ldapError(ldapRequestID(con), "LDAPgetAllVoPersonIDs", "SearchWithPaging", err)
 		return nil, err
 	}
 
@@ -178,7 +337,7 @@ func LDAPgetAllVoPersonIDs(con *ldap.Conn) ([]string, error) {
 	return voPersonIDs, err
 }
 
-func LDAPaddUser(lData LDAPUserData, con *ldap.Conn) error {
+func LDAPaddUser(lData LDAPUserData, con ldap.Client) error {
 
 	givenName := []string{lData.GivenName}
 	uid := []string{lData.Uid}
@@ -201,25 +360,25 @@ func LDAPaddUser(lData LDAPUserData, con *ldap.Conn) error {
 	addReq.Attribute("voPersonID", voPersonID)
 	err := con.Add(addReq)
 	if err != nil {
-		ldapError("LDAPaddUser", "Add", err)
+		ldapError(ldapRequestID(con), "LDAPaddUser", "Add", err)
 	}
 	return err
 }
 
-func LDAPremoveUser(voPersonID string, con *ldap.Conn) error {
+func LDAPremoveUser(voPersonID string, con ldap.Client) error {
 
-	DN := fmt.Sprintf("voPersonID=%s,%s", voPersonID, ldapBaseDN)
+	DN := fmt.Sprintf("voPersonID=%s,%s", voPersonID, ldapConfig.Load().baseDN)
 	delReq := ldap.NewDelRequest(DN, []ldap.Control{})
 	err := con.Del(delReq)
 	// If the user was not in LDAP, don't put out an error.
 	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
-		ldapError("LDAPremoveUser", "Del", err)
+		ldapError(ldapRequestID(con), "LDAPremoveUser", "Del", err)
 	}
 
 	return err
 }
 
-func LDAPgetCapabilitySetData(dn string, con *ldap.Conn) (LDAPCapabilitySetData, error) {
+func LDAPgetCapabilitySetData(dn string, con ldap.Client) (LDAPCapabilitySetData, error) {
 	var rData LDAPCapabilitySetData
 	attributes := []string{"dn", "objectClass", "voPersonExternalID", "eduPersonEntitlement", "uid", "eduPersonPrincipalName", "voPersonApplicationUID"}
 
@@ -227,7 +386,7 @@ func LDAPgetCapabilitySetData(dn string, con *ldap.Conn) (LDAPCapabilitySetData,
 
 	result, err := con.Search(searchReq)
 	if err != nil {
-		ldapError("LDAPgetCapabilitySetData", "Search", err)
+		ldapError(ldapRequestID(con), "LDAPgetCapabilitySetData", "Search", err)
 		return rData, err
 	}
 
@@ -247,7 +406,7 @@ func LDAPgetCapabilitySetData(dn string, con *ldap.Conn) (LDAPCapabilitySetData,
 	return rData, nil
 }
 
-func LDAPaddCapabilitySet(rData LDAPCapabilitySetData, con *ldap.Conn) error {
+func LDAPaddCapabilitySet(rData LDAPCapabilitySetData, con ldap.Client) error {
 
 	voPersonExternalID := []string{rData.voPersonExternalID}
 	uid := []string{rData.uid}
@@ -265,46 +424,46 @@ func LDAPaddCapabilitySet(rData LDAPCapabilitySetData, con *ldap.Conn) error {
 	}
 	err := con.Add(addReq)
 	if err != nil {
-		ldapError("LDAPaddCapabilitySet", "Add", err)
+		ldapError(ldapRequestID(con), "LDAPaddCapabilitySet", "Add", err)
 	}
 
 	return err
 }
 
-func LDAPremoveCapabilitySet(voPersonExternalID string, con *ldap.Conn) error {
+func LDAPremoveCapabilitySet(voPersonExternalID string, con ldap.Client) error {
 
-	DN := fmt.Sprintf("uid=%s,%s", voPersonExternalID, ldapBaseSetDN)
+	DN := fmt.Sprintf("uid=%s,%s", voPersonExternalID, ldapConfig.Load().baseSetDN)
 	delReq := ldap.NewDelRequest(DN, []ldap.Control{})
 	err := con.Del(delReq)
 	if err != nil {
-		ldapError("LDAPremoveCapabilitySet", "Del", err)
+		ldapError(ldapRequestID(con), "LDAPremoveCapabilitySet", "Del", err)
 	}
 
 	return err
 }
 
-func LDAPaddScope(setName string, patterns []string, con *ldap.Conn) error {
+func LDAPaddScope(setName string, patterns []string, con ldap.Client) error {
 
-	DN := fmt.Sprintf("uid=%s,%s", setName, ldapBaseSetDN)
+	DN := fmt.Sprintf("uid=%s,%s", setName, ldapConfig.Load().baseSetDN)
 	modify := ldap.NewModifyRequest(DN, nil)
 	modify.Add("eduPersonEntitlement", patterns)
 	err := con.Modify(modify)
 	if err != nil {
-		ldapError("LDAPaddScope", "Modify", err)
+		ldapError(ldapRequestID(con), "LDAPaddScope", "Modify", err)
 	}
 
 	return err
 
 }
 
-func LDAPremoveScope(setName string, pattern []string, con *ldap.Conn) error {
+func LDAPremoveScope(setName string, pattern []string, con ldap.Client) error {
 
-	DN := fmt.Sprintf("uid=%s,%s", setName, ldapBaseSetDN)
+	DN := fmt.Sprintf("uid=%s,%s", setName, ldapConfig.Load().baseSetDN)
 	modify := ldap.NewModifyRequest(DN, nil)
 	modify.Delete("eduPersonEntitlement", pattern)
 	err := con.Modify(modify)
 	if err != nil {
-		ldapError("LDAPremoveScope", "Modify", err)
+		ldapError(ldapRequestID(con), "LDAPremoveScope", "Modify", err)
 	}
 
 	return err
@@ -312,7 +471,7 @@ func LDAPremoveScope(setName string, pattern []string, con *ldap.Conn) error {
 }
 
 func LDAPmodifyUserScoping(dn string, setsToDrop []string, setsToAdd []string, groupsToDrop []string, groupsToAdd []string,
-	con *ldap.Conn) (bool, error) {
+	con ldap.Client) (bool, error) {
 	var err error
 	var adjSetsToDrop, adjSetsToAdd, adjGroupsToDrop, adjGroupsToAdd []string
 	modified := false
@@ -368,13 +527,13 @@ func LDAPmodifyUserScoping(dn string, setsToDrop []string, setsToAdd []string, g
 		if err == nil {
 			modified = true
 		} else {
-			ldapError("LDAPmodifyUserScoping", "Modify", err)
+			ldapError(ldapRequestID(con), "LDAPmodifyUserScoping", "Modify", err)
 		}
 	}
 	return modified, err
 }
 
-func LdapModifyAttributes(dn string, m map[string]string, con *ldap.Conn) error {
+func LdapModifyAttributes(dn string, m map[string]string, con ldap.Client) error {
 	var err error
 
 	modify := ldap.NewModifyRequest(dn, nil)
@@ -390,6 +549,11 @@ func LdapModifyAttributes(dn string, m map[string]string, con *ldap.Conn) error
 				sn := []string{name[1]}
 				modify.Replace("sn", sn)
 			}
+		} else if key == "uid" {
+			modify.Replace("uid", []string{value})
+		} else if key == "mail" {
+			modify.Replace("mail", []string{value})
+			modify.Replace("voPersonExternalID", []string{value})
 		} else {
 			return fmt.Errorf("attribute %s is not supported", key)
 		}
@@ -398,12 +562,12 @@ func LdapModifyAttributes(dn string, m map[string]string, con *ldap.Conn) error
 	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
 		return nil
 	} else if err != nil {
-		ldapError("LdapModifyAttributes", "Modify", err)
+		ldapError(ldapRequestID(con), "LdapModifyAttributes", "Modify", err)
 	}
 	return err
 }
 
-func LDAPmodifyCapabilitySetAttributes(rData LDAPCapabilitySetData, eData LDAPCapabilitySetData, con *ldap.Conn) error {
+func LDAPmodifyCapabilitySetAttributes(rData LDAPCapabilitySetData, eData LDAPCapabilitySetData, con ldap.Client) error {
 	var err error
 	var doit = false
 
@@ -442,7 +606,7 @@ func LDAPmodifyCapabilitySetAttributes(rData LDAPCapabilitySetData, eData LDAPCa
 	if doit {
 		err = con.Modify(modify)
 		if err != nil {
-			ldapError("LDAPmodifyCapabilitySetAttributes", "Modify", err)
+			ldapError(ldapRequestID(con), "LDAPmodifyCapabilitySetAttributes", "Modify", err)
 		}
 	}
 	return err
@@ -467,11 +631,11 @@ func getWlcgGroup(fqan string, unitname string) string {
 
 // Adds a user to LDAP but does NOT deal with eduPersonEntitilments or isMemberOf.  see updateLdapForUserSet for that.
 // This method ensures a user, who listed in the DB, is also in LDAP.  It not the user is added to LDAP.
-func addUserToLdapBase(c APIContext, i Input, con *ldap.Conn) (LDAPUserData, []APIError) {
+func addUserToLdapBase(c APIContext, i Input, con ldap.Client) (LDAPUserData, []APIError) {
 	var apiErr []APIError
 	var lData LDAPUserData
 
-	emailSuffix := "fnal.gov"
+	emailSuffix := emailDomain()
 	uname := NewNullAttribute(UserName)
 	uid := NewNullAttribute(UID)
 	lData.ObjectClass = []string{"person", "organizationalPerson", "inetOrgPerson", "eduMember", "eduPerson", "voPerson"}
@@ -521,7 +685,7 @@ func addUserToLdapBase(c APIContext, i Input, con *ldap.Conn) (LDAPUserData, []A
 		}
 	}
 
-	lData.Dn = fmt.Sprintf("voPersonID=%s,%s", lData.TokenSubject, ldapBaseDN)
+	lData.Dn = fmt.Sprintf("voPersonID=%s,%s", lData.TokenSubject, ldapConfig.Load().baseDN)
 	lData.Mail = fmt.Sprintf("%s@%s", uname.Data, emailSuffix)
 	lData.EduPersonPrincipalName = lData.TokenSubject
 	lData.Uid = uname.Data.(string)
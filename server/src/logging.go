@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header used to accept and return the ID of a request
+const RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+// requestID returns the ID sent by the client in the X-Request-ID header, or a new one when
+// the header is missing or invalid
+func requestID(r *http.Request) string {
+	id := strings.TrimSpace(r.Header.Get(RequestIDHeader))
+	if validRequestID.MatchString(id) {
+		return id
+	}
+	return uuid.New().String()
+}
+
+// hostnameCache stores the result of reverse DNS lookups, including failed ones
+var hostnameCache = cache.New(time.Hour, 10*time.Minute)
+
+// lookupHostname returns the hostname of an IP address.  Lookups are cached and limited to
+// a short timeout so logging never waits on a slow DNS server.
+func lookupHostname(ip string) string {
+	const Unknown = "unknown"
+
+	if hostname, found := hostnameCache.Get(ip); found {
+		return hostname.(string)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	hostname := Unknown
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err == nil && len(names) > 0 {
+		hostname = strings.Trim(names[0], ".")
+	}
+	hostnameCache.Set(ip, hostname, cache.DefaultExpiration)
+
+	return hostname
+}
+
+// currentLogFormat is the log format set by the configuration
+var currentLogFormat string
+
+// logFormatter returns the log formatter selected in the log section of the configuration
+func logFormatter(format string) log.Formatter {
+	if strings.ToLower(format) == "json" {
+		return &log.JSONFormatter{}
+	}
+	return &log.TextFormatter{
+		FullTimestamp: true,
+		DisableColors: true,
+	}
+}
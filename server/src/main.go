@@ -1,20 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"regexp"
 	"strconv"
-	"strings"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/go-openapi/runtime/middleware"
 
 	"crypto/tls"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	golog "log"
@@ -29,7 +31,6 @@ import (
 var DBptr *sql.DB
 var DBtx Transaction
 var Mainsrv *http.Server
-var ValidCAs CAs
 var AccCache *cache.Cache
 var FerryAlertsURL string
 var serverRole string
@@ -46,18 +47,20 @@ func QueryFields(c APIContext) log.Fields {
 	fields := make(log.Fields)
 
 	fields["action"] = c.R.URL.Path[1:]
+	if len(c.RequestID) > 0 {
+		fields["request_id"] = c.RequestID
+	}
 	fields["query"] = c.R.URL
 	fields["auth_level"] = c.AuthLevel.String()
 	fields["duration"] = time.Since(c.StartTime).Nanoseconds() / 1e6
 
-	clientIP := strings.Split(c.R.RemoteAddr, ":")[0]
-	fields["client_ip"] = clientIP
-
-	clientNames, err := net.LookupAddr(clientIP)
-	if err == nil {
-		fields["hostname"] = strings.Trim(clientNames[0], ".")
-	} else {
-		fields["hostname"] = Unknown
+	ip, proxy := requestClient(c.R)
+	if ip != "" {
+		fields["client_ip"] = ip
+		fields["hostname"] = lookupHostname(ip)
+	}
+	if proxy != "" {
+		fields["proxy_ip"] = proxy
 	}
 
 	if len(c.Subject) > 0 {
@@ -123,17 +126,12 @@ func main() {
 		panic(fmt.Errorf("fatal error config file: %s ", cfgErr))
 	}
 	viper.WatchConfig()
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		log.WithFields(log.Fields{"file": e.Name}).Info("Config file changed.")
-	})
 
 	//Setup log file
 	logConfig := viper.GetStringMapString("log")
 
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-		DisableColors: true,
-	})
+	log.SetFormatter(logFormatter(logConfig["format"]))
+	currentLogFormat = logConfig["format"]
 
 	if len(logConfig) > 0 {
 		if len(logConfig["file"]) > 0 {
@@ -164,6 +162,10 @@ func main() {
 		log.Fatal(ldapErr)
 	}
 
+	if err := ProxyInitialize(); err != nil {
+		log.Fatal(err)
+	}
+
 	APIs := make(APICollection)
 	IncludeUserAPIs(&APIs)
 	IncludeGroupAPIs(&APIs)
@@ -172,6 +174,11 @@ func main() {
 	IncludeUnitAPIs(&APIs)
 	IncludeLdapAPIs(&APIs)
 	IncludeAllocationAPIs(&APIs)
+	IncludeAuditAPIs(&APIs)
+	IncludeWebhookAPIs(&APIs)
+	IncludeAccessorAPIs(&APIs)
+	IncludeReloadAPIs(&APIs)
+	IncludeArchiveAPIs(&APIs)
 
 	log.Debug("Here we go...")
 
@@ -224,6 +231,7 @@ func main() {
 			log.Fatal(err)
 		}
 		AccCache = cache.New(time.Duration(expTime)*time.Minute, time.Duration(verTime)*time.Minute)
+		AccessorCacheListen(connString)
 
 		DBptr = Mydb
 		Mydb.SetMaxOpenConns(maxOpen)
@@ -232,6 +240,10 @@ func main() {
 		if pingerr != nil {
 			log.Fatal(pingerr)
 		}
+
+		WebhookInitialize()
+		ExpirationInitialize()
+		MetricsInitialize()
 	}
 
 	grouter := mux.NewRouter()
@@ -276,12 +288,18 @@ func main() {
 	grouter.HandleFunc("/removeUserExternalAffiliationAttribute", APIs["removeUserExternalAffiliationAttribute"].Run)
 	grouter.HandleFunc("/createUser", APIs["createUser"].Run)
 	grouter.HandleFunc("/dropUser", APIs["dropUser"].Run)
+	grouter.HandleFunc("/mergeUsers", APIs["mergeUsers"].Run)
+	grouter.HandleFunc("/renameUser", APIs["renameUser"].Run)
+	grouter.HandleFunc("/archiveUser", APIs["archiveUser"].Run)
+	grouter.HandleFunc("/getArchivedUser", APIs["getArchivedUser"].Run)
+	grouter.HandleFunc("/restoreUser", APIs["restoreUser"].Run)
 	grouter.HandleFunc("/getUserUname", APIs["getUserUname"].Run)
 	grouter.HandleFunc("/getUserUID", APIs["getUserUID"].Run)
 	grouter.HandleFunc("/getMemberAffiliations", APIs["getMemberAffiliations"].Run)
 	grouter.HandleFunc("/getUserAccessToComputeResources", APIs["getUserAccessToComputeResources"].Run)
 	grouter.HandleFunc("/getStorageQuotas", APIs["getStorageQuotas"].Run)
 	grouter.HandleFunc("/getAllUsers", APIs["getAllUsers"].Run)
+	grouter.HandleFunc("/searchUsers", APIs["searchUsers"].Run)
 	grouter.HandleFunc("/getAllUsersFQANs", APIs["getAllUsersFQANs"].Run)
 	grouter.HandleFunc("/getAllUsersCertificateDNs", APIs["getAllUsersCertificateDNs"].Run)
 	grouter.HandleFunc("/setUserGridAccess", APIs["setUserGridAccess"].Run)
@@ -335,6 +353,7 @@ func main() {
 	grouter.HandleFunc("/ping", APIs["ping"].Run)
 
 	grouter.HandleFunc("/testBaseAPI", APIs["testBaseAPI"].Run)
+	grouter.HandleFunc("/batch", APIs.RunBatch)
 
 	//affiliation unit API calls
 	grouter.HandleFunc("/createAffiliationUnit", APIs["createAffiliationUnit"].Run)
@@ -389,12 +408,41 @@ func main() {
 	grouter.HandleFunc("/deleteAdjustment", APIs["deleteAdjustment"].Run)
 	grouter.HandleFunc("/getProjects", APIs["getProjects"].Run)
 
+	// audit API calls
+	grouter.HandleFunc("/getAuditLog", APIs["getAuditLog"].Run)
+
+	// webhook API calls
+	grouter.HandleFunc("/createWebhook", APIs["createWebhook"].Run)
+	grouter.HandleFunc("/getWebhooks", APIs["getWebhooks"].Run)
+	grouter.HandleFunc("/removeWebhook", APIs["removeWebhook"].Run)
+	grouter.HandleFunc("/getWebhookDeliveries", APIs["getWebhookDeliveries"].Run)
+
+	// accessor API calls
+	grouter.HandleFunc("/createAccessor", APIs["createAccessor"].Run)
+	grouter.HandleFunc("/setAccessorInfo", APIs["setAccessorInfo"].Run)
+	grouter.HandleFunc("/deactivateAccessor", APIs["deactivateAccessor"].Run)
+	grouter.HandleFunc("/getAccessors", APIs["getAccessors"].Run)
+	grouter.HandleFunc("/createAccessorPolicy", APIs["createAccessorPolicy"].Run)
+	grouter.HandleFunc("/removeAccessorPolicy", APIs["removeAccessorPolicy"].Run)
+	grouter.HandleFunc("/getAccessorPolicies", APIs["getAccessorPolicies"].Run)
+	grouter.HandleFunc("/getAccessorCache", APIs["getAccessorCache"].Run)
+	grouter.HandleFunc("/flushAccessorCache", APIs["flushAccessorCache"].Run)
+	grouter.HandleFunc("/reloadServer", APIs["reloadServer"].Run)
+
+	// monitoring
+	grouter.HandleFunc("/metrics", ServeMetrics)
+
+	// Requests derive their context from baseCtx, so canceling it aborts the requests still running at the end of a shutdown
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	Mainsrv = &http.Server{
 		Addr:        srvConfig["port"],
 		ReadTimeout: 10 * time.Second,
 		Handler:     grouter,
 		ConnState:   gatekeeper,
 		ErrorLog:    golog.New(log.StandardLogger().WriterLevel(log.DebugLevel), "", 0),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
 
 	serverRole = srvConfig["role"]
@@ -412,11 +460,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	clientCAs.Store(Certpool)
+
+	serverCert, err := loadServerCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverCertificate.Store(serverCert)
 
-	ValidCAs, err = FetchCAs(srvConfig["cas"])
+	cas, err := FetchCAs(srvConfig["cas"])
 	if err != nil {
 		log.Fatal(err)
 	}
+	validCAs.Store(&cas)
+	RevocationInitialize(srvConfig["cas"])
 
 	// Support only a specific set of ciphers.
 	// Use the constants defined in the tls package.
@@ -437,6 +494,7 @@ func main() {
 		ClientAuth:               tls.VerifyClientCertIfGiven,
 		ClientCAs:                Certpool,
 		GetConfigForClient:       checkClientIP,
+		GetCertificate:           getServerCertificate,
 		Certificates:             nil,
 		MinVersion:               tls.VersionTLS12,
 		InsecureSkipVerify:       false,
@@ -445,10 +503,42 @@ func main() {
 	}
 
 	// We should probably make the cert and key paths variables in a config file at some point
-	log.WithFields(log.Fields{"port": Mainsrv.Addr[1:]}).Infof("Starting FERRY API Database: %s  ldap: %s", dbName, ldapURL)
-	serverror := Mainsrv.ListenAndServeTLS(srvConfig["cert"], srvConfig["key"])
-	if serverror != nil {
+	log.WithFields(log.Fields{"port": Mainsrv.Addr[1:]}).Infof("Starting FERRY API Database: %s  ldap: %s", dbName, ldapConfig.Load().url)
+	shutdownDone := make(chan struct{})
+	go gracefulShutdown(srvConfig["shutdown_timeout"], cancelRequests, shutdownDone)
+
+	ReloadInitialize()
+
+	// The certificate and key are loaded by GetCertificate, so they can be reloaded
+	serverror := Mainsrv.ListenAndServeTLS("", "")
+	if serverror != nil && !errors.Is(serverror, http.ErrServerClosed) {
 		log.Fatal(serverror)
 	}
-	defer Mydb.Close()
+	<-shutdownDone
+	Mydb.Close()
+	log.Info("FERRY API stopped")
+}
+
+// gracefulShutdown stops the server on SIGTERM or SIGINT.  New connections are refused and in-flight requests are
+// drained for up to timeout, after which the remaining requests are canceled.
+func gracefulShutdown(timeout string, cancelRequests context.CancelFunc, done chan struct{}) {
+	defer close(done)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	grace, err := time.ParseDuration(timeout)
+	if err != nil {
+		grace = 30 * time.Second
+	}
+	log.WithFields(log.Fields{"signal": sig.String(), "timeout": grace.String()}).Info("Shutting down, draining requests")
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := Mainsrv.Shutdown(ctx); err != nil {
+		log.Warnf("Shutdown timed out, canceling in-flight requests: %s", err)
+		cancelRequests()
+		Mainsrv.Close()
+	}
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Default histogram buckets, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics collected by the server
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ferry_api_requests_total",
+		Help: "Number of API requests by API, status, access level and error type.",
+	}, []string{"api", "status", "auth_level", "error_type"})
+	apiLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ferry_api_request_duration_seconds",
+		Help:    "Latency of API requests by API.",
+		Buckets: latencyBuckets,
+	}, []string{"api"})
+	accessorCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ferry_accessor_cache_requests_total",
+		Help: "Number of accessor lookups by cache result.",
+	}, []string{"result"})
+	accessorCacheItems = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ferry_accessor_cache_items",
+		Help: "Number of entries in the accessor cache.",
+	}, func() float64 {
+		if AccCache == nil {
+			return 0
+		}
+		return float64(AccCache.ItemCount())
+	})
+	ldapOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ferry_ldap_operations_total",
+		Help: "Number of LDAP operations by operation and status.",
+	}, []string{"operation", "status"})
+	ldapLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ferry_ldap_operation_duration_seconds",
+		Help:    "Latency of LDAP operations by operation.",
+		Buckets: latencyBuckets,
+	}, []string{"operation"})
+	ldapSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ferry_ldap_sync_total",
+		Help: "Number of syncLdapWithFerry runs by outcome.",
+	}, []string{"outcome"})
+	ldapSyncUsers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ferry_ldap_sync_users_total",
+		Help: "Number of users changed by syncLdapWithFerry by action.",
+	}, []string{"action"})
+	ldapSyncLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ferry_ldap_sync_last_success_timestamp_seconds",
+		Help: "Time of the last successful syncLdapWithFerry run.",
+	})
+)
+
+// metricsRegistry holds the metrics returned by /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(apiRequests, apiLatency, accessorCache, accessorCacheItems, ldapOperations, ldapLatency,
+		ldapSyncs, ldapSyncUsers, ldapSyncLastSuccess, dbStatsCollector{})
+}
+
+// dbStats are the statistics of the database connection pool, refreshed every metrics.interval by MetricsInitialize so
+// scrapes never wait on the database
+var dbStats atomic.Pointer[sql.DBStats]
+
+// MetricsInitialize refreshes the database statistics every metrics.interval
+func MetricsInitialize() {
+	interval, err := time.ParseDuration(viper.GetString("metrics.interval"))
+	if err != nil || interval <= 0 {
+		interval = 15 * time.Second
+	}
+
+	go func() {
+		for {
+			if DBptr != nil {
+				stats := DBptr.Stats()
+				dbStats.Store(&stats)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// dbStatsCollector exports the last database statistics stored by MetricsInitialize
+type dbStatsCollector struct{}
+
+var (
+	dbMaxOpen = prometheus.NewDesc("ferry_db_max_open_connections", "Maximum number of open connections to the database.",
+		nil, nil)
+	dbOpen              = prometheus.NewDesc("ferry_db_open_connections", "Number of established connections to the database.", nil, nil)
+	dbInUse             = prometheus.NewDesc("ferry_db_in_use_connections", "Number of connections currently in use.", nil, nil)
+	dbIdle              = prometheus.NewDesc("ferry_db_idle_connections", "Number of idle connections.", nil, nil)
+	dbWaitCount         = prometheus.NewDesc("ferry_db_wait_count_total", "Number of connections waited for.", nil, nil)
+	dbWaitDuration      = prometheus.NewDesc("ferry_db_wait_duration_seconds_total", "Time blocked waiting for a new connection.", nil, nil)
+	dbMaxIdleClosed     = prometheus.NewDesc("ferry_db_max_idle_closed_total", "Number of connections closed due to SetMaxIdleConns.", nil, nil)
+	dbMaxIdleTimeClosed = prometheus.NewDesc("ferry_db_max_idle_time_closed_total", "Number of connections closed due to SetConnMaxIdleTime.", nil, nil)
+	dbMaxLifetimeClosed = prometheus.NewDesc("ferry_db_max_lifetime_closed_total", "Number of connections closed due to SetConnMaxLifetime.", nil, nil)
+)
+
+func (dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbMaxOpen, dbOpen, dbInUse, dbIdle, dbWaitCount, dbWaitDuration, dbMaxIdleClosed,
+		dbMaxIdleTimeClosed, dbMaxLifetimeClosed} {
+		ch <- desc
+	}
+}
+
+func (dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := dbStats.Load()
+	if stats == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(dbMaxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbOpen, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(dbWaitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(dbMaxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(dbMaxIdleTimeClosed, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed))
+	ch <- prometheus.MustNewConstMetric(dbMaxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
+
+// observeAPI records the outcome of an API request
+func observeAPI(c APIContext, success bool, errType ErrorType) {
+	status := "failure"
+	if success {
+		status = "success"
+		errType = HTTP200
+	}
+	apiRequests.WithLabelValues(c.API, status, c.AuthLevel.String(), errType.String()).Inc()
+	apiLatency.WithLabelValues(c.API).Observe(time.Since(c.StartTime).Seconds())
+}
+
+// observeLDAP records the outcome of an LDAP operation
+func observeLDAP(operation string, start time.Time, err error) {
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+	ldapOperations.WithLabelValues(operation, status).Inc()
+	ldapLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// countLdapSync records the outcome of syncLdapWithFerry
+func countLdapSync(f func(APIContext, Input) (interface{}, []APIError)) func(APIContext, Input) (interface{}, []APIError) {
+	return func(c APIContext, i Input) (interface{}, []APIError) {
+		out, apiErr := f(c, i)
+		if c.DryRun != nil {
+			return out, apiErr
+		}
+
+		var changes struct {
+			Removed []interface{} `json:"removedFromLdap"`
+			Added   []interface{} `json:"addedToLdap"`
+			Updated []interface{} `json:"updatedLDAPUserData"`
+		}
+		if out != nil && remarshal(out, &changes) == nil {
+			ldapSyncUsers.WithLabelValues("removed").Add(float64(len(changes.Removed)))
+			ldapSyncUsers.WithLabelValues("added").Add(float64(len(changes.Added)))
+			ldapSyncUsers.WithLabelValues("updated").Add(float64(len(changes.Updated)))
+		}
+
+		if len(apiErr) > 0 {
+			ldapSyncs.WithLabelValues("failure").Inc()
+		} else {
+			ldapSyncs.WithLabelValues("success").Inc()
+			ldapSyncLastSuccess.SetToCurrentTime()
+		}
+		return out, apiErr
+	}
+}
+
+// metricsHandler writes the metrics of the registry in the Prometheus text format
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// ServeMetrics godoc
+// @Summary      Returns the server metrics in the Prometheus text format.
+// @Description  Returns the server metrics in the Prometheus text format: API request counts and latencies by API, access
+// @Description  level and error type, database connection pool statistics, accessor cache hits and misses, LDAP operation
+// @Description  counts and latencies and syncLdapWithFerry outcomes.  Database statistics are refreshed every
+// @Description  metrics.interval, scrapes do not use the database.
+// @Tags         Miscellaneous
+// @Accept       html
+// @Produce      plain
+// @Success      200  {string}  string
+// @Failure      401  {object}  jsonOutput
+// @Router /metrics [get]
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var context APIContext
+	context.StartTime = time.Now()
+	context.R = r
+	context.API = "metrics"
+	context.RequestID = requestID(r)
+	w.Header().Set(RequestIDHeader, context.RequestID)
+
+	authLevel, message, subject, acc := authorize(context, RoleRead)
+	context.AuthRole = RoleRead
+	context.AuthLevel = authLevel
+	context.Subject = subject
+	context.Accessor = acc
+	if authLevel == LevelDenied {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		output := Output{Err: []error{errors.New("client not authorized")}}
+		output.Parse(context, w)
+		observeAPI(context, false, ErrorAuthorization)
+		log.WithFields(QueryFields(context)).Info(message)
+		return
+	}
+	log.WithFields(QueryFields(context)).Debug(message)
+
+	metricsHandler.ServeHTTP(w, r)
+	observeAPI(context, true, HTTP200)
+	log.WithFields(QueryFields(context)).Info("success")
+}
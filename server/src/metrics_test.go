@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func TestServeMetrics(t *testing.T) {
+	testAccessorCache(t)
+	AccCache.Set("192.0.2.1", accessor{name: "192.0.2.1", active: true, accType: "ip_role"}, cache.DefaultExpiration)
+	// A known address that is not an ip_role, so its requests are not authorized
+	AccCache.Set("192.0.2.2", accessor{name: "192.0.2.2", active: true, accType: "dn_role"}, cache.DefaultExpiration)
+
+	previous := dbStats.Swap(&sql.DBStats{OpenConnections: 3})
+	t.Cleanup(func() { dbStats.Store(previous) })
+
+	observeAPI(APIContext{API: "getUserInfo", StartTime: time.Now()}, true, HTTP200)
+
+	tests := []struct {
+		name     string
+		remote   string
+		status   int
+		contains []string
+	}{
+		{"ip_role accessor", "192.0.2.1:4321", http.StatusOK, []string{
+			`ferry_api_requests_total{api="getUserInfo",auth_level="unauthenticated",error_type="none",status="success"} 1`,
+			"ferry_db_open_connections 3",
+			"ferry_accessor_cache_items 2",
+		}},
+		{"client without access", "192.0.2.2:4321", http.StatusUnauthorized, []string{"client not authorized"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			r.RemoteAddr = test.remote
+			w := httptest.NewRecorder()
+
+			ServeMetrics(w, r)
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(w.Body.String(), s) {
+					t.Errorf("expected %q in:\n%s", s, w.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -32,6 +32,7 @@ func IncludeMiscAPIs(c *APICollection) {
 			return out, nil
 		},
 		RolePublic,
+		[]Attribute{UserName, UID},
 	}
 	c.Add("testBaseAPI", &testBaseAPI)
 
@@ -49,6 +50,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		setStorageQuota,
 		RoleWrite,
+		[]Attribute{UnitName, ResourceName, GroupName, UserName},
 	}
 	c.Add("setStorageQuota", &setStorageQuota)
 
@@ -58,10 +60,11 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getGroupGID,
 		RoleRead,
+		[]Attribute{GroupName},
 	}
 	c.Add("getGroupGID", &getGroupGID)
 
-	getGroupFile := BaseAPI{
+	getGroupFile := NativeAPI(
 		InputModel{
 			Parameter{UnitName, false},
 			Parameter{ResourceName, false},
@@ -69,10 +72,12 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getGroupFile,
 		RoleRead,
-	}
+		[]Attribute{UnitName, ResourceName},
+		renderGroupFile,
+	)
 	c.Add("getGroupFile", &getGroupFile)
 
-	getGridMapFile := BaseAPI{
+	getGridMapFile := NativeAPI(
 		InputModel{
 			Parameter{UnitName, false},
 			Parameter{ResourceName, false},
@@ -82,7 +87,9 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getGridMapFile,
 		RoleRead,
-	}
+		[]Attribute{UnitName, ResourceName},
+		renderGridMapFile,
+	)
 	c.Add("getGridMapFile", &getGridMapFile)
 
 	getGridMapFileByVO := BaseAPI{
@@ -93,17 +100,20 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getGridMapFileByVO,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getGridMapFileByVO", &getGridMapFileByVO)
 
-	getVORoleMapFile := BaseAPI{
+	getVORoleMapFile := NativeAPI(
 		InputModel{
 			Parameter{ResourceName, false},
 			Parameter{LastUpdated, false},
 		},
 		getVORoleMapFile,
 		RoleRead,
-	}
+		[]Attribute{ResourceName},
+		renderVORoleMapFile,
+	)
 	c.Add("getVORoleMapFile", &getVORoleMapFile)
 
 	getGroupName := BaseAPI{
@@ -112,6 +122,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getGroupName,
 		RoleRead,
+		nil,
 	}
 	c.Add("getGroupName", &getGroupName)
 
@@ -121,6 +132,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		lookupCertificateDN,
 		RoleWrite,
+		nil,
 	}
 	c.Add("lookupCertificateDN", &lookupCertificateDN)
 
@@ -128,17 +140,20 @@ func IncludeMiscAPIs(c *APICollection) {
 		InputModel{},
 		getMappedGidFile,
 		RoleRead,
+		nil,
 	}
 	c.Add("getMappedGidFile", &getMappedGidFile)
 
-	getStorageAuthzDBFile := BaseAPI{
+	getStorageAuthzDBFile := NativeAPI(
 		InputModel{
 			Parameter{PasswdMode, false},
 			Parameter{LastUpdated, false},
 		},
 		getStorageAuthzDBFile,
 		RoleRead,
-	}
+		nil,
+		renderStorageAuthzDBFile,
+	)
 	c.Add("getStorageAuthzDBFile", &getStorageAuthzDBFile)
 
 	getAffiliationMembersRoles := BaseAPI{
@@ -148,6 +163,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getAffiliationMembersRoles,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getAffiliationMembersRoles", &getAffiliationMembersRoles)
 
@@ -161,6 +177,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		createComputeResource,
 		RoleWrite,
+		[]Attribute{UnitName, ResourceName},
 	}
 	c.Add("createComputeResource", &createComputeResource)
 
@@ -174,6 +191,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		setComputeResourceInfo,
 		RoleWrite,
+		[]Attribute{UnitName, ResourceName},
 	}
 	c.Add("setComputeResourceInfo", &setComputeResourceInfo)
 
@@ -187,6 +205,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		createStorageResource,
 		RoleWrite,
+		[]Attribute{ResourceName},
 	}
 	c.Add("createStorageResource", &createStorageResource)
 
@@ -200,6 +219,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		setStorageResourceInfo,
 		RoleWrite,
+		[]Attribute{ResourceName},
 	}
 	c.Add("setStorageResourceInfo", &setStorageResourceInfo)
 
@@ -209,6 +229,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getStorageResourceInfo,
 		RoleRead,
+		[]Attribute{ResourceName},
 	}
 	c.Add("getStorageResourceInfo", &getStorageResourceInfo)
 
@@ -219,10 +240,11 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getAllComputeResources,
 		RoleRead,
+		nil,
 	}
 	c.Add("getAllComputeResources", &getAllComputeResources)
 
-	getVOUserMap := BaseAPI{
+	getVOUserMap := PagedAPI(
 		InputModel{
 			Parameter{UserName, false},
 			Parameter{UnitName, false},
@@ -230,10 +252,11 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getVOUserMap,
 		RoleRead,
-	}
+		[]Attribute{UnitName, UserName},
+	)
 	c.Add("getVOUserMap", &getVOUserMap)
 
-	getPasswdFile := BaseAPI{
+	getPasswdFile := NativeAPI(
 		InputModel{
 			Parameter{Status, false},
 			Parameter{UnitName, false},
@@ -242,13 +265,16 @@ func IncludeMiscAPIs(c *APICollection) {
 		},
 		getPasswdFile,
 		RoleRead,
-	}
+		[]Attribute{UnitName, ResourceName},
+		renderPasswdFile,
+	)
 	c.Add("getPasswdFile", &getPasswdFile)
 
 	ping := BaseAPI{
 		nil,
 		ping,
 		RolePublic,
+		nil,
 	}
 	c.Add("ping", &ping)
 
@@ -256,6 +282,7 @@ func IncludeMiscAPIs(c *APICollection) {
 		nil,
 		cleanStorageQuotas,
 		RoleWrite,
+		nil,
 	}
 	c.Add("cleanStorageQuotas", &cleanStorageQuotas)
 
@@ -263,16 +290,20 @@ func IncludeMiscAPIs(c *APICollection) {
 		nil,
 		cleanCondorQuotas,
 		RoleWrite,
+		nil,
 	}
 	c.Add("cleanCondorQuotas", &cleanCondorQuotas)
 }
 
 // getPasswdFile godoc
 // @Summary      Returns the contents for a passwd file with all the members of an affiliation unit.
-// @Description  Returns the contents for a passwd file with all the members of an affiliation unit.
+// @Description  Returns the contents for a passwd file with all the members of an affiliation unit.  In the native format,
+// @Description  users are listed once, so the request fails if a user has a different home directory or shell on two of
+// @Description  the resources returned; request a single resourcename then.
 // @Tags         Authorization Queries
 // @Accept       html
-// @Produce      json
+// @Produce      json,plain
+// @Param        format         query     string  false  "json (default) or native to return the file in its native format, also selected by Accept: text/plain"
 // @Param        lastupdated    query     string  false  "limit results to records  updated since"  Format(date)
 // @Param        resourcename   query     string  false  "compute resource to return passwd file data for"
 // @Param        status         query     boolean false  "return only those with the specified status, default all"  Format(true/false)
@@ -402,7 +433,8 @@ func getPasswdFile(c APIContext, i Input) (interface{}, []APIError) {
 // @Description  Returns the contents for a group file for a compute resource assigned to an affiliation unit.
 // @Tags         Authorization Queries
 // @Accept       html
-// @Produce      json
+// @Produce      json,plain
+// @Param        format         query     string  false  "json (default) or native to return the file in its native format, also selected by Accept: text/plain"
 // @Param        lastupdated    query     string  false  "limit results to records  updated since"  Format(date)
 // @Param        resourcename   query     string  false  "compute resource to return group file data for"
 // @Param        unitname       query     string  false  "affiliation to return group file data for""
@@ -505,7 +537,8 @@ func getGroupFile(c APIContext, i Input) (interface{}, []APIError) {
 // @Description  Returns the contents for a gridmap file for a specific experiment and/or a group.
 // @Tags         Authorization Queries
 // @Accept       html
-// @Produce      json
+// @Produce      json,plain
+// @Param        format         query     string  false  "json (default) or native to return the file in its native format, also selected by Accept: text/plain.  The native format lists active users only and is not supported with jwt"
 // @Param        jwt            query     string  false  "When exists, output the new token supporting format"
 // @Param        lastupdated    query     string  false  "limit results to records  updated since"  Format(date)
 // @Param        resourcename   query     string  false  "compute resource to return gridmap file data for"
@@ -552,7 +585,8 @@ func getGridMapFile(c APIContext, i Input) (interface{}, []APIError) {
 							   where (unitid = $1 or $1 is null)
 							     and (compid = $2 or $2 is null)
 								 and (ac.last_updated>=$3 or uc.last_updated>=$3 or us.last_updated>=$3 or $3 is null)
-								 and (us.status = $4 or $4 is null)`,
+								 and (us.status = $4 or $4 is null)
+								 order by dn`,
 		unitid, compid, i[LastUpdated], i[Status])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -623,7 +657,8 @@ func getJWTGridMapFile(c APIContext, i Input) (interface{}, []APIError) {
 							   where (unitid = $1 or $1 is null)
 							     and (compid = $2 or $2 is null)
 								 and (uac.last_updated>=$3 or us.last_updated>=$3 or $3 is null)
-								 and (us.status = $4 or $4 is null)`,
+								 and (us.status = $4 or $4 is null)
+								 order by subject`,
 		unitid, compid, i[LastUpdated], i[Status])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -689,7 +724,8 @@ func getGridMapFileByVO(c APIContext, i Input) (interface{}, []APIError) {
 								left join users as us using(uid)
 								left join affiliation_units as au using(unitid)
 								where (unitid = $1 or $1 is null) and (ac.last_updated >= $2 or uc.last_updated >= $2 or
-									   us.last_updated >= $2 or au.last_updated >= $2 or $2 is null)`,
+									   us.last_updated >= $2 or au.last_updated >= $2 or $2 is null)
+									   order by name`,
 		unitid, i[LastUpdated])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -751,7 +787,8 @@ func getJWTGridMapFileByVO(c APIContext, i Input) (interface{}, []APIError) {
 								  left join affiliation_units as au using(unitid)
 							   where (unitid = $1 or $1 is null)
 								  and (uac.last_updated>=$2 or us.last_updated>=$2 or $2 is null)
-								  and (us.status = $3 or $3 is null)`,
+								  and (us.status = $3 or $3 is null)
+								  order by name`,
 		unitid, i[LastUpdated], i[Status])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -782,7 +819,8 @@ func getJWTGridMapFileByVO(c APIContext, i Input) (interface{}, []APIError) {
 // @Description  Returns the contents for a grid-vorolemap file for a specific experiment and/or a group.
 // @Tags         Authorization Queries
 // @Accept       html
-// @Produce      json
+// @Produce      json,plain
+// @Param        format         query     string  false  "json (default) or native to return the file in its native format, also selected by Accept: text/plain"
 // @Param        lastupdated    query     string  false  "limit results to records  updated since"  Format(date)
 // @Param        resourcename   query     string  false  "compute resource to return gridmap file data for"
 // @Success      200  {object}  miscVORoleMapFile
@@ -805,12 +843,13 @@ func getVORoleMapFile(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select distinct fqan, uname, name
+	rows, err := c.DBtx.Query(`select distinct fqan, uname, name
 								from grid_fqan as gf
 								join users as u on gf.mapped_user = u.uid
 								join compute_access_group as cag on (cag.groupid=gf.mapped_group and gf.mapped_user=cag.uid)
 								left join affiliation_units using(unitid)
-							  where (compid = $1 or $1 is null) and (gf.last_updated >= $2 or u.last_updated >= $2 or $2 is null)`,
+							  where (compid = $1 or $1 is null) and (gf.last_updated >= $2 or u.last_updated >= $2 or $2 is null)
+							  order by fqan`,
 		compid, i[LastUpdated])
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -975,7 +1014,8 @@ func getMappedGidFile(c APIContext, i Input) (interface{}, []APIError) {
 
 	rows, err := c.DBtx.Query(`select fqan, uname, gid from grid_fqan as gf
 							   left join groups as g on g.groupid = gf.mapped_group
-							   left join users as u on u.uid = gf.mapped_user`)
+							   left join users as u on u.uid = gf.mapped_user
+							   order by fqan`)
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1017,7 +1057,8 @@ func getMappedGidFile(c APIContext, i Input) (interface{}, []APIError) {
 // @Description  on the the parameter passwdmode.  (Now how do you show that in swagger?)
 // @Tags         Authorization Queries
 // @Accept       html
-// @Produce      json
+// @Produce      json,plain
+// @Param        format         query     string  false  "json (default) or native to return the file in its native format, also selected by Accept: text/plain"
 // @Param        lastupdated    query     string  false  "limit results to records  updated since"  Format(date)
 // @Param        passwdmode     query     string  false  "Changes the JSON struct output.  Why?  I have no idea."
 // @Failure      400  {object}  jsonOutput
@@ -1156,12 +1197,13 @@ func getAffiliationMembersRoles(c APIContext, i Input) (interface{}, []APIError)
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select name, fqan, uname, full_name, token_subject, uid
+	rows, err := c.DBtx.Query(`select name, fqan, uname, full_name, token_subject, uid
 								from grid_access
 								join grid_fqan using(fqanid)
 								join users using(uid)
 								left join affiliation_units using(unitid)
-							  where (unitid = $1 or $1 is null) and (lower(fqan) like lower($2))`,
+							  where (unitid = $1 or $1 is null) and (lower(fqan) like lower($2))
+							  order by name`,
 		unitid, "%/role="+role.Data.(string)+"/%")
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -1519,7 +1561,7 @@ func getAllComputeResources(c APIContext, i Input) (interface{}, []APIError) {
 		}
 	}
 
-	rows, err := DBptr.Query(`select cr.name, default_shell, default_home_dir, cr.type, au.name
+	rows, err := c.DBtx.Query(`select cr.name, default_shell, default_home_dir, cr.type, au.name
 							  from compute_resources as cr
 							  left join affiliation_units as au using(unitid)
 							  where (cr.last_updated>=$1 or $1 is null)
@@ -1566,7 +1608,7 @@ func ping(c APIContext, i Input) (interface{}, []APIError) {
 	const BuildDate Attribute = "builddate"
 	const Server Attribute = "server"
 
-	rows, err := DBptr.Query(`select now();`)
+	rows, err := c.DBtx.Query(`select now();`)
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1586,6 +1628,10 @@ func ping(c APIContext, i Input) (interface{}, []APIError) {
 // @Param        fqan       query     string  false  "restrict returned data to a specific fqan"
 // @Param        unitname   query     string  false  "restrict returned data to a specific affiliatiion"
 // @Param        username   query     string  false  "restruct returned data to a specific user"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
 // @Success      200  {object}  miscVOUserMap
 // @Failure      400  {object}  jsonOutput
 // @Failure      401  {object}  jsonOutput
@@ -1621,22 +1667,35 @@ func getVOUserMap(c APIContext, i Input) (interface{}, []APIError) {
 	unit := i[UnitName].Default("%")
 	fqan := i[FQAN].Default("%")
 
-	rows, err := DBptr.Query(`select distinct
-								u1.uname as username,
-								au.name as unitname,
-								gf.fqan as fqan,
-								coalesce(u2.uname, u1.uname) as mapped_user
-							  from
-								grid_access g
-								join users u1 using(uid)
-								join grid_fqan gf using(fqanid)
-								join affiliation_units au using(unitid)
-								left outer join users u2 on gf.mapped_user = u2.uid
-							  where
-								u1.uname like $1
-								and au.name like $2
-								and gf.fqan like $3
-							  order by u1.uname`, user, unit, fqan)
+	page, apiErr := newPage(i, map[Attribute]string{UserName: "username"}, UserName, "uid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(4)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`with mappings as (
+								select distinct
+								  u1.uid,
+								  u1.uname as username,
+								  au.name as unitname,
+								  gf.fqan as fqan,
+								  coalesce(u2.uname, u1.uname) as mapped_user
+								from
+								  grid_access g
+								  join users u1 using(uid)
+								  join grid_fqan gf using(fqanid)
+								  join affiliation_units au using(unitid)
+								  left outer join users u2 on gf.mapped_user = u2.uid
+								where
+								  u1.uname like $1
+								  and au.name like $2
+								  and gf.fqan like $3
+							  ), page as (
+								select uid, username from mappings where %s group by uid, username %s %s
+							  )
+							  select %s, username, unitname, fqan, mapped_user from mappings join page using(uid, username)
+							  %s, unitname, fqan`, after, page.orderBy(), page.limitBy(), page.columns(), page.orderBy()),
+		append([]interface{}{user, unit, fqan}, args...)...)
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1644,24 +1703,31 @@ func getVOUserMap(c APIContext, i Input) (interface{}, []APIError) {
 	}
 	defer rows.Close()
 
-	out := make(map[string]map[string]map[string]interface{})
+	out := newOrderedMap()
 
 	for rows.Next() {
+		var sortValue, sortKey string
 		row := NewMapNullAttribute(UserName, UnitName, FQAN, UserAttribute)
-		rows.Scan(row[UserName], row[UnitName], row[FQAN], row[UserAttribute])
+		rows.Scan(&sortValue, &sortKey, row[UserName], row[UnitName], row[FQAN], row[UserAttribute])
 
 		if row[UserName].Valid {
-			if _, ok := out[row[UserName].Data.(string)]; !ok {
-				out[row[UserName].Data.(string)] = make(map[string]map[string]interface{})
+			units, found := out.Get(row[UserName].Data.(string))
+			if !found {
+				if !page.add(sortValue, sortKey) {
+					break
+				}
+				units = make(map[string]map[string]interface{})
+				out.Set(row[UserName].Data.(string), units)
 			}
-			if _, ok := out[row[UserName].Data.(string)][row[UnitName].Data.(string)]; !ok {
-				out[row[UserName].Data.(string)][row[UnitName].Data.(string)] = make(map[string]interface{})
+			userUnits := units.(map[string]map[string]interface{})
+			if _, ok := userUnits[row[UnitName].Data.(string)]; !ok {
+				userUnits[row[UnitName].Data.(string)] = make(map[string]interface{})
 			}
-			out[row[UserName].Data.(string)][row[UnitName].Data.(string)][row[FQAN].Data.(string)] = row[UserAttribute].Data
+			userUnits[row[UnitName].Data.(string)][row[FQAN].Data.(string)] = row[UserAttribute].Data
 		}
 	}
 
-	return out, nil
+	return page.output(out), nil
 }
 
 // cleanStorageQuotas godoc
@@ -94,3 +94,19 @@ type miscComputeResources []struct {
 
 type miscVOUserMap map[string]map[string]struct {
 }
+
+type auditLogEntry []struct {
+	AuditID      int                    `json:"auditid"`
+	API          string                 `json:"api"`
+	Subject      string                 `json:"subject"`
+	AuthLevel    string                 `json:"authlevel"`
+	ClientIP     string                 `json:"clientip"`
+	ProxyIP      string                 `json:"proxyip"`
+	Input        map[string]interface{} `json:"input"`
+	UID          int                    `json:"uid"`
+	UserName     string                 `json:"username"`
+	GroupName    string                 `json:"groupname"`
+	UnitName     string                 `json:"unitname"`
+	ResourceName string                 `json:"resourcename"`
+	EventTime    string                 `json:"eventtime"`
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// pagedOutput is returned by paged APIs to carry the cursor of the next page
+type pagedOutput struct {
+	Out        interface{}
+	NextCursor string
+}
+
+// pageCursor is the keyset position of the last record of a page
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Key   string `json:"k"`
+}
+
+// page is the keyset pagination of a paged API query, built from its limit, cursor and sort parameters
+type page struct {
+	sort       string
+	column     string
+	key        string
+	descending bool
+	limit      int64
+	cursor     *pageCursor
+	count      int64
+	last       pageCursor
+	next       string
+}
+
+// PagedAPI builds a BaseAPI supporting the limit, cursor, sort and fields parameters.
+// The QueryFunction reads the limit, cursor and sort parameters with newPage and returns the records of the page with
+// page.output.  The fields parameter is applied to the records returned.
+func PagedAPI(m InputModel, f func(APIContext, Input) (interface{}, []APIError), role AccessRole, scope []Attribute) BaseAPI {
+	model := append(m[:len(m):len(m)],
+		Parameter{Limit, false},
+		Parameter{Cursor, false},
+		Parameter{Sort, false},
+		Parameter{Fields, false},
+	)
+
+	paged := func(c APIContext, i Input) (interface{}, []APIError) {
+		out, apiErr := f(c, i)
+		if len(apiErr) > 0 || !i[Fields].Valid {
+			return out, apiErr
+		}
+
+		fields := make(map[string]bool)
+		for _, f := range strings.Split(i[Fields].Data.(string), ",") {
+			fields[strings.TrimSpace(f)] = true
+		}
+		if p, ok := out.(pagedOutput); ok {
+			p.Out = projectOutput(p.Out, fields)
+			return p, nil
+		}
+		return projectOutput(out, fields), nil
+	}
+
+	return BaseAPI{model, paged, role, scope}
+}
+
+// newPage parses the limit, cursor and sort parameters of a paged API.  columns maps the fields the records can be
+// sorted by to their SQL expression, which must not be null, and defaultSort is the field used when no sort is
+// requested.  key is the SQL expression of a unique key of the records, used to order records with the same value.
+func newPage(i Input, columns map[Attribute]string, defaultSort Attribute, key string) (*page, []APIError) {
+	var apiErr []APIError
+
+	p := page{sort: i[Sort].Default(string(defaultSort)).Data.(string), key: key}
+	p.descending = strings.HasPrefix(p.sort, "-")
+
+	column, found := columns[Attribute(strings.TrimPrefix(p.sort, "-"))]
+	if !found {
+		var names []string
+		for name := range columns {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, fmt.Sprintf("this api can only be sorted by %s", strings.Join(names, ", "))))
+		return nil, apiErr
+	}
+	p.column = column
+
+	if i[Limit].Valid {
+		p.limit = i[Limit].Data.(int64)
+		if p.limit < 1 {
+			apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, Limit))
+			return nil, apiErr
+		}
+	}
+
+	if i[Cursor].Valid {
+		p.cursor = new(pageCursor)
+		raw, err := base64.RawURLEncoding.DecodeString(i[Cursor].Data.(string))
+		if err == nil {
+			err = json.Unmarshal(raw, p.cursor)
+		}
+		if err != nil || p.cursor.Sort != p.sort {
+			apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, Cursor))
+			return nil, apiErr
+		}
+	}
+
+	return &p, nil
+}
+
+// columns returns the SQL select list of the sort value and key of a record as text, to be passed to add
+func (p *page) columns() string {
+	return fmt.Sprintf("cast(%s as text), cast(%s as text)", p.column, p.key)
+}
+
+// where returns the SQL condition selecting the records following the cursor and its arguments, numbered from n
+func (p *page) where(n int) (string, []interface{}) {
+	if p.cursor == nil {
+		return "true", nil
+	}
+	operator := ">"
+	if p.descending {
+		operator = "<"
+	}
+	return fmt.Sprintf("(%s %s $%d or (%s = $%d and %s > $%d))", p.column, operator, n, p.column, n, p.key, n+1),
+		[]interface{}{p.cursor.Value, p.cursor.Key}
+}
+
+// orderBy returns the SQL order by clause of the page.  Records with the same value are always ordered by ascending key.
+func (p *page) orderBy() string {
+	direction := "asc"
+	if p.descending {
+		direction = "desc"
+	}
+	return fmt.Sprintf("order by %s %s, %s", p.column, direction, p.key)
+}
+
+// limitBy returns the SQL limit clause of the page.  One more record than the limit is selected to know whether there
+// is a next page.
+func (p *page) limitBy() string {
+	if p.limit == 0 {
+		return ""
+	}
+	return fmt.Sprintf("limit %d", p.limit+1)
+}
+
+// add counts a record of the page with its sort value and key, as selected by columns.  It returns false for the
+// record following the last one of the page, which is left out of the output and marks that there is a next page.
+func (p *page) add(value string, key string) bool {
+	if p.limit > 0 && p.count == p.limit {
+		encoded, _ := json.Marshal(p.last)
+		p.next = base64.RawURLEncoding.EncodeToString(encoded)
+		return false
+	}
+	p.count++
+	p.last = pageCursor{p.sort, value, key}
+	return true
+}
+
+// output returns the records of the page with the cursor of the next page
+func (p *page) output(out interface{}) pagedOutput {
+	return pagedOutput{out, p.next}
+}
+
+// orderedMap is a JSON object which keeps its keys in the order they were added, so map outputs stay sorted
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// newOrderedMap builds an empty orderedMap
+func newOrderedMap() *orderedMap {
+	return &orderedMap{values: make(map[string]interface{})}
+}
+
+// Get returns the value of a key
+func (m *orderedMap) Get(key string) (interface{}, bool) {
+	value, found := m.values[key]
+	return value, found
+}
+
+// Set sets the value of a key, adding the key after the existing ones if it is new
+func (m *orderedMap) Set(key string, value interface{}) {
+	if _, found := m.values[key]; !found {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// MarshalJSON encodes the map as a JSON object with its keys in order
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for n, key := range m.keys {
+		if n > 0 {
+			buffer.WriteByte(',')
+		}
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		encodedValue, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(encodedKey)
+		buffer.WriteByte(':')
+		buffer.Write(encodedValue)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// projectOutput keeps only the requested fields of the records of a paged output
+func projectOutput(out interface{}, fields map[string]bool) interface{} {
+	if m, ok := out.(*orderedMap); ok {
+		projected := newOrderedMap()
+		for _, key := range m.keys {
+			projected.Set(key, project(reflect.ValueOf(m.values[key]), fields).Interface())
+		}
+		return projected
+	}
+
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Slice {
+		return out
+	}
+	projected := reflect.MakeSlice(v.Type(), 0, v.Len())
+	for n := 0; n < v.Len(); n++ {
+		projected = reflect.Append(projected, project(v.Index(n), fields))
+	}
+	return projected.Interface()
+}
+
+// project keeps only the requested fields of a record, or of each record in a list
+func project(v reflect.Value, fields map[string]bool) reflect.Value {
+	record := v
+	for record.Kind() == reflect.Interface {
+		record = record.Elem()
+	}
+
+	switch {
+	case record.Kind() == reflect.Map && record.Type().Key().Kind() == reflect.String:
+		projected := reflect.MakeMap(record.Type())
+		for _, k := range record.MapKeys() {
+			if fields[k.String()] {
+				projected.SetMapIndex(k, record.MapIndex(k))
+			}
+		}
+		return projected
+	case record.Kind() == reflect.Slice:
+		projected := reflect.MakeSlice(record.Type(), 0, record.Len())
+		for n := 0; n < record.Len(); n++ {
+			projected = reflect.Append(projected, project(record.Index(n), fields))
+		}
+		return projected
+	}
+
+	return v
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testColumns = map[Attribute]string{
+	UserName: "u.uname",
+	UID:      "u.uid",
+}
+
+func testPageInput(sort, limit, cursor string) Input {
+	i := Input{
+		Sort:   NewNullAttribute(Sort),
+		Limit:  NewNullAttribute(Limit),
+		Cursor: NewNullAttribute(Cursor),
+	}
+	for attribute, value := range map[Attribute]string{Sort: sort, Limit: limit, Cursor: cursor} {
+		if value != "" {
+			i[attribute] = i[attribute].Default(value)
+		}
+	}
+	return i
+}
+
+func testCursor(c pageCursor) string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func TestNewPage(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      Input
+		err        string
+		column     string
+		descending bool
+		limit      int64
+	}{
+		{"default sort", testPageInput("", "", ""), "", "u.uname", false, 0},
+		{"descending sort", testPageInput("-uid", "", ""), "", "u.uid", true, 0},
+		{"limit", testPageInput("", "10", ""), "", "u.uname", false, 10},
+		{"unknown sort", testPageInput("groupname", "", ""), "this api can only be sorted by uid, username", "", false, 0},
+		{"zero limit", testPageInput("", "0", ""), DefaultAPIError(ErrorInvalidData, Limit).Error.Error(), "", false, 0},
+		{"bad cursor", testPageInput("", "", "not a cursor"), DefaultAPIError(ErrorInvalidData, Cursor).Error.Error(), "", false, 0},
+		{"cursor of another sort", testPageInput("uid", "", testCursor(pageCursor{"username", "jdoe", "1"})),
+			DefaultAPIError(ErrorInvalidData, Cursor).Error.Error(), "", false, 0},
+		{"cursor", testPageInput("", "", testCursor(pageCursor{"username", "jdoe", "1"})), "", "u.uname", false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, apiErr := newPage(test.input, testColumns, UserName, "u.uid")
+			if test.err != "" {
+				if len(apiErr) != 1 || apiErr[0].Error.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, apiErr)
+				}
+				return
+			}
+			if len(apiErr) > 0 {
+				t.Fatalf("unexpected error %v", apiErr)
+			}
+			if p.column != test.column || p.descending != test.descending || p.limit != test.limit {
+				t.Errorf("got column %q, descending %t, limit %d", p.column, p.descending, p.limit)
+			}
+		})
+	}
+}
+
+func TestPageClauses(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   Input
+		where   string
+		args    []interface{}
+		orderBy string
+		limitBy string
+	}{
+		{"first page", testPageInput("", "", ""), "true", nil, "order by u.uname asc, u.uid", ""},
+		{"next page", testPageInput("", "5", testCursor(pageCursor{"username", "jdoe", "7"})),
+			"(u.uname > $3 or (u.uname = $3 and u.uid > $4))", []interface{}{"jdoe", "7"}, "order by u.uname asc, u.uid", "limit 6"},
+		{"descending", testPageInput("-uid", "1", testCursor(pageCursor{"-uid", "7", "7"})),
+			"(u.uid < $3 or (u.uid = $3 and u.uid > $4))", []interface{}{"7", "7"}, "order by u.uid desc, u.uid", "limit 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, apiErr := newPage(test.input, testColumns, UserName, "u.uid")
+			if len(apiErr) > 0 {
+				t.Fatalf("unexpected error %v", apiErr)
+			}
+			where, args := p.where(3)
+			if where != test.where || !reflect.DeepEqual(args, test.args) {
+				t.Errorf("where: got %q %v", where, args)
+			}
+			if orderBy := p.orderBy(); orderBy != test.orderBy {
+				t.Errorf("orderBy: got %q", orderBy)
+			}
+			if limitBy := p.limitBy(); limitBy != test.limitBy {
+				t.Errorf("limitBy: got %q", limitBy)
+			}
+		})
+	}
+}
+
+func TestPageAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   string
+		records []string
+		added   int
+		next    string
+	}{
+		{"no limit", "", []string{"a", "b", "c"}, 3, ""},
+		{"last page", "3", []string{"a", "b", "c"}, 3, ""},
+		{"next page", "2", []string{"a", "b", "c"}, 2, testCursor(pageCursor{"username", "b", "b"})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, apiErr := newPage(testPageInput("", test.limit, ""), testColumns, UserName, "u.uid")
+			if len(apiErr) > 0 {
+				t.Fatalf("unexpected error %v", apiErr)
+			}
+			var out []string
+			for _, record := range test.records {
+				if !p.add(record, record) {
+					break
+				}
+				out = append(out, record)
+			}
+			output := p.output(out)
+			if len(out) != test.added || output.NextCursor != test.next {
+				t.Errorf("got %v with next cursor %q", out, output.NextCursor)
+			}
+		})
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	tests := []struct {
+		name string
+		sets [][2]interface{}
+		json string
+	}{
+		{"empty", nil, `{}`},
+		{"insertion order", [][2]interface{}{{"b", 1}, {"a", "x"}}, `{"b":1,"a":"x"}`},
+		{"update keeps order", [][2]interface{}{{"b", 1}, {"a", 2}, {"b", 3}}, `{"b":3,"a":2}`},
+		{"nested", [][2]interface{}{{"k", []string{"v"}}}, `{"k":["v"]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newOrderedMap()
+			for _, set := range test.sets {
+				m.Set(set[0].(string), set[1])
+			}
+			encoded, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(encoded) != test.json {
+				t.Errorf("got %s", encoded)
+			}
+		})
+	}
+}
+
+func TestProjectOutput(t *testing.T) {
+	fields := map[string]bool{"username": true}
+	records := []map[string]interface{}{{"username": "jdoe", "uid": 1}}
+	projected := projectOutput(records, fields)
+	expected := []map[string]interface{}{{"username": "jdoe"}}
+	if !reflect.DeepEqual(projected, expected) {
+		t.Errorf("got %v", projected)
+	}
+
+	m := newOrderedMap()
+	m.Set("jdoe", []map[string]interface{}{{"username": "jdoe", "uid": 1}})
+	encoded, _ := json.Marshal(projectOutput(m, fields))
+	if string(encoded) != `{"jdoe":[{"username":"jdoe"}]}` {
+		t.Errorf("got %s", encoded)
+	}
+}
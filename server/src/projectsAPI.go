@@ -22,6 +22,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		createProject,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("createProject", &createProject)
 
@@ -35,6 +36,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		editProject,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("editProject", &editProject)
 
@@ -48,6 +50,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		deleteProject,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("deleteProject", &deleteProject)
 
@@ -60,6 +63,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		createAllocation,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("createAllocation", &createAllocation)
 
@@ -73,6 +77,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		editAllocation,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("editAllocation", &editAllocation)
 
@@ -84,6 +89,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		deleteAllocation,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("deleteAllocation", &deleteAllocation)
 
@@ -98,6 +104,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		addAdjustment,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("addAdjustment", &addAdjustment)
 
@@ -110,6 +117,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		deleteAdjustment,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("deleteAdjustment", &deleteAdjustment)
 
@@ -122,6 +130,7 @@ func IncludeAllocationAPIs(c *APICollection) {
 		},
 		getProjects,
 		RoleRead,
+		[]Attribute{GroupName},
 	}
 	c.Add("getProjects", &getProjects)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ForwardedForHeader is the header trusted proxies use to pass the IP address of the client
+const ForwardedForHeader = "X-Forwarded-For"
+
+// proxyConfig holds the reverse proxies allowed to pass the client identity in headers
+type proxyConfig struct {
+	// networks are the networks of the trusted proxies
+	networks []*net.IPNet
+	// dnHeader is the header trusted proxies use to pass the DN of the client certificate
+	dnHeader string
+}
+
+// trustedProxies are the trusted proxies loaded by the last reload
+var trustedProxies atomic.Pointer[proxyConfig]
+
+// ProxyInitialize reads the trusted reverse proxies from the proxies section of the configuration
+func ProxyInitialize() error {
+	proxies, err := loadTrustedProxies()
+	if err != nil {
+		return err
+	}
+	trustedProxies.Store(proxies)
+
+	if len(proxies.networks) > 0 {
+		log.WithFields(log.Fields{"proxies": viper.GetStringSlice("proxies.trusted"), "dn_header": proxies.dnHeader}).Info("Trusting reverse proxies.")
+		log.Warning("the revocation of certificates passed by trusted proxies is not checked, the proxies must check it")
+	}
+	return nil
+}
+
+// loadTrustedProxies returns the networks and the DN header of the trusted proxies in the configuration
+func loadTrustedProxies() (*proxyConfig, error) {
+	var networks []*net.IPNet
+	for _, proxy := range viper.GetStringSlice("proxies.trusted") {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %s", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+
+	header := viper.GetString("proxies.dn_header")
+	if header == "" {
+		header = "X-SSL-Client-S-DN"
+	}
+	return &proxyConfig{networks, header}, nil
+}
+
+// parseNetwork parses an IP address or a CIDR network, a single address is a network of one
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// isTrustedProxy checks if an IP address belongs to a trusted reverse proxy
+func isTrustedProxy(ip string) bool {
+	return trustedProxies.Load().trusts(ip)
+}
+
+// trusts checks if an IP address belongs to one of the proxies
+func (p *proxyConfig) trusts(ip string) bool {
+	addr := net.ParseIP(ip)
+	if p == nil || addr == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClient returns the IP address of the client making a request and, when the request comes through a trusted
+// proxy, the IP address of the proxy.  The client is the last address in X-Forwarded-For not belonging to a trusted
+// proxy, so clients cannot forge their address by sending the header themselves.  The client is empty when a trusted
+// proxy does not pass an address outside the trusted proxies, so the request is never authorized as the proxy.
+func requestClient(r *http.Request) (string, string) {
+	return trustedProxies.Load().client(r)
+}
+
+// client returns the IP address of the client making a request and of the proxy it came through, if any
+func (p *proxyConfig) client(r *http.Request) (string, string) {
+	remote := clientIP(r.RemoteAddr)
+	if !p.trusts(remote) {
+		return remote, ""
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values(ForwardedForHeader), ","), ",")
+	for n := len(forwarded) - 1; n >= 0; n-- {
+		ip := clientIP(strings.TrimSpace(forwarded[n]))
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		if !p.trusts(ip) {
+			return ip, remote
+		}
+	}
+	return "", remote
+}
+
+// requestDNs returns the DNs of the client certificates of a request.  Requests coming through a trusted proxy are
+// identified by the DN the proxy passes in its header, never by the certificate of the proxy itself.  Only the DN is
+// passed, so the proxy is responsible for rejecting revoked certificates.
+func requestDNs(r *http.Request) []string {
+	var dns []string
+	proxies := trustedProxies.Load()
+	if _, proxy := proxies.client(r); proxy != "" {
+		if header := strings.TrimSpace(r.Header.Get(proxies.dnHeader)); header != "" {
+			if dn, ok := proxyDN(header); ok {
+				dns = append(dns, dn)
+			} else {
+				log.WithFields(log.Fields{"proxy": proxy, "dn": header}).Warn("ignoring malformed DN passed by proxy")
+			}
+		}
+		return dns
+	}
+
+	if r.TLS == nil {
+		return dns
+	}
+	for _, presCert := range r.TLS.PeerCertificates {
+		dns = append(dns, parseDN(presCert.Subject.Names, "/"))
+	}
+	return dns
+}
+
+// proxyDN converts a DN passed by a proxy to the format returned by parseDN.  Proxies pass either the OpenSSL
+// /-separated format, used as is, or the RFC 2253 format, which lists the attributes in reverse order.
+func proxyDN(dn string) (string, bool) {
+	if strings.HasPrefix(dn, "/") {
+		return dn, true
+	}
+
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return "", false
+	}
+	var subject []string
+	for n := len(parsed.RDNs) - 1; n >= 0; n-- {
+		for _, a := range parsed.RDNs[n].Attributes {
+			subject = append(subject, fmt.Sprintf("%s=%s", a.Type, a.Value))
+		}
+	}
+	return "/" + strings.Join(subject, "/"), true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func testProxies(t *testing.T, proxies ...string) {
+	var config proxyConfig
+	config.dnHeader = "X-SSL-Client-S-DN"
+	for _, proxy := range proxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.networks = append(config.networks, network)
+	}
+	previous := trustedProxies.Swap(&config)
+	t.Cleanup(func() { trustedProxies.Store(previous) })
+}
+
+func TestRequestClient(t *testing.T) {
+	testProxies(t, "10.0.0.0/24", "2001:db8::1")
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		client    string
+		proxy     string
+	}{
+		{"direct client", "203.0.113.5:4321", nil, "203.0.113.5", ""},
+		{"spoofed header from an untrusted peer", "203.0.113.5:4321", []string{"198.51.100.7"}, "203.0.113.5", ""},
+		{"trusted proxy", "10.0.0.1:4321", []string{"203.0.113.5"}, "203.0.113.5", "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:4321", []string{"203.0.113.5, 10.0.0.3", "10.0.0.2"}, "203.0.113.5", "10.0.0.1"},
+		{"spoofed address before the client", "10.0.0.1:4321", []string{"198.51.100.7, 203.0.113.5, 10.0.0.2"}, "203.0.113.5", "10.0.0.1"},
+		{"IPv6 proxy and client", "[2001:db8::1]:4321", []string{"2001:db8:0:0::5"}, "2001:db8::5", "2001:db8::1"},
+		{"only trusted proxies", "10.0.0.1:4321", []string{"10.0.0.2"}, "", "10.0.0.1"},
+		{"trusted proxy without header", "10.0.0.1:4321", nil, "", "10.0.0.1"},
+		{"malformed address", "10.0.0.1:4321", []string{"unknown"}, "", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/getUserInfo", nil)
+			r.RemoteAddr = test.remote
+			for _, header := range test.forwarded {
+				r.Header.Add(ForwardedForHeader, header)
+			}
+
+			client, proxy := requestClient(r)
+			if client != test.client || proxy != test.proxy {
+				t.Errorf("expected client %q proxy %q, got %q %q", test.client, test.proxy, client, proxy)
+			}
+		})
+	}
+}
+
+func TestAuthorizeProxyWithoutClient(t *testing.T) {
+	testProxies(t, "10.0.0.0/24")
+	testAccessorCache(t)
+
+	// The proxy is itself an ip_role accessor, which must not authorize the clients it does not identify
+	AccCache.Set("10.0.0.1", accessor{name: "10.0.0.1", active: true, write: true, accType: "ip_role"}, cache.DefaultExpiration)
+
+	tests := []struct {
+		name      string
+		forwarded []string
+	}{
+		{"without header", nil},
+		{"only trusted proxies", []string{"10.0.0.2"}},
+		{"malformed address", []string{"unknown"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/getUserInfo", nil)
+			r.RemoteAddr = "10.0.0.1:4321"
+			for _, header := range test.forwarded {
+				r.Header.Add(ForwardedForHeader, header)
+			}
+
+			level, message, _, _ := authorize(APIContext{R: r, API: "getUserInfo", StartTime: time.Now()}, RoleRead)
+			if level != LevelDenied {
+				t.Errorf("expected the request to be denied, got %s: %s", level, message)
+			}
+		})
+	}
+}
+
+func TestRequestDNs(t *testing.T) {
+	testProxies(t, "10.0.0.1")
+
+	cert := &x509.Certificate{Subject: pkix.Name{Names: []pkix.AttributeTypeAndValue{
+		{Type: []int{2, 5, 4, 10}, Value: "Example"},
+		{Type: []int{2, 5, 4, 3}, Value: "peer.example.com"},
+	}}}
+
+	tests := []struct {
+		name   string
+		remote string
+		header string
+		tls    bool
+		dns    []string
+	}{
+		{"certificate", "203.0.113.5:4321", "", true, []string{"/O=Example/CN=peer.example.com"}},
+		{"DN header from a non-proxy peer", "203.0.113.5:4321", "/O=Forged/CN=admin", true, []string{"/O=Example/CN=peer.example.com"}},
+		{"DN header from a non-proxy peer without certificate", "203.0.113.5:4321", "/O=Forged/CN=admin", false, nil},
+		{"DN header from a proxy", "10.0.0.1:4321", "/O=Example/CN=client.example.com", true, []string{"/O=Example/CN=client.example.com"}},
+		{"RFC 2253 DN header from a proxy", "10.0.0.1:4321", "CN=client.example.com,O=Example", true, []string{"/O=Example/CN=client.example.com"}},
+		{"proxy without DN header", "10.0.0.1:4321", "", true, nil},
+		{"malformed DN header from a proxy", "10.0.0.1:4321", "not a DN", true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/getUserInfo", nil)
+			r.RemoteAddr = test.remote
+			if test.header != "" {
+				r.Header.Set("X-SSL-Client-S-DN", test.header)
+			}
+			r.TLS = nil
+			if test.tls {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			}
+
+			if dns := requestDNs(r); !reflect.DeepEqual(dns, test.dns) {
+				t.Errorf("expected DNs %v, got %v", test.dns, dns)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// clientCAs is the pool of CAs client certificates are verified against
+var clientCAs atomic.Pointer[x509.CertPool]
+
+// serverCertificate is the certificate presented by the server
+var serverCertificate atomic.Pointer[tls.Certificate]
+
+// validCAs are the CAs the DNs of users and accessors are matched against
+var validCAs atomic.Pointer[CAs]
+
+// reloadMutex serializes reloads, which can be triggered concurrently by a configuration change, SIGHUP and the API
+var reloadMutex sync.Mutex
+
+// reloadReport describes the outcome of a reload
+type reloadReport struct {
+	Source    string   `json:"source"`
+	Applied   bool     `json:"applied"`
+	Changed   []string `json:"changed"`
+	Unchanged []string `json:"unchanged"`
+	Flushed   int      `json:"flushedaccessors"`
+}
+
+func (r *reloadReport) compare(item string, changed bool) {
+	if changed {
+		r.Changed = append(r.Changed, item)
+	} else {
+		r.Unchanged = append(r.Unchanged, item)
+	}
+}
+
+// IncludeReloadAPIs includes all APIs described in this file in an APICollection
+func IncludeReloadAPIs(c *APICollection) {
+	reloadServer := BaseAPI{
+		InputModel{},
+		reloadServer,
+		RoleWrite,
+		nil,
+	}
+	c.Add("reloadServer", &reloadServer)
+}
+
+// ReloadInitialize reloads the server when the configuration file changes or on SIGHUP
+func ReloadInitialize() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		log.WithFields(log.Fields{"file": e.Name}).Info("Config file changed.")
+		Reload("config", true)
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			Reload("sighup", true)
+		}
+	}()
+}
+
+// loadServerCertificate loads the certificate and key of the server
+func loadServerCertificate() (*tls.Certificate, error) {
+	srvConfig := viper.GetStringMapString("server")
+	cert, err := tls.LoadX509KeyPair(srvConfig["cert"], srvConfig["key"])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// getServerCertificate returns the server certificate loaded by the last reload
+func getServerCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return serverCertificate.Load(), nil
+}
+
+// Reload rebuilds the CAs, certificates, token issuers, trusted proxies, log settings and LDAP settings from the
+// configuration and flushes the accessor cache.  Everything is loaded before anything is replaced, so a reload either
+// applies every change or none.  With apply false, only reports what would change.
+func Reload(source string, apply bool) (reloadReport, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	report := reloadReport{Source: source, Changed: make([]string, 0), Unchanged: make([]string, 0)}
+	var errs []string
+
+	// Load everything
+	srvConfig := viper.GetStringMapString("server")
+	pool, err := loadCerts(viper.GetStringSlice("certificates"))
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("certificates: %s", err))
+	}
+	cert, err := loadServerCertificate()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("server certificate: %s", err))
+	}
+	cas, err := FetchCAs(srvConfig["cas"])
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("cas: %s", err))
+	}
+	var revoked *crlSet
+	if crlEnabled() {
+		revoked = readCRLs(srvConfig["cas"])
+	}
+	proxies, err := loadTrustedProxies()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("proxies: %s", err))
+	}
+	logConfig := viper.GetStringMapString("log")
+	level := log.GetLevel()
+	if len(logConfig["level"]) > 0 {
+		if level, err = log.ParseLevel(logConfig["level"]); err != nil {
+			errs = append(errs, fmt.Sprintf("log: %s", err))
+		}
+	}
+	issuers := viper.GetStringSlice("issuers")
+	scopes, err := loadIssuerScopes()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("issuers: %s", err))
+	}
+	current := tokenValidation.Load()
+	issuersChanged := !reflect.DeepEqual(scopes, current.scopes) || !slices.Equal(issuers, current.issuers)
+	newLdap, err := loadLdapSettings()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("ldap: %s", err))
+	}
+
+	// The enforcer is created last, only when applying a reload that loaded everything else
+	var tokens *tokenConfig
+	if len(errs) == 0 && apply && issuersChanged {
+		if tokens, err = newEnforcer(); err != nil {
+			errs = append(errs, fmt.Sprintf("issuers: %s", err))
+		}
+	}
+	if len(errs) > 0 {
+		err := errors.New(strings.Join(errs, "; "))
+		log.WithFields(log.Fields{"source": source}).Errorf("Reload failed, keeping the current configuration: %s", err)
+		return report, err
+	}
+
+	// Report what changed
+	report.compare("certificates", !pool.Equal(clientCAs.Load()))
+	oldCert := serverCertificate.Load()
+	report.compare("server_certificate", oldCert == nil || !slices.Equal(cert.Certificate[0], oldCert.Certificate[0]))
+	report.compare("cas", !reflect.DeepEqual(cas, *validCAs.Load()))
+	report.compare("crls", !reflect.DeepEqual(revoked, revokedCRLs.Load()))
+	report.compare("issuers", issuersChanged)
+	report.compare("proxies", !reflect.DeepEqual(proxies, trustedProxies.Load()))
+	report.compare("log", level != log.GetLevel() || logConfig["format"] != currentLogFormat)
+	report.compare("ldap", *newLdap != *ldapConfig.Load())
+
+	if !apply {
+		return report, nil
+	}
+
+	// Replace everything.  Requests load each setting once, and a replaced enforcer is stopped once the requests
+	// validating tokens with it are done.
+	clientCAs.Store(pool)
+	serverCertificate.Store(cert)
+	validCAs.Store(&cas)
+	revokedCRLs.Store(revoked)
+	trustedProxies.Store(proxies)
+	ldapConfig.Store(newLdap)
+	if tokens != nil {
+		go tokenValidation.Swap(tokens).stop()
+	}
+	log.SetLevel(level)
+	if logConfig["format"] != currentLogFormat {
+		log.SetFormatter(logFormatter(logConfig["format"]))
+		currentLogFormat = logConfig["format"]
+	}
+	if AccCache != nil {
+		report.Flushed = AccCache.ItemCount()
+		AccCache.Flush()
+	}
+	report.Applied = true
+
+	log.WithFields(log.Fields{"source": source, "changed": strings.Join(report.Changed, ","), "flushed": report.Flushed}).Info("Reloaded configuration.")
+	return report, nil
+}
+
+// reloadServer godoc
+// @Summary      Reloads the configuration of the server.
+// @Description  Reloads the CAs, certificates, token issuers, trusted proxies, log settings and LDAP settings from the
+// @Description  configuration file and flushes the accessor cache, without dropping connections.  Everything is loaded before
+// @Description  anything is replaced, so if any part fails to load the current configuration is kept.  Returns what changed.
+// @Description  The server also reloads when the configuration file changes and on SIGHUP.  With dryrun, only reports what
+// @Description  would change.  Requires an admin accessor, and cannot run in a batch.
+// @Tags         Miscellaneous
+// @Accept       html
+// @Produce      json
+// @Success      200  {object}  reloadReport
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /reloadServer [put]
+func reloadServer(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	report, err := Reload("api", c.DryRun == nil)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, APIError{fmt.Errorf("reload failed: %s", err), ErrorAPIRequirement})
+		return nil, apiErr
+	}
+
+	return report, nil
+}
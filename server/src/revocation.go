@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ocsp"
+)
+
+// crlSet holds the revoked certificates listed in the CRLs, by the raw subject of their issuer
+type crlSet struct {
+	serials    map[string]map[string]bool
+	nextUpdate map[string]time.Time
+}
+
+// revokedCRLs is the set of CRLs loaded by the last reload, nil when CRLs are disabled
+var revokedCRLs atomic.Pointer[crlSet]
+
+// ocspCache stores the status of certificates returned by the OCSP responder
+var ocspCache = cache.New(10*time.Minute, 10*time.Minute)
+
+// RevocationInitialize loads the CRLs from the CA directory and reloads them periodically, as set in the revocation
+// section of the configuration.  Reloads use the CA directory of the current configuration, and turn the CRLs on or off
+// as the configuration changes.
+func RevocationInitialize(caDir string) {
+	if crlEnabled() {
+		loadCRLs(caDir)
+	} else {
+		log.Warning("certificate revocation lists are disabled")
+	}
+
+	revConfig := viper.GetStringMapString("revocation")
+	interval, err := time.ParseDuration(revConfig["interval"])
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if crlEnabled() {
+				loadCRLs(viper.GetStringMapString("server")["cas"])
+			} else {
+				revokedCRLs.Store(nil)
+			}
+		}
+	}()
+}
+
+// crlEnabled checks if the CRLs are enabled in the revocation section of the configuration
+func crlEnabled() bool {
+	return strings.ToLower(viper.GetStringMapString("revocation")["crl"]) != "false"
+}
+
+// revocationRejects checks if certificates are rejected when their revocation cannot be checked for a reason set in the
+// revocation section of the configuration, expired_crl or ocsp_failure.  They are accepted unless the reason is set to
+// reject.
+func revocationRejects(reason string) bool {
+	return strings.ToLower(viper.GetStringMapString("revocation")[reason]) == "reject"
+}
+
+// loadCRLs replaces the revoked certificates with those listed in the CRLs of the CA directory
+func loadCRLs(caDir string) {
+	revokedCRLs.Store(readCRLs(caDir))
+}
+
+// readCRLs reads the IGTF CRLs (*.r0) in the CA directory.  Each CRL must be signed by the CA stored with the same hash
+// (*.0), CRLs that cannot be verified are ignored.
+func readCRLs(caDir string) *crlSet {
+	revoked := &crlSet{make(map[string]map[string]bool), make(map[string]time.Time)}
+
+	pathList, _ := filepath.Glob(caDir + "/*.r0")
+	for _, path := range pathList {
+		crl, err := readCRL(path)
+		if err != nil {
+			log.WithFields(log.Fields{"crl": path}).Warnf("ignoring CRL: %s", err)
+			continue
+		}
+		if crl.NextUpdate.Before(time.Now()) {
+			log.WithFields(log.Fields{"crl": path, "next_update": crl.NextUpdate}).Warn("CRL is expired")
+		}
+
+		issuer := string(crl.RawIssuer)
+		serials, found := revoked.serials[issuer]
+		if !found {
+			serials = make(map[string]bool)
+			revoked.serials[issuer] = serials
+		}
+		if crl.NextUpdate.After(revoked.nextUpdate[issuer]) {
+			revoked.nextUpdate[issuer] = crl.NextUpdate
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+
+	log.WithFields(log.Fields{"crls": len(pathList), "issuers": len(revoked.serials)}).Info("Loaded certificate revocation lists.")
+	return revoked
+}
+
+// readCRL parses a CRL in PEM or DER format and checks its signature against the CA with the same hash
+func readCRL(path string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	caData, err := os.ReadFile(strings.TrimSuffix(path, ".r0") + ".0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the CA: %s", err)
+	}
+	for {
+		var block *pem.Block
+		block, caData = pem.Decode(caData)
+		if block == nil {
+			break
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if crl.CheckSignatureFrom(ca) == nil {
+			return crl, nil
+		}
+	}
+	return nil, errors.New("CRL is not signed by its CA")
+}
+
+// isRevoked checks if a certificate is listed in the CRL of its issuer.  Returns an error if that CRL is expired.
+func isRevoked(cert *x509.Certificate) (bool, error) {
+	crls := revokedCRLs.Load()
+	if crls == nil {
+		return false, nil
+	}
+
+	issuer := string(cert.RawIssuer)
+	if crls.serials[issuer][cert.SerialNumber.String()] {
+		return true, nil
+	}
+	if nextUpdate, found := crls.nextUpdate[issuer]; found && nextUpdate.Before(time.Now()) {
+		return false, fmt.Errorf("the CRL of %s expired on %s", parseDN(cert.Issuer.Names, "/"), nextUpdate.Format(time.RFC3339))
+	}
+	return false, nil
+}
+
+// ocspRevoked asks the OCSP responder set in the configuration whether a certificate is revoked.  Only good and
+// revoked statuses are cached, an unknown status is returned as an error like a failed request.
+func ocspRevoked(cert *x509.Certificate, issuer *x509.Certificate) (bool, error) {
+	revConfig := viper.GetStringMapString("revocation")
+	responder := revConfig["ocsp_url"]
+	if responder == "" {
+		return false, nil
+	}
+
+	key := string(cert.RawIssuer) + cert.SerialNumber.String()
+	if status, found := ocspCache.Get(key); found {
+		return status.(int) == ocsp.Revoked, nil
+	}
+
+	timeout, err := time.ParseDuration(revConfig["ocsp_timeout"])
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, fmt.Errorf("unable to create OCSP request: %s", err)
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return false, fmt.Errorf("OCSP request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return false, fmt.Errorf("OCSP request failed: %s", err)
+	}
+	response, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return false, fmt.Errorf("invalid OCSP response: %s", err)
+	}
+	if response.Status != ocsp.Good && response.Status != ocsp.Revoked {
+		return false, errors.New("OCSP responder does not know the certificate")
+	}
+
+	expiration := cache.DefaultExpiration
+	if !response.NextUpdate.IsZero() && time.Until(response.NextUpdate) < 10*time.Minute {
+		expiration = time.Until(response.NextUpdate)
+	}
+	ocspCache.Set(key, response.Status, expiration)
+
+	return response.Status == ocsp.Revoked, nil
+}
+
+// revokedCertificate checks the client certificates of a request, and the intermediate CAs that issued them, against
+// the CRLs and the OCSP responder.  Returns whether a certificate is revoked and a message naming it.  Certificates
+// whose revocation cannot be checked are accepted with a warning, unless expired_crl or ocsp_failure is set to reject.
+// Trusted proxies only pass the DN of their clients, so proxied certificates must be checked by the proxy.
+func revokedCertificate(r *http.Request) (bool, string) {
+	if r.TLS == nil {
+		return false, ""
+	}
+
+	for _, chain := range r.TLS.VerifiedChains {
+		// The last certificate of a chain is the trusted CA itself
+		for n := 0; n+1 < len(chain); n++ {
+			cert := chain[n]
+			fields := log.Fields{"dn": parseDN(cert.Subject.Names, "/"), "serial": cert.SerialNumber.String()}
+
+			revoked, err := isRevoked(cert)
+			if err != nil {
+				log.WithFields(fields).Warn(err)
+				if revocationRejects("expired_crl") {
+					return true, fmt.Sprintf("certificate %s serial %s cannot be checked: %s", fields["dn"], fields["serial"], err)
+				}
+			}
+			if !revoked {
+				revoked, err = ocspRevoked(cert, chain[n+1])
+				if err != nil {
+					log.WithFields(fields).Warn(err)
+					if revocationRejects("ocsp_failure") {
+						return true, fmt.Sprintf("certificate %s serial %s cannot be checked: %s", fields["dn"], fields["serial"], err)
+					}
+				}
+			}
+			if revoked {
+				log.WithFields(fields).Warn("rejecting revoked certificate")
+				return true, fmt.Sprintf("certificate %s serial %s is revoked", fields["dn"], fields["serial"])
+			}
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// testCA writes a CA and a CRL signed by it, revoking serial 2, to a CA directory.  Returns the CA certificate and a
+// certificate it issued with the given serial.
+func testCA(t *testing.T, dir string, nextUpdate time.Time, serial int64) (*x509.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	leafDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "host.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDer)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: nextUpdate.Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(2), RevocationTime: time.Now().Add(-time.Hour)},
+		},
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+	if err := os.WriteFile(filepath.Join(dir, "testca.0"), caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "testca.r0"), crlPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ca, leaf
+}
+
+func TestRevokedCertificate(t *testing.T) {
+	tests := []struct {
+		name       string
+		serial     int64
+		nextUpdate time.Duration
+		expiredCRL string
+		revoked    bool
+	}{
+		{"revoked", 2, time.Hour, "", true},
+		{"good", 3, time.Hour, "", false},
+		{"stale CRL accepted by default", 3, -time.Hour, "", false},
+		{"stale CRL rejected when set", 3, -time.Hour, "reject", true},
+		{"revoked with a stale CRL", 2, -time.Hour, "", true},
+	}
+
+	defer revokedCRLs.Store(nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("revocation", map[string]string{"expired_crl": test.expiredCRL})
+			defer viper.Set("revocation", map[string]string{})
+
+			dir := t.TempDir()
+			ca, leaf := testCA(t, dir, time.Now().Add(test.nextUpdate), test.serial)
+			loadCRLs(dir)
+
+			r := &http.Request{TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca}}}}
+			revoked, message := revokedCertificate(r)
+			if revoked != test.revoked {
+				t.Errorf("expected revoked %v, got %v: %s", test.revoked, revoked, message)
+			}
+		})
+	}
+}
@@ -14,7 +14,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func SlackMessage(ctx context.Context, message string) error {
+// SlackMessage posts an alert to the ferryalertsurl Slack webhook, tagged with the ID of the request that raised it if any
+func SlackMessage(ctx context.Context, requestID string, message string) error {
 	if e := ctx.Err(); e != nil {
 		log.Errorf("Error sending slack message: %s", e)
 		return e
@@ -24,6 +25,9 @@ func SlackMessage(ctx context.Context, message string) error {
 		return nil
 	}
 	message = fmt.Sprintf("Server: %s - %s", serverRole, message)
+	if len(requestID) > 0 {
+		message = fmt.Sprintf("%s (request_id %s)", message, requestID)
+	}
 	msg := []byte(fmt.Sprintf(`{"text": "%s"}`, strings.Replace(message, "\"", "\\\"", -1)))
 	req, err := http.NewRequest("POST", FerryAlertsURL, bytes.NewBuffer(msg))
 	if err != nil {
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"strings"
 	"regexp"
 	"fmt"
 	"context"
@@ -15,18 +14,22 @@ import (
 // Transaction for nested scopes.
 type Transaction struct {
 	tx *sql.Tx
+	ctx context.Context
 	commitKey int64
 	err error
+	afterCommit []func()
 }
 
 // Start starts a transaction with default isolation level.
+// The transaction is rolled back and every statement is canceled when ctx is done.
 // It returns a unique key required to commit the transaction. Returns 0 if the transaction is already started.
-func (t *Transaction) Start(db *sql.DB) (int64, error) {
+func (t *Transaction) Start(ctx context.Context, db *sql.DB) (int64, error) {
 	t.err = errors.New("transaction did not complete properly")
 	if t.commitKey == 0 {
 		log.Debug("Creating new transaction")
 		t.commitKey = time.Now().Unix()
-		t.tx, t.err = db.Begin()
+		t.ctx = ctx
+		t.tx, t.err = db.BeginTx(ctx, nil)
 		//_, t.err = t.tx.Exec("set transaction isolation level serializable")
 		return t.commitKey, t.err
 	}
@@ -45,12 +48,26 @@ func (t *Transaction) Commit(key int64) error {
 	} else if t.commitKey == key {
 		t.err = nil
 		t.commitKey = 0
-		return t.tx.Commit()
+		hooks := t.afterCommit
+		t.afterCommit = nil
+		if err := t.tx.Commit(); err != nil {
+			return err
+		}
+		for _, hook := range hooks {
+			hook()
+		}
+		return nil
 	}
 	t.err = errors.New("invalid key")
 	return t.err
 }
 
+// AfterCommit registers a function to run once the transaction is committed, in the order registered.
+// The functions are dropped if the transaction is rolled back, so dry runs and failed calls never run them.
+func (t *Transaction) AfterCommit(hook func()) {
+	t.afterCommit = append(t.afterCommit, hook)
+}
+
 // Rollback aborts the transaction.
 func (t *Transaction) Rollback(key int64) error {
 	if key == 0 {
@@ -58,6 +75,7 @@ func (t *Transaction) Rollback(key int64) error {
 	}
 	if t.commitKey != 0 {
 		t.commitKey = 0
+		t.afterCommit = nil
 		return t.tx.Rollback()
 	}
 	t.err = errors.New("transaction has not been started")
@@ -69,7 +87,7 @@ func (t *Transaction) Savepoint(savepoint string) error {
 	if t.commitKey != 0 {
 		re := regexp.MustCompile("[-]")
 		savepoint = re.ReplaceAllLiteralString(savepoint, "_")
-		_, t.err = t.tx.Exec(fmt.Sprintf("SAVEPOINT %s;", savepoint))
+		_, t.err = t.tx.ExecContext(t.ctx, fmt.Sprintf("SAVEPOINT %s;", savepoint))
 		return t.err
 	}
 	t.err = errors.New("transaction has not been started")
@@ -79,7 +97,7 @@ func (t *Transaction) Savepoint(savepoint string) error {
 // RollbackToSavepoint reverts the Trasaction to a savepoint
 func (t *Transaction) RollbackToSavepoint(savepoint string) error {
 	if t.commitKey != 0 {
-		_, t.err = t.tx.Exec(fmt.Sprintf("ROLLBACK TO SAVEPOINT %s;", savepoint))
+		_, t.err = t.tx.ExecContext(t.ctx, fmt.Sprintf("ROLLBACK TO SAVEPOINT %s;", savepoint))
 		return t.err
 	}
 	t.err = errors.New("transaction has not been started")
@@ -90,13 +108,7 @@ func (t *Transaction) RollbackToSavepoint(savepoint string) error {
 func (t *Transaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
 	if t.commitKey != 0 {
 		var rows *sql.Rows
-
-		// [EXPERIMENTAL] Tries to automatically order queries by the first column
-		if !strings.Contains(query, "order by") && !strings.Contains(query, ";") {
-			query = fmt.Sprintf("select * from (%s) as t order by 1", query)
-		}
-
-		rows, t.err = t.tx.Query(query, args...)
+		rows, t.err = t.tx.QueryContext(t.ctx, query, args...)
 		return rows, t.err
 	}
 	t.err = errors.New("transaction has not been started")
@@ -106,7 +118,7 @@ func (t *Transaction) Query(query string, args ...interface{}) (*sql.Rows, error
 // QueryRow executes a query that returns one row, typically a SELECT.
 func (t *Transaction) QueryRow(query string, args ...interface{}) (*sql.Row) {
 	if t.commitKey != 0 {
-		row := t.tx.QueryRow(query, args...)
+		row := t.tx.QueryRowContext(t.ctx, query, args...)
 		return row
 	}
 	t.err = errors.New("transaction has not been started")
@@ -118,7 +130,7 @@ func (t *Transaction) QueryRow(query string, args ...interface{}) (*sql.Row) {
 func (t *Transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
 	if t.commitKey != 0 {
 		var result sql.Result
-		result, t.err = t.tx.Exec(query, args...)
+		result, t.err = t.tx.ExecContext(t.ctx, query, args...)
 		return result, t.err
 	}
 	t.err = errors.New("transaction has not been started")
@@ -128,7 +140,7 @@ func (t *Transaction) Exec(query string, args ...interface{}) (sql.Result, error
 // Prepare creates a prepared statement for use within a Transaction.
 func (t *Transaction) Prepare(query string) (*sql.Stmt, error) {
 	if t.commitKey != 0 {
-		return t.tx.Prepare(query)
+		return t.tx.PrepareContext(t.ctx, query)
 	}
 	t.err = errors.New("transaction has not been started")
 	return nil, t.err
@@ -154,7 +166,13 @@ func (t *Transaction) Error() (error) {
 	return t.err
 }
 
+// Context returns the context the Transaction was started with
+func (t *Transaction) Context() (context.Context) {
+	return t.ctx
+}
+
 // LoadTransaction loads a Transaction from an http context. Returns a new Transaction if none is found.
+// A new Transaction is bound to the context of the request.
 func LoadTransaction(r *http.Request, db *sql.DB) (*Transaction, int64, error) {
 	if r.Context().Value("tx") != nil {
 		log.Debug("Reusing transaction")
@@ -162,13 +180,12 @@ func LoadTransaction(r *http.Request, db *sql.DB) (*Transaction, int64, error) {
 		return tx, 0, nil
 	}
 	var newTx Transaction
-	key, err := newTx.Start(db)
+	key, err := newTx.Start(r.Context(), db)
 	return &newTx, key, err
 }
 
-// WithTransaction starts a new Transaction and add it to an HTTP context
+// WithTransaction adds a Transaction to an HTTP context so LoadTransaction can reuse it
 func WithTransaction(r *http.Request, tx *Transaction) (*http.Request) {
-	var ctx context.Context
-	ctx = context.WithValue(ctx, "tx", tx)
+	ctx := context.WithValue(r.Context(), "tx", tx)
 	return r.WithContext(ctx)
 }
\ No newline at end of file
@@ -23,6 +23,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		setAffiliationUnitInfo,
 		RoleWrite,
+		[]Attribute{UnitName},
 	}
 	c.Add("setAffiliationUnitInfo", &setAffiliationUnitInfo)
 
@@ -34,6 +35,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		getAffiliationUnitMembers,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getAffiliationUnitMembers", &getAffiliationUnitMembers)
 
@@ -43,6 +45,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		getAffiliationMembers,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getAffiliationMembers", &getAffiliationMembers)
 
@@ -54,6 +57,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		getGroupsInAffiliationUnit,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getGroupsInAffiliationUnit", &getGroupsInAffiliationUnit)
 
@@ -63,6 +67,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		getGroupLeadersinAffiliationUnit,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getGroupLeadersinAffiliationUnit", &getGroupLeadersinAffiliationUnit)
 
@@ -73,6 +78,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		getAffiliationUnitComputeResources,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getAffiliationUnitComputeResources", &getAffiliationUnitComputeResources)
 
@@ -85,6 +91,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		createAffiliationUnit,
 		RoleWrite,
+		[]Attribute{UnitName},
 	}
 	c.Add("createAffiliationUnit", &createAffiliationUnit)
 
@@ -94,6 +101,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		removeAffiliationUnit,
 		RoleWrite,
+		[]Attribute{UnitName},
 	}
 	c.Add("removeAffiliationUnit", &removeAffiliationUnit)
 
@@ -106,6 +114,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		createFQAN,
 		RoleWrite,
+		[]Attribute{UnitName, GroupName, UserName},
 	}
 	c.Add("createFQAN", &createFQAN)
 
@@ -117,6 +126,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		setFQANMappings,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("setFQANMappings", &setFQANMappings)
 
@@ -126,6 +136,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		removeFQAN,
 		RoleWrite,
+		nil,
 	}
 	c.Add("removeFQAN", &removeFQAN)
 
@@ -136,6 +147,7 @@ func IncludeUnitAPIs(c *APICollection) {
 		},
 		getAllAffiliationUnits,
 		RoleRead,
+		nil,
 	}
 	c.Add("getAllAffiliationUnits", &getAllAffiliationUnits)
 }
@@ -550,7 +562,7 @@ func getGroupLeadersinAffiliationUnit(c APIContext, i Input) (interface{}, []API
 		return nil, apiErr
 	}
 
-	rows, checkerr := DBptr.Query(`select name, type, uid, uname from user_group
+	rows, checkerr := c.DBtx.Query(`select name, type, uid, uname from user_group
 								   join users using(uid)
 								   join groups using(groupid)
 								   where is_leader = TRUE and
@@ -896,9 +908,10 @@ func getAllAffiliationUnits(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select name, url from affiliation_units au left join voms_url using(unitid)
+	rows, err := c.DBtx.Query(`select name, url from affiliation_units au left join voms_url using(unitid)
 							  where url is not null and (url like concat('%voms/', $1::text) or url like concat('%voms/', $1::text, '/%') or $1 is null)
-							  and (au.last_updated>=$2 or $2 is null)`,
+							  and (au.last_updated>=$2 or $2 is null)
+							  order by name`,
 		i[VOName], i[LastUpdated])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
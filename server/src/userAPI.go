@@ -8,8 +8,9 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 // IncludeUserAPIs includes all APIs described in this file in an APICollection
@@ -21,6 +22,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		banUser,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("banUser", &banUser)
 
@@ -31,7 +33,8 @@ func IncludeUserAPIs(c *APICollection) {
 			Parameter{TokenSubject, false},
 		},
 		getUserInfo,
-		RoleRead,
+		RoleSelf,
+		[]Attribute{UserName, UID},
 	}
 	c.Add("getUserInfo", &getUserInfo)
 
@@ -45,6 +48,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserInfo,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("setUserInfo", &setUserInfo)
 
@@ -59,6 +63,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		createUser,
 		RoleWrite,
+		[]Attribute{GroupName, UserName, UID},
 	}
 	c.Add("createUser", &createUser)
 
@@ -68,9 +73,32 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		dropUser,
 		RoleWrite,
+		[]Attribute{UID},
 	}
 	c.Add("dropUser", &dropUser)
 
+	mergeUsers := BaseAPI{
+		InputModel{
+			Parameter{SourceUID, true},
+			Parameter{TargetUID, true},
+		},
+		mergeUsers,
+		RoleWrite,
+		[]Attribute{SourceUID, TargetUID},
+	}
+	c.Add("mergeUsers", &mergeUsers)
+
+	renameUser := BaseAPI{
+		InputModel{
+			Parameter{UserName, true},
+			Parameter{NewUserName, true},
+		},
+		renameUser,
+		RoleWrite,
+		[]Attribute{UserName},
+	}
+	c.Add("renameUser", &renameUser)
+
 	addCertificateDNToUser := BaseAPI{
 		InputModel{
 			Parameter{UserName, true},
@@ -79,6 +107,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		addCertificateDNToUser,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("addCertificateDNToUser", &addCertificateDNToUser)
 
@@ -90,6 +119,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getUserExternalAffiliationAttributes,
 		RoleRead,
+		[]Attribute{UserName},
 	}
 	c.Add("getUserExternalAffiliationAttributes", &getUserExternalAffiliationAttributes)
 
@@ -101,6 +131,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserExternalAffiliationAttribute,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("setUserExternalAffiliationAttribute", &setUserExternalAffiliationAttribute)
 
@@ -111,7 +142,8 @@ func IncludeUserAPIs(c *APICollection) {
 			Parameter{ResourceName, true},
 		},
 		getUserStorageQuota,
-		RoleRead,
+		RoleSelf,
+		[]Attribute{UnitName, ResourceName, UserName},
 	}
 	c.Add("getUserStorageQuota", &getUserStorageQuota)
 
@@ -124,6 +156,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getStorageQuotas,
 		RoleRead,
+		[]Attribute{ResourceName, GroupName, UserName},
 	}
 	c.Add("getStorageQuotas", &getStorageQuotas)
 
@@ -134,6 +167,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getUserAccessToComputeResources,
 		RoleRead,
+		[]Attribute{UserName},
 	}
 	c.Add("getUserAccessToComputeResources", &getUserAccessToComputeResources)
 
@@ -148,6 +182,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserAccessToComputeResource,
 		RoleWrite,
+		[]Attribute{ResourceName, GroupName, UserName},
 	}
 	c.Add("setUserAccessToComputeResource", &setUserAccessToComputeResource)
 
@@ -160,6 +195,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserExperimentFQAN,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("setUserExperimentFQAN", &setUserExperimentFQAN)
 
@@ -172,6 +208,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		removeUserExperimentFQAN,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("removeUserExperimentFQAN", &removeUserExperimentFQAN)
 
@@ -182,7 +219,8 @@ func IncludeUserAPIs(c *APICollection) {
 			Parameter{LastUpdated, false},
 		},
 		getUserFQANs,
-		RoleRead,
+		RoleSelf,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("getUserFQANs", &getUserFQANs)
 
@@ -192,11 +230,12 @@ func IncludeUserAPIs(c *APICollection) {
 			Parameter{UnitName, false},
 		},
 		getUserCertificateDNs,
-		RoleRead,
+		RoleSelf,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("getUserCertificateDNs", &getUserCertificateDNs)
 
-	getAllUsersCertificateDNs := BaseAPI{
+	getAllUsersCertificateDNs := PagedAPI(
 		InputModel{
 			Parameter{UnitName, false},
 			Parameter{Status, false},
@@ -204,7 +243,8 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getAllUsersCertificateDNs,
 		RoleRead,
-	}
+		[]Attribute{UnitName},
+	)
 	c.Add("getAllUsersCertificateDNs", &getAllUsersCertificateDNs)
 
 	getUserGroups := BaseAPI{
@@ -213,7 +253,8 @@ func IncludeUserAPIs(c *APICollection) {
 			Parameter{LastUpdated, false},
 		},
 		getUserGroups,
-		RoleRead,
+		RoleSelf,
+		[]Attribute{UserName},
 	}
 	c.Add("getUserGroups", &getUserGroups)
 
@@ -226,6 +267,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		addUserToGroup,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("addUserToGroup", &addUserToGroup)
 
@@ -238,6 +280,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserShellAndHomeDir,
 		RoleWrite,
+		[]Attribute{ResourceName, UserName},
 	}
 	c.Add("setUserShellAndHomeDir", &setUserShellAndHomeDir)
 
@@ -249,6 +292,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getUserShellAndHomeDir,
 		RoleRead,
+		[]Attribute{ResourceName, UserName},
 	}
 	c.Add("getUserShellAndHomeDir", &getUserShellAndHomeDir)
 
@@ -260,6 +304,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserShell,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("setUserShell", &setUserShell)
 
@@ -271,6 +316,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		removeUserFromGroup,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("removeUserFromGroup", &removeUserFromGroup)
 
@@ -280,6 +326,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getUserUname,
 		RoleRead,
+		[]Attribute{UID},
 	}
 	c.Add("getUserUname", &getUserUname)
 
@@ -289,10 +336,11 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getUserUID,
 		RoleRead,
+		[]Attribute{UserName},
 	}
 	c.Add("getUserUID", &getUserUID)
 
-	getAllUsers := BaseAPI{
+	getAllUsers := PagedAPI(
 		InputModel{
 			Parameter{Status, false},
 			Parameter{LastUpdated, false},
@@ -300,17 +348,43 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getAllUsers,
 		RoleRead,
-	}
+		nil,
+	)
 	c.Add("getAllUsers", &getAllUsers)
 
-	getAllUsersFQANs := BaseAPI{
+	searchUsers := PagedAPI(
+		InputModel{
+			Parameter{FullName, false},
+			Parameter{Email, false},
+			Parameter{Status, false},
+			Parameter{Banned, false},
+			Parameter{GroupAccount, false},
+			Parameter{UnitName, false},
+			Parameter{GroupName, false},
+			Parameter{GroupType, false},
+			Parameter{ResourceName, false},
+			Parameter{ExpiresAfter, false},
+			Parameter{ExpiresBefore, false},
+			Parameter{LastUpdated, false},
+			Parameter{UpdatedBefore, false},
+			Parameter{UserAttribute, false},
+			Parameter{Value, false},
+		},
+		searchUsers,
+		RoleRead,
+		[]Attribute{UnitName, ResourceName, GroupName},
+	)
+	c.Add("searchUsers", &searchUsers)
+
+	getAllUsersFQANs := PagedAPI(
 		InputModel{
 			Parameter{Suspend, false},
 			Parameter{LastUpdated, false},
 		},
 		getAllUsersFQANs,
 		RoleRead,
-	}
+		nil,
+	)
 	c.Add("getAllUsersFQANs", &getAllUsersFQANs)
 
 	getMemberAffiliations := BaseAPI{
@@ -320,6 +394,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getMemberAffiliations,
 		RoleRead,
+		[]Attribute{UserName},
 	}
 	c.Add("getMemberAffiliations", &getMemberAffiliations)
 
@@ -331,6 +406,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		setUserGridAccess,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("setUserGridAccess", &setUserGridAccess)
 
@@ -341,6 +417,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		removeUserCertificateDN,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("removeUserCertificateDN", &removeUserCertificateDN)
 
@@ -351,6 +428,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		removeUserExternalAffiliationAttribute,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("removeUserExternalAffiliationAttribute", &removeUserExternalAffiliationAttribute)
 
@@ -362,6 +440,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		getUserGroupsForComputeResource,
 		RoleRead,
+		[]Attribute{UnitName},
 	}
 	c.Add("getUserGroupsForComputeResource", &getUserGroupsForComputeResource)
 
@@ -374,6 +453,7 @@ func IncludeUserAPIs(c *APICollection) {
 		},
 		removeUserFromComputeResource,
 		RoleWrite,
+		[]Attribute{ResourceName, GroupName, UserName},
 	}
 	c.Add("removeUserFromComputeResource", &removeUserFromComputeResource)
 
@@ -440,6 +520,7 @@ func banUser(c APIContext, i Input) (interface{}, []APIError) {
 // @Summary      Returns DNs registered for users.
 // @Description  Returns all the certificate DNs registered for users. If the optional unitname variable
 // @Description  is set, it only returns a list of certificate DNs registered with the specified experiment name.
+// @Description  Users can call it for themselves with their own JWT or certificate, username defaults to them.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -531,6 +612,10 @@ func getUserCertificateDNs(c APIContext, i Input) (interface{}, []APIError) {
 // @Param        lastupdated    query     string  false  "return those updated since"  Format(date)
 // @Param        status         query     string  false  "return DNs only for inactive users, default active"
 // @Param        unitname       query     string  false  "restricts results to the specific affiliation"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
 // @Success      200  {object}  main.userCertificates
 // @Failure      400  {object}  main.jsonOutput
 // @Failure      401  {object}  main.jsonOutput
@@ -555,13 +640,25 @@ func getAllUsersCertificateDNs(c APIContext, i Input) (interface{}, []APIError)
 
 	activeOnly := i[Status].Default(false)
 
-	rows, queryerr := c.DBtx.Query(`select uname, name, dn from
-										affiliation_unit_user_certificate as ac
-										join user_certificates using(dnid)
-										join users using(uid)
-										join affiliation_units using(unitid)
+	page, apiErr := newPage(i, map[Attribute]string{UserName: "uname"}, UserName, "uid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(4)
+
+	rows, queryerr := c.DBtx.Query(fmt.Sprintf(`with certificates as (
+										select uid, uname, name, dn from
+											affiliation_unit_user_certificate as ac
+											join user_certificates using(dnid)
+											join users using(uid)
+											join affiliation_units using(unitid)
 										where unitid = coalesce($1, unitid) and (status = $2 or not $2) and (ac.last_updated >= $3 or $3 is null)
-									order by uname`, unitid, activeOnly, i[LastUpdated])
+									), page as (
+										select uid, uname from certificates where %s group by uid, uname %s %s
+									)
+									select %s, uname, name, dn from certificates join page using(uid, uname)
+									%s, name, dn`, after, page.orderBy(), page.limitBy(), page.columns(), page.orderBy()),
+		append([]interface{}{unitid, activeOnly, i[LastUpdated]}, args...)...)
 	if queryerr != nil {
 		log.WithFields(QueryFields(c)).Error(queryerr)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -577,10 +674,14 @@ func getAllUsersCertificateDNs(c APIContext, i Input) (interface{}, []APIError)
 
 	prevUname := NewNullAttribute(UserName)
 	for rows.Next() {
+		var sortValue, sortKey string
 		row := NewMapNullAttribute(UserName, UnitName, DN)
-		rows.Scan(row[UserName], row[UnitName], row[DN])
+		rows.Scan(&sortValue, &sortKey, row[UserName], row[UnitName], row[DN])
 		if row[UserName].Valid {
 			if prevUname != *row[UserName] {
+				if !page.add(sortValue, sortKey) {
+					break
+				}
 				user := make(jsonuser)
 				user[UserName] = row[UserName].Data
 				user[Certificates] = make([]jsoncert, 0)
@@ -594,12 +695,13 @@ func getAllUsersCertificateDNs(c APIContext, i Input) (interface{}, []APIError)
 		}
 	}
 
-	return out, nil
+	return page.output(out), nil
 }
 
 // getUserFQANs       godoc
 // @Summary      Returns the FQANs a user is assigned.
 // @Description  Given a username, returns all the FQANs a user is assigned to broken down by experiment names.
+// @Description  Users can call it for themselves with their own JWT or certificate, username defaults to them.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -669,6 +771,7 @@ func getUserFQANs(c APIContext, i Input) (interface{}, []APIError) {
 // getUserGroups godoc
 // @Summary      Returns the gid and group names of all the groups the user is member of.
 // @Description  Returns the gid and group names of all the groups the user is member of.
+// @Description  Users can call it for themselves with their own JWT or certificate, username defaults to them.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -696,7 +799,8 @@ func getUserGroups(c APIContext, i Input) (interface{}, []APIError) {
 	rows, err := c.DBtx.Query(`select gid, name, type from
 									groups join
 									user_group using(groupid)
-							   where uid = $1 and (user_group.last_updated >= $2 or $2 is null)`,
+							   where uid = $1 and (user_group.last_updated >= $2 or $2 is null)
+							   order by gid`,
 		uid, i[LastUpdated])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -724,6 +828,7 @@ func getUserGroups(c APIContext, i Input) (interface{}, []APIError) {
 // getUserInfo godoc
 // @Summary      Return attributes for a user.
 // @Description  For a specific user, returns the entity attributes. You must supply ONE of username or uid or tokensubject.
+// @Description  Users can call it for themselves with their own JWT or certificate, username defaults to them.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -744,7 +849,8 @@ func getUserInfo(c APIContext, i Input) (interface{}, []APIError) {
 							   from users
 							   where (uname=$1 or $1 is null)
 							     and (uid=$2 or $2 is null)
-								 and (token_subject=$3 or $3 is null)`, i[UserName], i[UID], i[TokenSubject])
+								 and (token_subject=$3 or $3 is null)
+								 order by full_name`, i[UserName], i[UID], i[TokenSubject])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -771,6 +877,7 @@ func getUserInfo(c APIContext, i Input) (interface{}, []APIError) {
 // @Summary      This is not the method you are looking for.
 // @Description  This is probably NOT what you want to run.  This is mostly an internal usage API.  You most likely want
 // @Description  setUserAccessToComputeResource which can be run multiple times to add the user to a specific group and cluster.
+// @Description  Group leaders can call it with their JWT for the groups they lead, without setting leader.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -837,6 +944,7 @@ func addUserToGroup(c APIContext, i Input) (interface{}, []APIError) {
 // removeUserFromGroup godoc
 // @Summary      Remove this group membership from the user.
 // @Description  Remove this group membership from the user.
+// @Description  Group leaders can call it with their JWT for the groups they lead.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -967,7 +1075,7 @@ func setUserExperimentFQAN(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, queryerr := c.DBtx.Query(`select fqanid from grid_fqan where unitid = $1 and fqan like $2`, unitid, fqan)
+	rows, queryerr := c.DBtx.Query(`select fqanid from grid_fqan where unitid = $1 and fqan like $2 order by fqanid`, unitid, fqan)
 	if queryerr != nil {
 		log.WithFields(QueryFields(c)).Error(queryerr)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1059,7 +1167,7 @@ func removeUserExperimentFQAN(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, queryerr := c.DBtx.Query(`select fqanid from grid_fqan where unitid = $1 and fqan like $2`, unitid, fqan)
+	rows, queryerr := c.DBtx.Query(`select fqanid from grid_fqan where unitid = $1 and fqan like $2 order by fqanid`, unitid, fqan)
 	if queryerr != nil {
 		log.WithFields(QueryFields(c)).Error(queryerr)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -1316,6 +1424,7 @@ func getUserShellAndHomeDir(c APIContext, i Input) (interface{}, []APIError) {
 // getUserStorageQuota godoc
 // @Summary      Returns the user's storage quota.
 // @Description  Returns the storage quota for a resource applied to a user, if any.
+// @Description  Users can call it for themselves with their own JWT or certificate, username defaults to them.
 // @Tags         Users
 // @Accept       html
 // @Produce      json
@@ -1356,7 +1465,7 @@ func getUserStorageQuota(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select path, value, unit, valid_until from storage_quota
+	rows, err := c.DBtx.Query(`select path, value, unit, valid_until from storage_quota
 							  where uid = $1 AND unitid = $2 and storageid = $3 and (valid_until is null or valid_until >= NOW())
 							  order by valid_until desc`, uid, unitid, resourceid)
 	if err != nil {
@@ -1516,7 +1625,7 @@ func getUserExternalAffiliationAttributes(c APIContext, i Input) (interface{}, [
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select uname, attribute, value from
+	rows, err := c.DBtx.Query(`select uname, attribute, value from
 								external_affiliation_attribute as a
 								join users as u using(uid)
 							  where u.uid = coalesce($1, uid) and (a.last_updated >= $2 or $2 is null)
@@ -1717,7 +1826,7 @@ func removeUserCertificateDN(c APIContext, i Input) (interface{}, []APIError) {
 // @Tags         Users
 // @Accept       html
 // @Produce      json
-// @Param        expirationdate query     string  false  "date the user's account expires" Format(date)
+// @Param        expirationdate query     string  false  "date the user's account expires, warnings are emailed to username@email_domain" Format(date)
 // @Param        fullname       query     string  false  "proper name of the user"
 // @Param        groupaccount   query     boolean false  "true if this is to be a group account - default is false"
 // @Param        status         query     string  false  "false to deactivate the account - default is true"
@@ -1800,7 +1909,7 @@ func setUserInfo(c APIContext, i Input) (interface{}, []APIError) {
 // @Tags         Users
 // @Accept       html
 // @Produce      json
-// @Param        expirationdate query     string  false  "date the user's account expires" Format(date)
+// @Param        expirationdate query     string  false  "date the user's account expires, warnings are emailed to username@email_domain" Format(date)
 // @Param        fullname       query     string  true   "proper name of the user"
 // @Param        groupaccount   query     boolean false  "true if this is to be a group account - default is false"
 // @Param        status         query     string  true   "false to deactivate the account - default is true"
@@ -1889,10 +1998,11 @@ func getMemberAffiliations(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select name, alternative_name
+	rows, err := c.DBtx.Query(`select name, alternative_name
 							  from affiliation_units as au
 							    join user_affiliation_units as uau using(unitid)
-							  where uid = $1 and (uau.last_updated >= $2 or $2 is null)`, uid, i[LastUpdated])
+							  where uid = $1 and (uau.last_updated >= $2 or $2 is null)
+							  order by name`, uid, i[LastUpdated])
 	if err != nil && err != sql.ErrNoRows {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -2044,7 +2154,7 @@ func dropUser(c APIContext, i Input) (interface{}, []APIError) {
 		jLastUpdated: TypeDate,
 	}
 
-	rows, err := DBptr.Query(`select uid, groupid, is_leader, last_updated from user_group where uid = $1`, i[UID])
+	rows, err := c.DBtx.Query(`select uid, groupid, is_leader, last_updated from user_group where uid = $1 order by groupid`, i[UID])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -2158,6 +2268,584 @@ func dropUser(c APIContext, i Input) (interface{}, []APIError) {
 	return nil, nil
 }
 
+// mergeUsers godoc
+// @Summary      Merges a duplicate user account into another.
+// @Description  Moves every association of the source user to the target user, archives what remains of the source in
+// @Description  user_archives, as archiveUser does, and updates LDAP once the merge is committed.  The target keeps its
+// @Description  name, status and expiration date.
+// @Description  Conflicts are resolved by these rules, each resolution is listed in the output:
+// @Description  - groups: the target is leader of a group if either user was.
+// @Description  - compute resources: where both have access, the target keeps its shell and home directory.  Moved accesses
+// @Description    keep the shell of the source and get the default home directory of the resource for the target.
+// @Description  - primary groups: the target keeps its primary group on a resource, the primary group of the source only
+// @Description    becomes primary where the target has none.
+// @Description  - FQANs: for an FQAN both have, the target is superuser if either was, and suspended only if both were.
+// @Description  - storage quotas: where both have a quota on a resource, the larger one is kept.  Moved quotas with a path
+// @Description    ending with the name of the source get the same path for the target, other paths are kept as they are.
+// @Description  - external attributes: where both have an attribute, the target keeps its value.
+// @Description  Use dryrun to preview the merge.
+// @Tags         Users
+// @Accept       html
+// @Produce      json
+// @Param        sourceuid      query     int     true  "uid of the duplicate account, archived after the merge"
+// @Param        targetuid      query     int     true  "uid of the account to keep"
+// @Success      200  {object}  userMerge
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /mergeUsers [put]
+func mergeUsers(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	source := NewNullAttribute(UserName)
+	target := NewNullAttribute(UserName)
+	targetActive := NewNullAttribute(Status)
+
+	err := c.DBtx.QueryRow(`select (select uname from users where uid = $1),
+								   (select uname from users where uid = $2),
+								   (select status from users where uid = $2)`,
+		i[SourceUID], i[TargetUID]).Scan(&source, &target, &targetActive)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	if !source.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, SourceUID))
+	}
+	if !target.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, TargetUID))
+	}
+	if source.Valid && target.Valid && i[SourceUID].Data.(int64) == i[TargetUID].Data.(int64) {
+		apiErr = append(apiErr, APIError{errors.New("sourceuid and targetuid must be different users"), ErrorAPIRequirement})
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	merge := userMerge{
+		SourceUID:      i[SourceUID].Data.(int64),
+		SourceUserName: source.Data.(string),
+		TargetUID:      i[TargetUID].Data.(int64),
+		TargetUserName: target.Data.(string),
+		Moved:          make(map[string]int64),
+		Resolved:       make([]string, 0),
+	}
+
+	// The archive holds the source as it was before the merge
+	archive := userArchive{
+		UID:      merge.SourceUID,
+		UserName: merge.SourceUserName,
+	}
+	userData, apiErr := snapshotUser(c, &archive)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	c = queueLdapAfterCommit(c)
+	if apiErr = removeArchivedUserFromLdap(c, archive.UserName, userData); apiErr != nil {
+		return nil, apiErr
+	}
+
+	// Conflicts, listed before the rows are moved
+	var resolved []string
+	err = c.DBtx.QueryRow(`select array(
+								select format('group %s: leader kept', g.name)
+								from user_group as s join user_group as t using(groupid) join groups as g using(groupid)
+								where s.uid = $1 and t.uid = $2 and s.is_leader and not t.is_leader
+								union all
+								select format('resource %s: shell %s and home directory %s of %s kept', cr.name, t.shell, t.home_dir, $3::text)
+								from compute_access as s join compute_access as t using(compid) join compute_resources as cr using(compid)
+								where s.uid = $1 and t.uid = $2
+								union all
+								select format('resource %s: primary group %s of %s kept, %s added as secondary', cr.name, tg.name, $3::text, sg.name)
+								from compute_access_group as s
+								join compute_access_group as t on t.compid = s.compid and t.is_primary and t.groupid != s.groupid
+								join compute_resources as cr on cr.compid = s.compid
+								join groups as sg on sg.groupid = s.groupid
+								join groups as tg on tg.groupid = t.groupid
+								where s.uid = $1 and t.uid = $2 and s.is_primary
+								union all
+								select format('fqan %s: merged, superuser %s, suspended %s', f.fqan,
+											  s.is_superuser or t.is_superuser, s.is_suspended and t.is_suspended)
+								from grid_access as s join grid_access as t using(fqanid) join grid_fqan as f using(fqanid)
+								where s.uid = $1 and t.uid = $2
+								union all
+								select format('attribute %s: value %s of %s kept, %s dropped', t.attribute, t.value, $3::text, s.value)
+								from external_affiliation_attribute as s join external_affiliation_attribute as t using(attribute)
+								where s.uid = $1 and t.uid = $2 and s.value != t.value))`,
+		merge.SourceUID, merge.TargetUID, merge.TargetUserName).Scan(pq.Array(&resolved))
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	merge.Resolved = append(merge.Resolved, resolved...)
+
+	moves := []struct {
+		table string
+		query string
+	}{
+		{"user_certificates", `update user_certificates set uid = $2, last_updated = NOW() where uid = $1`},
+		{"user_affiliation_units", `insert into user_affiliation_units (uid, unitid)
+									select $2, unitid from user_affiliation_units
+									where uid = $1 and unitid not in (select unitid from user_affiliation_units where uid = $2)`},
+		{"user_group", `update user_group as t set is_leader = true, last_updated = NOW()
+						from user_group as s
+						where s.uid = $1 and s.is_leader and t.uid = $2 and t.groupid = s.groupid and not t.is_leader`},
+		{"user_group", `insert into user_group (uid, groupid, is_leader, last_updated)
+						select $2, groupid, is_leader, NOW() from user_group
+						where uid = $1 and groupid not in (select groupid from user_group where uid = $2)`},
+		{"compute_access_group", `insert into compute_access_group (compid, uid, groupid, is_primary)
+								  select s.compid, $2, s.groupid,
+										 s.is_primary and not exists (select 1 from compute_access_group as p
+																	  where p.uid = $2 and p.compid = s.compid and p.is_primary)
+								  from compute_access_group as s
+								  where s.uid = $1
+									and not exists (select 1 from compute_access_group as t
+													where t.uid = $2 and t.compid = s.compid and t.groupid = s.groupid)`},
+		{"grid_access", `update grid_access as t set is_superuser = t.is_superuser or s.is_superuser,
+													 is_suspended = t.is_suspended and s.is_suspended, last_updated = NOW()
+						 from grid_access as s
+						 where s.uid = $1 and t.uid = $2 and t.fqanid = s.fqanid
+						   and (t.is_superuser != (t.is_superuser or s.is_superuser) or t.is_suspended != (t.is_suspended and s.is_suspended))`},
+		{"grid_access", `insert into grid_access (uid, fqanid, is_superuser, is_suspended, last_updated)
+						 select $2, fqanid, is_superuser, is_suspended, NOW() from grid_access
+						 where uid = $1 and fqanid not in (select fqanid from grid_access where uid = $2)`},
+		{"external_affiliation_attribute", `insert into external_affiliation_attribute (uid, attribute, value)
+											select $2, attribute, value from external_affiliation_attribute
+											where uid = $1 and attribute not in (select attribute from external_affiliation_attribute where uid = $2)`},
+		{"compute_resource_shared_account", `update compute_resource_shared_account as s set uid = $2, last_updated = NOW()
+											 where s.uid = $1 and s.sharedaccount_uid != $2
+											   and not exists (select 1 from compute_resource_shared_account as t
+															   where t.uid = $2 and t.sharedaccount_uid = s.sharedaccount_uid and t.compid = s.compid)`},
+		{"compute_resource_shared_account", `update compute_resource_shared_account as s set sharedaccount_uid = $2, last_updated = NOW()
+											 where s.sharedaccount_uid = $1 and s.uid != $2
+											   and not exists (select 1 from compute_resource_shared_account as t
+															   where t.sharedaccount_uid = $2 and t.uid = s.uid and t.compid = s.compid)`},
+	}
+
+	// Moved compute accesses get the default home directory of the resource for the target
+	type access struct {
+		compid      int64
+		shell       sql.NullString
+		homeDir     sql.NullString
+		defaultHome sql.NullString
+	}
+	var accesses []access
+	rows, err := c.DBtx.Query(`select ca.compid, ca.shell, ca.home_dir, cr.default_home_dir
+							   from compute_access as ca join compute_resources as cr using(compid)
+							   where ca.uid = $1 and ca.compid not in (select compid from compute_access where uid = $2)
+							   order by ca.compid`, merge.SourceUID, merge.TargetUID)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	for rows.Next() {
+		var a access
+		if err := rows.Scan(&a.compid, &a.shell, &a.homeDir, &a.defaultHome); err != nil {
+			rows.Close()
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		accesses = append(accesses, a)
+	}
+	rows.Close()
+
+	for _, a := range accesses {
+		if a.defaultHome.Valid {
+			a.homeDir = sql.NullString{String: userHomeDir(a.defaultHome.String, merge.TargetUserName), Valid: true}
+		}
+		_, err := c.DBtx.Exec(`insert into compute_access (compid, uid, shell, home_dir) values ($1, $2, $3, $4)`,
+			a.compid, merge.TargetUID, a.shell, a.homeDir)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		merge.Moved["compute_access"]++
+	}
+
+	for _, move := range moves {
+		res, err := c.DBtx.Exec(move.query, merge.SourceUID, merge.TargetUID)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		count, _ := res.RowsAffected()
+		merge.Moved[move.table] += count
+	}
+
+	// Storage quotas are compared in bytes, as their units may differ
+	type quota struct {
+		storageid int64
+		storage   string
+		permanent bool
+		value     string
+		unit      string
+		validTill sql.NullTime
+		path      sql.NullString
+	}
+	var quotas []quota
+	rows, err = c.DBtx.Query(`select sq.storageid, sr.name, sq.valid_until is null, sq.value::text, sq.unit, sq.valid_until, sq.path
+							   from storage_quota as sq join storage_resources as sr using(storageid)
+							   where sq.uid = $1
+							   order by sq.storageid`, merge.SourceUID)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	for rows.Next() {
+		var q quota
+		if err := rows.Scan(&q.storageid, &q.storage, &q.permanent, &q.value, &q.unit, &q.validTill, &q.path); err != nil {
+			rows.Close()
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		quotas = append(quotas, q)
+	}
+	rows.Close()
+
+	for _, q := range quotas {
+		var tValue, tUnit string
+		err := c.DBtx.QueryRow(`select value::text, unit from storage_quota
+								where storageid = $1 and uid = $2 and (valid_until is null) = $3`,
+			q.storageid, merge.TargetUID, q.permanent).Scan(&tValue, &tUnit)
+		if err == sql.ErrNoRows {
+			path := q.path
+			if q.path.Valid {
+				if renamed, changed := renamedValue(q.path.String, "/", merge.SourceUserName, merge.TargetUserName); changed {
+					path.String = renamed
+					merge.Resolved = append(merge.Resolved, fmt.Sprintf("storage %s: path %s moved to %s", q.storage, q.path.String, renamed))
+				} else {
+					merge.Resolved = append(merge.Resolved, fmt.Sprintf("storage %s: path %s kept", q.storage, q.path.String))
+				}
+			}
+			_, err = c.DBtx.Exec(`update storage_quota set uid = $3, path = $5, last_updated = NOW()
+								  where storageid = $1 and uid = $2 and (valid_until is null) = $4`,
+				q.storageid, merge.SourceUID, merge.TargetUID, q.permanent, path)
+			if err != nil {
+				log.WithFields(QueryFields(c)).Error(err)
+				apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+				return nil, apiErr
+			}
+			merge.Moved["storage_quota"]++
+			continue
+		} else if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+
+		sBytes, err := convertValue(q.value, q.unit, "B")
+		if err != nil {
+			apiErr = append(apiErr, APIError{fmt.Errorf("storage %s: cannot compare quota %s %s of %s: %s", q.storage, q.value, q.unit, merge.SourceUserName, err), ErrorAPIRequirement})
+			return nil, apiErr
+		}
+		tBytes, err := convertValue(tValue, tUnit, "B")
+		if err != nil {
+			apiErr = append(apiErr, APIError{fmt.Errorf("storage %s: cannot compare quota %s %s of %s: %s", q.storage, tValue, tUnit, merge.TargetUserName, err), ErrorAPIRequirement})
+			return nil, apiErr
+		}
+		if sBytes <= tBytes {
+			merge.Resolved = append(merge.Resolved, fmt.Sprintf("storage %s: quota %s %s of %s kept, %s %s dropped",
+				q.storage, tValue, tUnit, merge.TargetUserName, q.value, q.unit))
+			continue
+		}
+		_, err = c.DBtx.Exec(`update storage_quota set value = $4, unit = $5, valid_until = $6, last_updated = NOW()
+							  where storageid = $1 and uid = $2 and (valid_until is null) = $3`,
+			q.storageid, merge.TargetUID, q.permanent, q.value, q.unit, q.validTill)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		merge.Moved["storage_quota"]++
+		merge.Resolved = append(merge.Resolved, fmt.Sprintf("storage %s: quota %s %s of %s kept, %s %s replaced",
+			q.storage, q.value, q.unit, merge.SourceUserName, tValue, tUnit))
+	}
+
+	// Whatever was not moved is archived with the source
+	if apiErr = deleteUserRows(c, archive.UID); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr = insertArchive(c, &archive, userData); apiErr != nil {
+		return nil, apiErr
+	}
+	merge.ArchiveID = archive.ArchiveID
+
+	if targetActive.Valid && targetActive.Data.(bool) {
+		input := Input{
+			UserName: target,
+		}
+		if _, apiErr = addOrUpdateUserInLdap(c, input); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+
+	return merge, nil
+}
+
+// renameUser godoc
+// @Summary      Renames a user.
+// @Description  Renames a user and cascades the new name to the home directories, the storage quota paths and the CILogon
+// @Description  certificate DNs ending with the old name, and to the uid, mail and voPersonExternalID attributes in LDAP
+// @Description  once the rename is committed.  Returns every changed record.  The old name is kept as an alias for
+// @Description  rename.alias_days (default 90), lookups by the alias are redirected to the user until it expires or a new
+// @Description  user takes the name.
+// @Tags         Users
+// @Accept       html
+// @Produce      json
+// @Param        username       query     string  true  "current name of the user"
+// @Param        newusername    query     string  true  "new name of the user"
+// @Success      200  {object}  userRename
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /renameUser [put]
+func renameUser(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	oldName := i[UserName].Data.(string)
+	newName := i[NewUserName].Data.(string)
+
+	if strings.Contains(newName, " ") {
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, "Spaces are not allowed in uname."))
+		return nil, apiErr
+	}
+	if newName == oldName {
+		apiErr = append(apiErr, APIError{errors.New("newusername is the current name of the user"), ErrorAPIRequirement})
+		return nil, apiErr
+	}
+
+	uid := NewNullAttribute(UID)
+	var voPersonID sql.NullString
+	var nameTaken, aliasTaken bool
+
+	err := c.DBtx.QueryRow(`select (select uid from users where uname = $1),
+								   (select token_subject from users where uname = $1),
+								   exists (select 1 from users where uname = $2),
+								   exists (select 1 from user_aliases as a join users as u using(uid)
+										   where a.alias = $2 and a.valid_until > NOW() and u.uname != $1)`,
+		oldName, newName).Scan(&uid, &voPersonID, &nameTaken, &aliasTaken)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	if !uid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UserName))
+		return nil, apiErr
+	}
+	if nameTaken {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDuplicateData, NewUserName))
+	}
+	if aliasTaken {
+		apiErr = append(apiErr, APIError{fmt.Errorf("%s is an alias of another user", newName), ErrorAPIRequirement})
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	rename := userRename{
+		UID:         uid.Data.(int64),
+		OldUserName: oldName,
+		NewUserName: newName,
+		Changes:     make([]userRenameChange, 0),
+	}
+
+	_, err = c.DBtx.Exec(`update users set uname = $2, last_updated = NOW() where uid = $1`, uid, newName)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	rename.Changes = append(rename.Changes, userRenameChange{"users", fmt.Sprintf("uid %d", rename.UID), "uname", oldName, newName})
+
+	type record struct {
+		key   string
+		id    int64
+		value string
+	}
+	// args returns the arguments of update for a record renamed to value
+	cascades := []struct {
+		table  string
+		column string
+		prefix string
+		query  string
+		update string
+		args   func(r record, value string) []interface{}
+	}{
+		{"compute_access", "home_dir", "/",
+			`select cr.name, ca.compid, ca.home_dir from compute_access as ca join compute_resources as cr using(compid)
+			 where ca.uid = $1 and ca.home_dir is not null order by cr.name`,
+			`update compute_access set home_dir = $3, last_updated = NOW() where uid = $1 and compid = $2`,
+			func(r record, value string) []interface{} { return []interface{}{uid, r.id, value} }},
+		// A user may have several quotas on a storage resource, the path identifies the quota
+		{"storage_quota", "path", "/",
+			`select sr.name, sq.storageid, sq.path from storage_quota as sq join storage_resources as sr using(storageid)
+			 where sq.uid = $1 and sq.path is not null order by sr.name, sq.path`,
+			`update storage_quota set path = $3, last_updated = NOW() where uid = $1 and storageid = $2 and path = $4`,
+			func(r record, value string) []interface{} { return []interface{}{uid, r.id, value, r.value} }},
+		{"user_certificates", "dn", "/CN=UID:",
+			`select 'dnid ' || dnid, dnid, dn from user_certificates where uid = $1 order by dnid`,
+			`update user_certificates set dn = $3, last_updated = NOW() where uid = $1 and dnid = $2`,
+			func(r record, value string) []interface{} { return []interface{}{uid, r.id, value} }},
+	}
+	for _, cascade := range cascades {
+		rows, err := c.DBtx.Query(cascade.query, uid)
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		var records []record
+		for rows.Next() {
+			var r record
+			if err := rows.Scan(&r.key, &r.id, &r.value); err != nil {
+				rows.Close()
+				log.WithFields(QueryFields(c)).Error(err)
+				apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+				return nil, apiErr
+			}
+			records = append(records, r)
+		}
+		rows.Close()
+
+		for _, r := range records {
+			value, changed := renamedValue(r.value, cascade.prefix, oldName, newName)
+			if !changed {
+				continue
+			}
+			_, err := c.DBtx.Exec(cascade.update, cascade.args(r, value)...)
+			if err != nil {
+				log.WithFields(QueryFields(c)).Error(err)
+				if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+					apiErr = append(apiErr, APIError{fmt.Errorf("%s %s already exists", cascade.column, value), ErrorAPIRequirement})
+				} else {
+					apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+				}
+				return nil, apiErr
+			}
+			rename.Changes = append(rename.Changes, userRenameChange{cascade.table, r.key, cascade.column, r.value, value})
+		}
+	}
+
+	// Keep the old name as an alias, a previous alias of the new name is no longer needed
+	aliasDays := viper.GetInt("rename.alias_days")
+	if aliasDays <= 0 {
+		aliasDays = 90
+	}
+	_, err = c.DBtx.Exec(`delete from user_aliases where alias = $1 and uid = $2`, newName, uid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	err = c.DBtx.QueryRow(`insert into user_aliases (alias, uid, valid_until) values ($1, $2, NOW() + make_interval(days => $3))
+						   on conflict (alias) do update set uid = $2, valid_until = NOW() + make_interval(days => $3)
+						   returning valid_until`,
+		oldName, uid, aliasDays).Scan(&rename.AliasUntil)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	if voPersonID.Valid && len(voPersonID.String) > 0 {
+		// The LDAP entry is renamed once the rename is committed
+		c = queueLdapAfterCommit(c)
+		con, err := LDAPgetConnection(c, false)
+		if err != nil {
+			msg := fmt.Sprintf("LDAP, connection failed: %v", err)
+			log.Error(msg)
+			apiErr = append(apiErr, DefaultAPIError(ErrorText, msg))
+			return nil, apiErr
+		}
+		defer con.Close()
+
+		lData, err := LDAPgetUserData(voPersonID.String, con)
+		if err != nil {
+			log.Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorText, "Unable to get user's LDAP data."))
+			return nil, apiErr
+		}
+		// In a batch, the entry may be added by an earlier step and not be in LDAP yet, it then has the values set by
+		// addUserToLdapBase
+		if lData.Dn == "" {
+			lData.Dn = fmt.Sprintf("voPersonID=%s,%s", voPersonID.String, ldapConfig.Load().baseDN)
+			lData.Uid = oldName
+			lData.Mail = fmt.Sprintf("%s@%s", oldName, emailDomain())
+			lData.VoPersonExternalID = lData.Mail
+		}
+		mail := fmt.Sprintf("%s@%s", newName, emailDomain())
+		// mail also sets voPersonExternalID, which LDAPaddUser sets to the mail address
+		m := map[string]string{"uid": newName, "mail": mail}
+		if err := LdapModifyAttributes(lData.Dn, m, con); err != nil {
+			log.Errorf("LdapModifyAttributes failed: %s", err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorText, "Unable to rename the user in LDAP"))
+			return nil, apiErr
+		}
+		rename.Changes = append(rename.Changes,
+			userRenameChange{"ldap", lData.Dn, "uid", lData.Uid, newName},
+			userRenameChange{"ldap", lData.Dn, "mail", lData.Mail, mail},
+			userRenameChange{"ldap", lData.Dn, "voPersonExternalID", lData.VoPersonExternalID, mail})
+	}
+
+	return rename, nil
+}
+
+// userHomeDir returns the home directory of a user in a base directory.  Home directories in /nashome are sorted by the
+// first letter of the name.
+func userHomeDir(base string, uname string) string {
+	base = strings.TrimRight(base, "/")
+	if base == "/nashome" && len(uname) > 0 {
+		base += "/" + uname[0:1]
+	}
+	return base + "/" + uname
+}
+
+// renamedValue renames a home directory, storage quota path or DN built from a name, which ends with prefix followed
+// by the old name.  Returns false if the value does not end with the old name.
+func renamedValue(value string, prefix string, oldName string, newName string) (string, bool) {
+	if len(oldName) == 0 || !strings.HasSuffix(value, prefix+oldName) {
+		return value, false
+	}
+	base := strings.TrimSuffix(value, prefix+oldName)
+	if prefix == "/" {
+		if parent := strings.TrimSuffix(base, "/"+oldName[0:1]); parent != base && userHomeDir(parent, oldName) == value {
+			return userHomeDir(parent, newName), true
+		}
+	}
+	return base + prefix + newName, true
+}
+
+// resolveUserAlias replaces a username which is the unexpired alias of a renamed user by the current name of the user.
+// Names taken by a user since the rename are not redirected, neither is the name of a user being created.
+func resolveUserAlias(c APIContext, i Input) error {
+	if !i[UserName].Valid || c.API == "createUser" {
+		return nil
+	}
+
+	var uname string
+	err := c.DBtx.QueryRow(`select u.uname from user_aliases as a join users as u using(uid)
+							where a.alias = $1 and a.valid_until > NOW()
+							  and not exists (select 1 from users where uname = $1)`, i[UserName]).Scan(&uname)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.WithFields(QueryFields(c)).Infof("username %s is an alias of %s", i[UserName].Data, uname)
+	i[UserName] = NewNullAttribute(UserName).Default(uname)
+	return nil
+}
+
 // getUserAccessToComputeResources godoc
 // @Summary      Return a list of all the compute and storage resources the user has access to.
 // @Description  Return a list of all the compute and storage resources the user has access to.
@@ -2192,7 +2880,8 @@ func getUserAccessToComputeResources(c APIContext, i Input) (interface{}, []APIE
 								compute_resources as cr using(compid) join
 								compute_access_group as cag using(compid,uid) join
 								groups as g using(groupid)
-							   where ca.uid = $1 and (ca.last_updated>=$2 or $2 is null)`,
+							   where ca.uid = $1 and (ca.last_updated>=$2 or $2 is null)
+							   order by cr.name`,
 		uid, i[LastUpdated])
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
@@ -2268,7 +2957,7 @@ func getStorageQuotas(c APIContext, i Input) (interface{}, []APIError) {
 		return nil, apiErr
 	}
 
-	rows, err := DBptr.Query(`select uname, g.name, sr.name, path, value, unit, valid_until from
+	rows, err := c.DBtx.Query(`select uname, g.name, sr.name, path, value, unit, valid_until from
 								storage_quota as sq
 								left join users as u on sq.uid = u.uid
 								left join groups as g on sq.groupid = g.groupid
@@ -2400,12 +3089,7 @@ func setUserAccessToComputeResource(c APIContext, i Input) (interface{}, []APIEr
 	}
 
 	if dHome.Valid {
-		homeStr := strings.TrimRight(dHome.Data.(string), "/")
-		if homeStr == "/nashome" {
-			homeStr = "/nashome/" + i[UserName].Data.(string)[0:1]
-		}
-		homeStr = homeStr + "/" + i[UserName].Data.(string)
-		dHome.Scan(homeStr)
+		dHome.Scan(userHomeDir(dHome.Data.(string), i[UserName].Data.(string)))
 	}
 
 	shell := i[Shell].Default(dShell.Data.(string))
@@ -2475,6 +3159,10 @@ func setUserAccessToComputeResource(c APIContext, i Input) (interface{}, []APIEr
 // @Param        status         query     boolean false  "return only those with the specified status"  Format(true/false)
 // @Param        lastupdated    query     string  false  "return those updated since"  Format(date)
 // @Param        banned         query     boolean false  "If supplied, only users of that type will be returned."
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
 // @Success      200  {object}  allUsersAttributes
 // @Failure      400  {object}  jsonOutput
 // @Failure      401  {object}  jsonOutput
@@ -2484,12 +3172,24 @@ func getAllUsers(c APIContext, i Input) (interface{}, []APIError) {
 
 	status := i[Status].Default(false)
 
-	rows, err := DBptr.Query(`select uname, uid, full_name, status, cast(expiration_date as text), token_subject, is_banned
+	page, apiErr := newPage(i, map[Attribute]string{
+		UserName: "uname",
+		UID:      "uid",
+		FullName: "coalesce(full_name, '')",
+	}, UserName, "uid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(4)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`select %s, uname, uid, full_name, status, cast(expiration_date as text), token_subject, is_banned
 							  from users
 							  where (status=$1 or not $1)
 							    and (last_updated>=$2 or $2 is null)
 								and (is_banned=$3 or $3 is null)
-							  order by uname`, status, i[LastUpdated], i[Banned])
+								and %s
+							  %s %s`, page.columns(), after, page.orderBy(), page.limitBy()),
+		append([]interface{}{status, i[LastUpdated], i[Banned]}, args...)...)
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -2500,8 +3200,12 @@ func getAllUsers(c APIContext, i Input) (interface{}, []APIError) {
 	type jsonout map[Attribute]interface{}
 	var out []jsonout
 	for rows.Next() {
+		var sortValue, sortKey string
 		row := NewMapNullAttribute(UserName, UID, FullName, Status, ExpirationDate, TokenSubject, Banned)
-		rows.Scan(row[UserName], row[UID], row[FullName], row[Status], row[ExpirationDate], row[TokenSubject], row[Banned])
+		rows.Scan(&sortValue, &sortKey, row[UserName], row[UID], row[FullName], row[Status], row[ExpirationDate], row[TokenSubject], row[Banned])
+		if !page.add(sortValue, sortKey) {
+			break
+		}
 		var expirationDate interface{}
 		if row[ExpirationDate].Valid {
 			expirationDate = row[ExpirationDate].Data
@@ -2516,7 +3220,165 @@ func getAllUsers(c APIContext, i Input) (interface{}, []APIError) {
 			Banned:         row[Banned].Data,
 		})
 	}
-	return out, nil
+	return page.output(out), nil
+}
+
+// searchUsers godoc
+// @Summary      Searches users by name, email, status and membership.
+// @Description  Returns the users matching all the criteria given, ranked by how well they match fullname and email.
+// @Description  fullname and email are case-insensitive substrings, matches on the whole name, then on its beginning, then
+// @Description  on the beginning of a word rank first.  The score of each user is how well it matches, the higher the better.
+// @Description  FERRY does not store email addresses: the email returned and matched is derived from the username, as
+// @Description  username@ the domain set in email_domain, and may not be where the user receives mail.  attribute
+// @Description  and value match external affiliation attributes, value being case-insensitive.  Returns all users if no
+// @Description  criteria are given.
+// @Tags         Users
+// @Accept       html
+// @Produce      json
+// @Param        fullname       query     string  false  "substring of the full name"
+// @Param        email          query     string  false  "substring of the email address derived as username@email_domain"
+// @Param        status         query     boolean false  "return only those with the specified status"  Format(true/false)
+// @Param        banned         query     boolean false  "return only those banned or not"  Format(true/false)
+// @Param        groupaccount   query     boolean false  "return only group accounts or only personal accounts"  Format(true/false)
+// @Param        unitname       query     string  false  "return only members of the affiliation unit"
+// @Param        groupname      query     string  false  "return only members of the group"
+// @Param        grouptype      query     string  false  "type of groupname, default UnixGroup"
+// @Param        resourcename   query     string  false  "return only those with access to the compute resource"
+// @Param        expiresafter   query     string  false  "return those expiring on or after"  Format(date)
+// @Param        expiresbefore  query     string  false  "return those expiring before"  Format(date)
+// @Param        lastupdated    query     string  false  "return those updated since"  Format(date)
+// @Param        updatedbefore  query     string  false  "return those last updated before"  Format(date)
+// @Param        attribute      query     string  false  "return those with the external affiliation attribute"
+// @Param        value          query     string  false  "return those with an external affiliation attribute of this value"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order, default -score"
+// @Success      200  {object}  userSearchResult
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /searchUsers [get]
+func searchUsers(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	unitid := NewNullAttribute(UnitID)
+	groupid := NewNullAttribute(GroupID)
+	compid := NewNullAttribute(ResourceID)
+	validAttribute := true
+
+	grouptype := i[GroupType].Default("UnixGroup")
+
+	err := c.DBtx.QueryRow(`select (select unitid from affiliation_units where name = $1),
+								   (select groupid from groups where name = $2 and type::text = $3),
+								   (select compid from compute_resources where name = $4),
+								   $5::text is null or $5 = any (enum_range(null::external_affiliation_attribute_attribute_type)::text[])`,
+		i[UnitName], i[GroupName], grouptype, i[ResourceName], i[UserAttribute]).Scan(&unitid, &groupid, &compid, &validAttribute)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	if i[UnitName].Valid && !unitid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UnitName))
+	}
+	if i[GroupName].Valid && !groupid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, GroupName))
+	}
+	if i[ResourceName].Valid && !compid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, ResourceName))
+	}
+	if !validAttribute {
+		apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, UserAttribute))
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	page, apiErr := newPage(i, map[Attribute]string{
+		Score:    "score",
+		UserName: "uname",
+		UID:      "uid",
+		FullName: "coalesce(full_name, '')",
+	}, "-"+Score, "uname")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(16)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`select %s, score, uid, uname, full_name, email, status,
+									  is_banned, is_groupaccount, cast(expiration_date as text), last_updated
+							   from (select u.*, u.uname || '@' || $3::text as email,
+											(case when $1::text is null then 0
+												  when lower(u.full_name) = lower($1) then 6
+												  when strpos(lower(u.full_name), lower($1)) = 1 then 4
+												  when strpos(' ' || lower(u.full_name), ' ' || lower($1)) > 0 then 2
+												  else 0 end) +
+											(case when $2::text is null then 0
+												  when lower(u.uname || '@' || $3) = lower($2) or lower(u.uname) = lower($2) then 6
+												  when strpos(lower(u.uname || '@' || $3), lower($2)) = 1 then 4
+												  else 0 end) as score
+									 from users as u) as u
+							   where ($1::text is null or strpos(lower(full_name), lower($1)) > 0)
+								 and ($2::text is null or strpos(lower(email), lower($2)) > 0)
+								 and (status = $4 or $4 is null)
+								 and (is_banned = $5 or $5 is null)
+								 and (is_groupaccount = $6 or $6 is null)
+								 and ($7::bigint is null or uid in (select uid from user_affiliation_units where unitid = $7))
+								 and ($8::bigint is null or uid in (select uid from user_group where groupid = $8))
+								 and ($9::bigint is null or uid in (select uid from compute_access where compid = $9))
+								 and (expiration_date >= $10 or $10 is null)
+								 and (expiration_date < $11 or $11 is null)
+								 and (last_updated >= $12 or $12 is null)
+								 and (last_updated < $13 or $13 is null)
+								 and (($14::text is null and $15::text is null) or
+									  uid in (select uid from external_affiliation_attribute
+											  where (attribute::text = $14 or $14 is null)
+												and (lower(value) = lower($15) or $15 is null)))
+								 and %s
+							   %s %s`, page.columns(), after, page.orderBy(), page.limitBy()),
+		append([]interface{}{i[FullName], i[Email], emailDomain(), i[Status], i[Banned], i[GroupAccount], unitid, groupid, compid,
+			i[ExpiresAfter], i[ExpiresBefore], i[LastUpdated], i[UpdatedBefore], i[UserAttribute], i[Value]}, args...)...)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	type jsonout map[Attribute]interface{}
+	out := make([]jsonout, 0)
+	for rows.Next() {
+		var sortValue, sortKey string
+		row := NewMapNullAttribute(Score, UID, UserName, FullName, Email, Status, Banned, GroupAccount, ExpirationDate, LastUpdated)
+		err := rows.Scan(&sortValue, &sortKey, row[Score], row[UID], row[UserName], row[FullName], row[Email], row[Status], row[Banned],
+			row[GroupAccount], row[ExpirationDate], row[LastUpdated])
+		if err != nil {
+			log.WithFields(QueryFields(c)).Error(err)
+			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+			return nil, apiErr
+		}
+		if !page.add(sortValue, sortKey) {
+			break
+		}
+		var expirationDate interface{}
+		if row[ExpirationDate].Valid {
+			expirationDate = row[ExpirationDate].Data
+		}
+		out = append(out, jsonout{
+			Score:          row[Score].Data,
+			UID:            row[UID].Data,
+			UserName:       row[UserName].Data,
+			FullName:       row[FullName].Data,
+			Email:          row[Email].Data,
+			Status:         row[Status].Data,
+			Banned:         row[Banned].Data,
+			GroupAccount:   row[GroupAccount].Data,
+			ExpirationDate: expirationDate,
+			LastUpdated:    row[LastUpdated].Data,
+		})
+	}
+	return page.output(out), nil
 }
 
 // getAllUsersFQANs godoc
@@ -2527,6 +3389,10 @@ func getAllUsers(c APIContext, i Input) (interface{}, []APIError) {
 // @Produce      json
 // @Param        lastupdated     query     string  false  "limit results to records  updated since"  Format(date)
 // @Param        suspended       query     boolean  false  "limit to suspended or not suspended"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
 // @Success      200  {object}  main.userAllUserFQANs
 // @Failure      400  {object}  main.jsonOutput
 // @Failure      401  {object}  main.jsonOutput
@@ -2534,14 +3400,26 @@ func getAllUsers(c APIContext, i Input) (interface{}, []APIError) {
 func getAllUsersFQANs(c APIContext, i Input) (interface{}, []APIError) {
 	var apiErr []APIError
 
-	rows, err := DBptr.Query(`select uname, fqan, name, ga.is_suspended from grid_access as ga
-							  join grid_fqan as gf using(fqanid)
-							  join users as u using(uid)
-							  join affiliation_units as au using(unitid)
-							  where (ga.last_updated>=$2 or gf.last_updated>=$2 or
-									  u.last_updated>=$2 or au.last_updated>=$2 or $2 is null)
-									and (ga.is_suspended = $1 or $1 is null)  order by uname`,
-		i[Suspend], i[LastUpdated])
+	page, apiErr := newPage(i, map[Attribute]string{UserName: "uname"}, UserName, "uid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(3)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`with fqans as (
+								select uid, uname, fqan, name, ga.is_suspended from grid_access as ga
+								join grid_fqan as gf using(fqanid)
+								join users as u using(uid)
+								join affiliation_units as au using(unitid)
+								where (ga.last_updated>=$2 or gf.last_updated>=$2 or
+									   u.last_updated>=$2 or au.last_updated>=$2 or $2 is null)
+									  and (ga.is_suspended = $1 or $1 is null)
+							  ), page as (
+								select uid, uname from fqans where %s group by uid, uname %s %s
+							  )
+							  select %s, uname, fqan, name, is_suspended from fqans join page using(uid, uname)
+							  %s, name, fqan`, after, page.orderBy(), page.limitBy(), page.columns(), page.orderBy()),
+		append([]interface{}{i[Suspend], i[LastUpdated]}, args...)...)
 	if err != nil {
 		log.WithFields(QueryFields(c)).Error(err)
 		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
@@ -2550,19 +3428,27 @@ func getAllUsersFQANs(c APIContext, i Input) (interface{}, []APIError) {
 	defer rows.Close()
 
 	type jsonfqan map[Attribute]interface{}
-	out := make(map[string][]jsonfqan)
+	out := newOrderedMap()
 
 	for rows.Next() {
+		var sortValue, sortKey string
 		row := NewMapNullAttribute(UserName, FQAN, UnitName, Suspend)
-		rows.Scan(row[UserName], row[FQAN], row[UnitName], row[Suspend])
-		out[row[UserName].Data.(string)] = append(out[row[UserName].Data.(string)], jsonfqan{
+		rows.Scan(&sortValue, &sortKey, row[UserName], row[FQAN], row[UnitName], row[Suspend])
+		fqans, found := out.Get(row[UserName].Data.(string))
+		if !found {
+			if !page.add(sortValue, sortKey) {
+				break
+			}
+			fqans = make([]jsonfqan, 0)
+		}
+		out.Set(row[UserName].Data.(string), append(fqans.([]jsonfqan), jsonfqan{
 			FQAN:     row[FQAN].Data,
 			UnitName: row[UnitName].Data,
 			Suspend:  row[Suspend].Data,
-		})
+		}))
 	}
 
-	return out, nil
+	return page.output(out), nil
 }
 
 // setUserGridAccess godoc
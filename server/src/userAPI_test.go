@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestUserHomeDir(t *testing.T) {
+	tests := []struct {
+		base  string
+		uname string
+		home  string
+	}{
+		{"/home", "jdoe", "/home/jdoe"},
+		{"/home/", "jdoe", "/home/jdoe"},
+		{"/nashome", "jdoe", "/nashome/j/jdoe"},
+		{"/nashome/", "jdoe", "/nashome/j/jdoe"},
+		{"/nashome/j", "jdoe", "/nashome/j/jdoe"},
+		{"/nashome", "", "/nashome/"},
+	}
+
+	for _, test := range tests {
+		if home := userHomeDir(test.base, test.uname); home != test.home {
+			t.Errorf("userHomeDir(%q, %q): expected %q, got %q", test.base, test.uname, test.home, home)
+		}
+	}
+}
+
+func TestRenamedValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		prefix  string
+		renamed string
+		changed bool
+	}{
+		{"home directory", "/home/jdoe", "/", "/home/jsmith", true},
+		{"nashome directory", "/nashome/j/jdoe", "/", "/nashome/j/jsmith", true},
+		{"storage path", "/pnfs/dune/scratch/users/jdoe", "/", "/pnfs/dune/scratch/users/jsmith", true},
+		{"DN", "/DC=org/DC=cilogon/C=US/O=Fermi National Accelerator Laboratory/OU=People/CN=Jane Doe/CN=UID:jdoe", "/CN=UID:",
+			"/DC=org/DC=cilogon/C=US/O=Fermi National Accelerator Laboratory/OU=People/CN=Jane Doe/CN=UID:jsmith", true},
+		{"home directory of a longer name", "/home/jdoe2", "/", "/home/jdoe2", false},
+		{"nashome directory of a longer name", "/nashome/j/jdoe2", "/", "/nashome/j/jdoe2", false},
+		{"storage path of a longer name", "/pnfs/dune/scratch/users/jdoe2", "/", "/pnfs/dune/scratch/users/jdoe2", false},
+		{"DN of a longer name", "/DC=org/DC=cilogon/CN=UID:jdoe2", "/CN=UID:", "/DC=org/DC=cilogon/CN=UID:jdoe2", false},
+		{"name with a prefix", "/home/xjdoe", "/", "/home/xjdoe", false},
+		{"DN with a prefixed name", "/DC=org/DC=cilogon/CN=UID:xjdoe", "/CN=UID:", "/DC=org/DC=cilogon/CN=UID:xjdoe", false},
+		{"path without the name", "/pnfs/dune/persistent/shared", "/", "/pnfs/dune/persistent/shared", false},
+		{"path with the name inside", "/pnfs/dune/jdoe/data", "/", "/pnfs/dune/jdoe/data", false},
+		{"DN without the name", "/DC=org/DC=cilogon/CN=Jane Doe", "/CN=UID:", "/DC=org/DC=cilogon/CN=Jane Doe", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			renamed, changed := renamedValue(test.value, test.prefix, "jdoe", "jsmith")
+			if renamed != test.renamed || changed != test.changed {
+				t.Errorf("expected %q %v, got %q %v", test.renamed, test.changed, renamed, changed)
+			}
+		})
+	}
+
+	if renamed, changed := renamedValue("/nashome/j/jdoe", "/", "jdoe", "asmith"); renamed != "/nashome/a/asmith" || !changed {
+		t.Errorf("expected the nashome directory to move to the letter of the new name, got %q %v", renamed, changed)
+	}
+	if renamed, changed := renamedValue("/data/j/jdoe", "/", "jdoe", "asmith"); renamed != "/data/j/asmith" || !changed {
+		t.Errorf("expected only nashome directories to move to the letter of the new name, got %q %v", renamed, changed)
+	}
+	if renamed, changed := renamedValue("/home/jdoe", "/", "", "asmith"); renamed != "/home/jdoe" || changed {
+		t.Errorf("expected an empty old name to change nothing, got %q %v", renamed, changed)
+	}
+}
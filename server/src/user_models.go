@@ -1,5 +1,10 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type userAttributes struct {
 	Banned         bool   `json:"banned"`
 	ExpirationDate string `json:"expirationdate"`
@@ -103,3 +108,55 @@ type userGroupComputeResources struct {
 }
 
 type userGroupComputeResourcesMap []userGroupComputeResources
+
+// userArchive describes an archive of a user
+type userArchive struct {
+	ArchiveID   int64           `json:"archiveid"`
+	UID         int64           `json:"uid"`
+	UserName    string          `json:"username"`
+	DateDeleted time.Time       `json:"datedeleted"`
+	Rows        map[string]int  `json:"rows,omitempty"`
+	UserData    json.RawMessage `json:"userdata,omitempty"`
+}
+
+type userSearchResult struct {
+	Score          int    `json:"score"`
+	UID            int    `json:"uid"`
+	UserName       string `json:"username"`
+	FullName       string `json:"fullname"`
+	Email          string `json:"email"`
+	Status         bool   `json:"status"`
+	Banned         bool   `json:"banned"`
+	GroupAccount   bool   `json:"groupaccount"`
+	ExpirationDate string `json:"expirationdate"`
+	LastUpdated    string `json:"lastupdated"`
+}
+
+// userMerge describes the merge of a user into another
+type userMerge struct {
+	SourceUID      int64            `json:"sourceuid"`
+	SourceUserName string           `json:"sourceusername"`
+	TargetUID      int64            `json:"targetuid"`
+	TargetUserName string           `json:"targetusername"`
+	Moved          map[string]int64 `json:"moved"`
+	Resolved       []string         `json:"resolved"`
+	ArchiveID      int64            `json:"archiveid"`
+}
+
+// userRename describes the rename of a user
+type userRename struct {
+	UID         int64              `json:"uid"`
+	OldUserName string             `json:"oldusername"`
+	NewUserName string             `json:"newusername"`
+	AliasUntil  time.Time          `json:"aliasuntil"`
+	Changes     []userRenameChange `json:"changes"`
+}
+
+// userRenameChange describes a record changed by a rename
+type userRenameChange struct {
+	Table    string `json:"table"`
+	Record   string `json:"record"`
+	Column   string `json:"column"`
+	OldValue string `json:"oldvalue"`
+	NewValue string `json:"newvalue"`
+}
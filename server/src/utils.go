@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 func getTableColumns(c APIContext, tableName string) ([]string, []APIError) {
@@ -169,7 +171,7 @@ func ExtractValidDN(dn string) (string, error) {
 	if err != nil {
 		return formatedDN, err
 	}
-	ca, err := ValidCAs.MatchCA(formatedDN)
+	ca, err := validCAs.Load().MatchCA(formatedDN)
 	if err != nil {
 		return formatedDN, err
 	}
@@ -212,3 +214,23 @@ func isFiscalYearValid(i Input) bool {
 	}
 	return true
 }
+
+// emailDomain returns the domain of the email addresses of users, set in email_domain.  FERRY does not store email
+// addresses, the mail attribute of users in LDAP and the expiration warnings use username@email_domain.
+func emailDomain() string {
+	domain := viper.GetString("email_domain")
+	if domain == "" {
+		domain = "fnal.gov"
+	}
+	return domain
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// webhookEvents maps write APIs to the type of change event they emit
+var webhookEvents = map[string]string{
+	"createUser":                             "user.created",
+	"setUserInfo":                            "user.updated",
+	"setUserShell":                           "user.updated",
+	"setUserShellAndHomeDir":                 "user.updated",
+	"setUserExternalAffiliationAttribute":    "user.updated",
+	"removeUserExternalAffiliationAttribute": "user.updated",
+	"expireUser":                             "user.updated",
+	"dropUser":                               "user.deleted",
+	"archiveUser":                            "user.deleted",
+	"restoreUser":                            "user.created",
+	"mergeUsers":                             "user.deleted",
+	"renameUser":                             "user.updated",
+	"banUser":                                "user.banned",
+	"addUserToGroup":                         "membership.changed",
+	"removeUserFromGroup":                    "membership.changed",
+	"setGroupLeader":                         "membership.changed",
+	"removeGroupLeader":                      "membership.changed",
+	"addUserToExperiment":                    "membership.changed",
+	"removeUserFromExperiment":               "membership.changed",
+	"addLPCConvener":                         "membership.changed",
+	"removeLPCConvener":                      "membership.changed",
+	"createGroup":                            "group.changed",
+	"addGroupToUnit":                         "group.changed",
+	"removeGroupFromUnit":                    "group.changed",
+	"setGroupRequired":                       "group.changed",
+	"setPrimaryStatusGroup":                  "group.changed",
+	"addLPCCollaborationGroup":               "group.changed",
+	"setStorageQuota":                        "quota.changed",
+	"setCondorQuota":                         "quota.changed",
+	"removeCondorQuota":                      "quota.changed",
+	"cleanStorageQuotas":                     "quota.changed",
+	"cleanCondorQuotas":                      "quota.changed",
+	"setUserExperimentFQAN":                  "fqan.mapped",
+	"removeUserExperimentFQAN":               "fqan.mapped",
+	"setUserGridAccess":                      "fqan.mapped",
+	"createFQAN":                             "fqan.changed",
+	"removeFQAN":                             "fqan.changed",
+	"setFQANMappings":                        "fqan.changed",
+	"addCertificateDNToUser":                 "certificate.changed",
+	"removeUserCertificateDN":                "certificate.changed",
+	"setLPCStorageAccess":                    "certificate.changed",
+	"setUserAccessToComputeResource":         "computeaccess.changed",
+	"removeUserFromComputeResource":          "computeaccess.changed",
+	"createAffiliationUnit":                  "unit.changed",
+	"setAffiliationUnitInfo":                 "unit.changed",
+	"removeAffiliationUnit":                  "unit.changed",
+	"createExperiment":                       "unit.changed",
+	"createComputeResource":                  "resource.changed",
+	"setComputeResourceInfo":                 "resource.changed",
+	"createStorageResource":                  "resource.changed",
+	"setStorageResourceInfo":                 "resource.changed",
+}
+
+// IncludeWebhookAPIs includes all APIs described in this file in an APICollection
+func IncludeWebhookAPIs(c *APICollection) {
+	createWebhook := BaseAPI{
+		InputModel{
+			Parameter{URL, true},
+			Parameter{EventTypes, false},
+			Parameter{UnitName, false},
+			Parameter{ResourceName, false},
+		},
+		createWebhook,
+		RoleWrite,
+		[]Attribute{UnitName, ResourceName},
+	}
+	c.Add("createWebhook", &createWebhook)
+
+	getWebhooks := BaseAPI{
+		InputModel{
+			Parameter{UnitName, false},
+			Parameter{ResourceName, false},
+		},
+		getWebhooks,
+		RoleRead,
+		[]Attribute{UnitName, ResourceName},
+	}
+	c.Add("getWebhooks", &getWebhooks)
+
+	removeWebhook := BaseAPI{
+		InputModel{
+			Parameter{WebhookID, true},
+		},
+		removeWebhook,
+		RoleWrite,
+		nil,
+	}
+	c.Add("removeWebhook", &removeWebhook)
+
+	getWebhookDeliveries := PagedAPI(
+		InputModel{
+			Parameter{WebhookID, true},
+			Parameter{Status, false},
+		},
+		getWebhookDeliveries,
+		RoleRead,
+		nil,
+	)
+	c.Add("getWebhookDeliveries", &getWebhookDeliveries)
+}
+
+// webhookScope holds the affiliation units and compute resources affected by a write API call
+type webhookScope struct {
+	units     []int64
+	resources []int64
+}
+
+// resolveWebhookScope finds the affiliation units and compute resources affected by a write API call.  The unit and
+// resource given as input are used when present, otherwise those of the group or, failing that, of the users affected.
+// It is called before and after the API runs, so entities created or removed by the call are both found.
+func resolveWebhookScope(c APIContext, i Input) (webhookScope, error) {
+	var scope webhookScope
+	if _, found := webhookEvents[c.API]; !found {
+		return scope, nil
+	}
+
+	found, err := queryScope(c, i, false)
+	if err != nil {
+		return scope, err
+	}
+
+	return webhookScope{found.unitIDs, found.resourceIDs}, nil
+}
+
+// queueWebhookEvents queues the change event of a write API for every matching webhook using the API Transaction.
+// Webhooks scoped to a unit or resource match if it was affected by the call, before or after it ran.
+// Events are delivered only if the Transaction is committed.
+func queueWebhookEvents(c APIContext, i Input, before webhookScope) error {
+	eventType, found := webhookEvents[c.API]
+	if !found {
+		return nil
+	}
+
+	after, err := resolveWebhookScope(c, i)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":   eventType,
+		"api":     c.API,
+		"subject": c.Subject,
+		"time":    time.Now().UTC().Format(time.RFC3339),
+		"input":   auditInput(i),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.DBtx.Exec(`insert into webhook_deliveries (webhookid, event_type, payload)
+						  select webhookid, $1, $2 from webhooks as w
+						  where w.active
+							and ($1 = any(w.event_types) or w.event_types is null)
+							and (w.unitid is null or w.unitid = any($3))
+							and (w.compid is null or w.compid = any($4))`,
+		eventType, string(payload), pq.Array(append(before.units, after.units...)),
+		pq.Array(append(before.resources, after.resources...)))
+
+	return err
+}
+
+// webhookBatchSize is the number of events claimed at once for delivery, and webhookClaimSize the number claimed for a
+// single webhook so one endpoint cannot take the whole batch
+const (
+	webhookBatchSize = 100
+	webhookClaimSize = 10
+)
+
+// WebhookInitialize starts delivering queued webhook events in the background
+func WebhookInitialize() {
+	webhookConfig := viper.GetStringMapString("webhooks")
+
+	interval, err := time.ParseDuration(webhookConfig["interval"])
+	if err != nil {
+		interval = 10 * time.Second
+	}
+	timeout, err := time.ParseDuration(webhookConfig["timeout"])
+	if err != nil {
+		timeout = 10 * time.Second
+	}
+	maxAttempts := viper.GetInt("webhooks.maxattempts")
+	if maxAttempts < 1 {
+		maxAttempts = 10
+	}
+	workers := viper.GetInt("webhooks.workers")
+	if workers < 1 {
+		workers = 8
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	go func() {
+		for {
+			deliverWebhooks(client, maxAttempts, workers)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// webhookDelivery is a queued event claimed for delivery
+type webhookDelivery struct {
+	id        int64
+	webhookid int64
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// deliverWebhooks sends the events due for delivery.  Events are claimed by moving their next attempt past the time
+// needed to deliver them all, in a short transaction, so several servers can share the same queue.  They are then posted
+// without holding any lock and the result of each one is recorded.  Events claimed by a server that stops are retried
+// once the claim expires.  The events of a webhook are posted in order, up to workers webhooks at a time.  A webhook
+// whose post fails gets no more posts until the failed event is retried: its other claimed events are released, but no
+// event is claimed while an earlier one of the same webhook waits for its retry, so a slow endpoint only delays its own
+// events.
+func deliverWebhooks(client *http.Client, maxAttempts int, workers int) {
+	fields := log.Fields{"action": "deliverWebhooks"}
+	claim := client.Timeout * (webhookBatchSize + 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), claim)
+	defer cancel()
+
+	rows, err := DBptr.QueryContext(ctx, `update webhook_deliveries as d set next_attempt = NOW() + $1 * interval '1 second'
+										  from webhooks as w
+										  where w.webhookid = d.webhookid
+											and d.deliveryid in (select deliveryid from webhook_deliveries
+																 where deliveryid in (select deliveryid
+																					  from (select deliveryid, row_number() over
+																								(partition by webhookid order by deliveryid) as n
+																							from webhook_deliveries
+																							where delivered is null and not abandoned
+																							  and next_attempt <= NOW()
+																							  and not exists (select 1 from webhook_deliveries as e
+																											  where e.webhookid = webhook_deliveries.webhookid
+																												and e.deliveryid < webhook_deliveries.deliveryid
+																												and e.delivered is null and not e.abandoned
+																												and e.next_attempt > NOW())) as due
+																					  where n <= $3
+																					  order by deliveryid limit $2)
+																   and delivered is null and not abandoned and next_attempt <= NOW()
+																 for update skip locked)
+										  returning d.deliveryid, d.webhookid, d.event_type, d.payload, d.attempts, w.url, w.secret`,
+		claim.Seconds(), webhookBatchSize, webhookClaimSize)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		return
+	}
+
+	queues := make(map[int64][]webhookDelivery)
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.id, &d.webhookid, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			log.WithFields(fields).Error(err)
+			continue
+		}
+		queues[d.webhookid] = append(queues[d.webhookid], d)
+	}
+	rows.Close()
+
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		sort.Slice(queue, func(a, b int) bool { return queue[a].id < queue[b].id })
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(queue []webhookDelivery) {
+			defer func() { <-slots; wg.Done() }()
+			unsent := postWebhookQueue(queue, func(d webhookDelivery) bool {
+				return deliverWebhook(ctx, client, d, maxAttempts)
+			})
+			releaseWebhookClaims(ctx, unsent)
+		}(queue)
+	}
+	wg.Wait()
+}
+
+// postWebhookQueue posts the events of a webhook in order until one fails, returning the events left unsent
+func postWebhookQueue(queue []webhookDelivery, post func(webhookDelivery) bool) []webhookDelivery {
+	for n, d := range queue {
+		if !post(d) {
+			return queue[n+1:]
+		}
+	}
+	return nil
+}
+
+// deliverWebhook posts a claimed event and records the result, returning whether the post succeeded
+func deliverWebhook(ctx context.Context, client *http.Client, d webhookDelivery, maxAttempts int) bool {
+	fields := log.Fields{"action": "deliverWebhooks", "deliveryid": d.id, "url": d.url}
+
+	err := sendWebhook(client, d.url, d.secret, d.id, d.eventType, d.payload)
+	if err == nil {
+		_, err = DBptr.ExecContext(ctx, `update webhook_deliveries set delivered = NOW(), attempts = attempts + 1, last_error = null
+										 where deliveryid = $1`, d.id)
+		if err != nil {
+			log.WithFields(fields).Error(err)
+		}
+		return true
+	}
+
+	log.WithFields(fields).Warn(err)
+	attempts := d.attempts + 1
+	_, err = DBptr.ExecContext(ctx, `update webhook_deliveries set attempts = $2, last_error = $3, abandoned = $4,
+									 next_attempt = NOW() + $5 * interval '1 second'
+									 where deliveryid = $1`, d.id, attempts, err.Error(), attempts >= maxAttempts,
+		webhookBackoff(attempts).Seconds())
+	if err != nil {
+		log.WithFields(fields).Error(err)
+	}
+	if attempts >= maxAttempts {
+		log.WithFields(fields).Error("webhook delivery abandoned")
+	}
+	return false
+}
+
+// releaseWebhookClaims makes claimed events that were not posted due again, once the earlier events are delivered
+func releaseWebhookClaims(ctx context.Context, queue []webhookDelivery) {
+	if len(queue) == 0 {
+		return
+	}
+	ids := make([]int64, 0, len(queue))
+	for _, d := range queue {
+		ids = append(ids, d.id)
+	}
+	_, err := DBptr.ExecContext(ctx, `update webhook_deliveries set next_attempt = NOW()
+									  where deliveryid = any($1) and delivered is null`, pq.Array(ids))
+	if err != nil {
+		log.WithFields(log.Fields{"action": "deliverWebhooks"}).Error(err)
+	}
+}
+
+// webhookBackoff returns the delay before retrying a delivery that failed attempts times, doubling from 2 minutes up to
+// about 3 days
+func webhookBackoff(attempts int) time.Duration {
+	return time.Duration(1<<uint(min(attempts, 12))) * time.Minute
+}
+
+// sendWebhook posts an event signed with HMAC-SHA256 using the webhook secret
+func sendWebhook(client *http.Client, url string, secret string, id int64, eventType string, payload []byte) error {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Ferry-Event", eventType)
+	req.Header.Set("X-Ferry-Delivery", fmt.Sprint(id))
+	req.Header.Set("X-Ferry-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// createWebhook godoc
+// @Summary      Registers a webhook to receive change events.
+// @Description  Registers a webhook to receive change events.  Events are posted as JSON and signed with HMAC-SHA256 using the
+// @Description  returned secret in the X-Ferry-Signature header.  Failed deliveries are retried with exponential backoff.
+// @Description  Events can be limited to a list of types and scoped to an affiliation unit and/or a compute resource.
+// @Tags         Webhooks
+// @Accept       html
+// @Produce      json
+// @Param        eventtypes     query     string  false  "comma separated list of event types to send, default all"
+// @Param        resourcename   query     string  false  "send only events for this compute resource"
+// @Param        unitname       query     string  false  "send only events for this affiliation unit"
+// @Param        url            query     string  true   "https URL events are posted to, http is only accepted if webhooks.allow_http is set"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /createWebhook [post]
+func createWebhook(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	hookURL, err := url.Parse(i[URL].Data.(string))
+	if err != nil || (hookURL.Scheme != "https" && hookURL.Scheme != "http") || hookURL.Host == "" {
+		apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, URL))
+		return nil, apiErr
+	}
+	if hookURL.Scheme == "http" && !viper.GetBool("webhooks.allow_http") {
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, "webhooks must use https"))
+		return nil, apiErr
+	}
+
+	var eventTypes []string
+	if i[EventTypes].Valid {
+		valid := make(map[string]bool)
+		for _, t := range webhookEvents {
+			valid[t] = true
+		}
+		for _, t := range strings.Split(i[EventTypes].Data.(string), ",") {
+			t = strings.TrimSpace(t)
+			if !valid[t] {
+				apiErr = append(apiErr, DefaultAPIError(ErrorInvalidData, fmt.Sprintf("event type %s", t)))
+				continue
+			}
+			eventTypes = append(eventTypes, t)
+		}
+		if len(apiErr) > 0 {
+			return nil, apiErr
+		}
+	}
+
+	unitid := NewNullAttribute(UnitID)
+	compid := NewNullAttribute(ResourceID)
+	err = c.DBtx.QueryRow(`select (select unitid from affiliation_units where name = $1),
+								  (select compid from compute_resources where name = $2)`,
+		i[UnitName], i[ResourceName]).Scan(&unitid, &compid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	if i[UnitName].Valid && !unitid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, UnitName))
+	}
+	if i[ResourceName].Valid && !compid.Valid {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, ResourceName))
+	}
+	if len(apiErr) > 0 {
+		return nil, apiErr
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorText, "unable to generate webhook secret"))
+		return nil, apiErr
+	}
+	secret := hex.EncodeToString(key)
+
+	var events interface{}
+	if eventTypes != nil {
+		events = pq.Array(eventTypes)
+	}
+
+	webhookid := NewNullAttribute(WebhookID)
+	err = c.DBtx.QueryRow(`insert into webhooks (url, secret, event_types, unitid, compid)
+						   values ($1, $2, $3, $4, $5) returning webhookid`,
+		hookURL.String(), secret, events, unitid, compid).Scan(&webhookid)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	const Secret Attribute = "secret"
+	return map[Attribute]interface{}{WebhookID: webhookid.Data, Secret: secret}, nil
+}
+
+// getWebhooks godoc
+// @Summary      Returns the registered webhooks.
+// @Description  Returns the active registered webhooks with the number of pending and abandoned deliveries.  Secrets are not returned.
+// @Tags         Webhooks
+// @Accept       html
+// @Produce      json
+// @Param        resourcename   query     string  false  "limit results to webhooks scoped to this compute resource"
+// @Param        unitname       query     string  false  "limit results to webhooks scoped to this affiliation unit"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getWebhooks [get]
+func getWebhooks(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	rows, err := c.DBtx.Query(`select webhookid, url, array_to_string(event_types, ','), au.name, cr.name,
+								 (select count(*) from webhook_deliveries as d
+								  where d.webhookid = w.webhookid and delivered is null and not abandoned),
+								 (select count(*) from webhook_deliveries as d
+								  where d.webhookid = w.webhookid and abandoned)
+							   from webhooks as w
+							   left join affiliation_units as au using(unitid)
+							   left join compute_resources as cr using(compid)
+							   where w.active and (au.name = $1 or $1 is null) and (cr.name = $2 or $2 is null)
+							   order by webhookid`, i[UnitName], i[ResourceName])
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	const Pending Attribute = "pending"
+	const Abandoned Attribute = "abandoned"
+
+	type jsonentry map[Attribute]interface{}
+	out := make([]jsonentry, 0)
+
+	for rows.Next() {
+		var pending, abandoned int64
+		row := NewMapNullAttribute(WebhookID, URL, EventTypes, UnitName, ResourceName)
+		rows.Scan(row[WebhookID], row[URL], row[EventTypes], row[UnitName], row[ResourceName], &pending, &abandoned)
+		out = append(out, jsonentry{
+			WebhookID:    row[WebhookID].Data,
+			URL:          row[URL].Data,
+			EventTypes:   row[EventTypes].Data,
+			UnitName:     row[UnitName].Data,
+			ResourceName: row[ResourceName].Data,
+			Pending:      pending,
+			Abandoned:    abandoned,
+		})
+	}
+
+	return out, nil
+}
+
+// removeWebhook godoc
+// @Summary      Removes a webhook.
+// @Description  Deactivates a webhook.  Pending deliveries are abandoned.
+// @Tags         Webhooks
+// @Accept       html
+// @Produce      json
+// @Param        webhookid      query     int     true   "id of the webhook to remove"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /removeWebhook [put]
+func removeWebhook(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	result, err := c.DBtx.Exec(`update webhooks set active = false where webhookid = $1 and active`, i[WebhookID])
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		apiErr = append(apiErr, DefaultAPIError(ErrorDataNotFound, WebhookID))
+		return nil, apiErr
+	}
+
+	_, err = c.DBtx.Exec(`update webhook_deliveries set abandoned = true
+						  where webhookid = $1 and delivered is null`, i[WebhookID])
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+
+	return nil, nil
+}
+
+// getWebhookDeliveries godoc
+// @Summary      Returns the deliveries of a webhook.
+// @Description  Returns the deliveries of a webhook.  With status=false only the pending and abandoned deliveries are returned.
+// @Tags         Webhooks
+// @Accept       html
+// @Produce      json
+// @Param        status         query     boolean false  "true for delivered events only, false for pending and abandoned events only"
+// @Param        webhookid      query     int     true   "id of the webhook"
+// @Param        cursor         query     string  false  "return the page following this cursor, as returned in ferry_next_cursor"
+// @Param        fields         query     string  false  "comma separated list of fields to return"
+// @Param        limit          query     int     false  "maximum number of records to return"
+// @Param        sort           query     string  false  "field to sort by, prefix with - for descending order"
+// @Success      200  {object}  jsonOutput
+// @Failure      400  {object}  jsonOutput
+// @Failure      401  {object}  jsonOutput
+// @Router /getWebhookDeliveries [get]
+func getWebhookDeliveries(c APIContext, i Input) (interface{}, []APIError) {
+	var apiErr []APIError
+
+	page, apiErr := newPage(i, map[Attribute]string{DeliveryID: "deliveryid"}, DeliveryID, "deliveryid")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	after, args := page.where(3)
+
+	rows, err := c.DBtx.Query(fmt.Sprintf(`select %s, deliveryid, event_type, attempts, created, next_attempt, delivered, abandoned, last_error
+							   from webhook_deliveries
+							   where webhookid = $1 and ((delivered is not null) = $2 or $2 is null) and %s
+							   %s %s`, page.columns(), after, page.orderBy(), page.limitBy()),
+		append([]interface{}{i[WebhookID], i[Status]}, args...)...)
+	if err != nil {
+		log.WithFields(QueryFields(c)).Error(err)
+		apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
+		return nil, apiErr
+	}
+	defer rows.Close()
+
+	const EventType Attribute = "eventtype"
+	const Attempts Attribute = "attempts"
+	const Created Attribute = "created"
+	const NextAttempt Attribute = "nextattempt"
+	const Delivered Attribute = "delivered"
+	const Abandoned Attribute = "abandoned"
+	const LastError Attribute = "lasterror"
+
+	type jsonentry map[Attribute]interface{}
+	out := make([]jsonentry, 0)
+
+	for rows.Next() {
+		var id, attempts int64
+		var eventType string
+		var created, nextAttempt time.Time
+		var delivered pq.NullTime
+		var abandoned bool
+		var lastError sql.NullString
+		var sortValue, sortKey string
+		rows.Scan(&sortValue, &sortKey, &id, &eventType, &attempts, &created, &nextAttempt, &delivered, &abandoned, &lastError)
+		if !page.add(sortValue, sortKey) {
+			break
+		}
+
+		entry := jsonentry{
+			DeliveryID:  id,
+			EventType:   eventType,
+			Attempts:    attempts,
+			Created:     created,
+			NextAttempt: nextAttempt,
+			Delivered:   nil,
+			Abandoned:   abandoned,
+			LastError:   nil,
+		}
+		if delivered.Valid {
+			entry[Delivered] = delivered.Time
+			entry[NextAttempt] = nil
+		}
+		if lastError.Valid {
+			entry[LastError] = lastError.String
+		}
+		out = append(out, entry)
+	}
+
+	return page.output(out), nil
+}
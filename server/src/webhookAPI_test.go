@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPostWebhookQueue(t *testing.T) {
+	queue := []webhookDelivery{{id: 1}, {id: 2}, {id: 3}}
+
+	tests := []struct {
+		name   string
+		fail   int64
+		posted []int64
+		unsent []int64
+	}{
+		{"all posted", 0, []int64{1, 2, 3}, nil},
+		{"first fails", 1, []int64{1}, []int64{2, 3}},
+		{"middle fails", 2, []int64{1, 2}, []int64{3}},
+		{"last fails", 3, []int64{1, 2, 3}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var posted []int64
+			unsent := postWebhookQueue(queue, func(d webhookDelivery) bool {
+				posted = append(posted, d.id)
+				return d.id != test.fail
+			})
+
+			var unsentIDs []int64
+			for _, d := range unsent {
+				unsentIDs = append(unsentIDs, d.id)
+			}
+			if !reflect.DeepEqual(posted, test.posted) {
+				t.Errorf("expected posts %v, got %v", test.posted, posted)
+			}
+			if !reflect.DeepEqual(unsentIDs, test.unsent) {
+				t.Errorf("expected unsent %v, got %v", test.unsent, unsentIDs)
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		addUserToExperiment,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("addUserToExperiment", &addUserToExperiment)
 
@@ -28,6 +29,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		removeUserFromExperiment,
 		RoleWrite,
+		[]Attribute{UnitName, UserName},
 	}
 	c.Add("removeUserFromExperiment", &removeUserFromExperiment)
 
@@ -39,6 +41,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		addLPCCollaborationGroup,
 		RoleWrite,
+		[]Attribute{GroupName},
 	}
 	c.Add("addLPCCollaborationGroup", &addLPCCollaborationGroup)
 
@@ -50,6 +53,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		setLPCStorageAccess,
 		RoleWrite,
+		[]Attribute{UserName},
 	}
 	c.Add("setLPCStorageAccess", &setLPCStorageAccess)
 
@@ -60,6 +64,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		addLPCConvener,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("addLPCConvener", &addLPCConvener)
 
@@ -71,6 +76,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		removeLPCConvener,
 		RoleWrite,
+		[]Attribute{GroupName, UserName},
 	}
 	c.Add("removeLPCConvener", &removeLPCConvener)
 
@@ -85,6 +91,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		},
 		createExperiment,
 		RoleWrite,
+		[]Attribute{UnitName, GroupName, UserName},
 	}
 	c.Add("createExperiment", &createExperiment)
 
@@ -92,6 +99,7 @@ func IncludeWrapperAPIs(c *APICollection) {
 		nil,
 		testWrapper,
 		RolePublic,
+		nil,
 	}
 	c.Add("testWrapper", &testWrapper)
 }
@@ -330,7 +338,7 @@ func addUserToExperiment(c APIContext, i Input) (interface{}, []APIError) {
 	}
 
 	if i[UnitName].Data.(string) == "cms" {
-		rows, err := c.DBtx.Query(`select name, default_path, default_quota, default_unit from storage_resources`)
+		rows, err := c.DBtx.Query(`select name, default_path, default_quota, default_unit from storage_resources order by name`)
 		if err != nil {
 			log.WithFields(QueryFields(c)).Error(err)
 			apiErr = append(apiErr, DefaultAPIError(ErrorDbQuery, nil))
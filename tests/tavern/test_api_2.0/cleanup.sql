@@ -3,3 +3,9 @@ delete from compute_access_group where compid=74 and uid=6956;
 delete from compute_access where compid=74 and uid=6956;
 select removeUserFromExperiment('napier', 'ebd');
 delete from user_group where groupid=5485 and uid=1136;
+delete from accessor_policies where accid in (select accid from accessors where name = '192.0.2.20');
+delete from accessors where name = '192.0.2.20';
+delete from accessors where name = '192.0.2.40';
+delete from webhook_deliveries where webhookid in (select webhookid from webhooks where url = 'https://localhost:1/tavern');
+delete from webhooks where url = 'https://localhost:1/tavern';
+delete from affiliation_units where name = 'tavern_webhook';